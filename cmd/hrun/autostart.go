@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/server"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// autostartTimeout bounds the wait for a started server to listen.
+const autostartTimeout = 5 * time.Second
+
+// autostartServer starts the server when nothing listens on addr, as
+// ssh-agent and gpg-agent do. The helper command line starts it when given,
+// hrun --start --daemon otherwise, but in a container, where it would run
+// in the container. The helper must return once it's started.
+func autostartServer(addr, helper string) error {
+	if serverListening(addr) {
+		return nil
+	}
+
+	var argv []string
+	if helper != "" {
+		var err error
+		if argv, err = server.SplitCommandLine(helper); err != nil || len(argv) == 0 {
+			return fmt.Errorf("invalid --autostart-cmd %q", helper)
+		}
+	} else {
+		network, path, err := transport.ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		if network != "unix" && network != "pipe" {
+			return fmt.Errorf("no server to start for %s, use --autostart-cmd", addr)
+		}
+		// A server started here would run the commands in the container
+		// instead of on the host
+		if inContainer() {
+			return fmt.Errorf("no server listens on %s, start it on the host or give --autostart-cmd starting it there", addr)
+		}
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		argv = []string{self, "--start", "--daemon", "--log-level", "warn", "--socket", path}
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("starting the server: %w", err)
+	}
+
+	// The helper may return before the server listens
+	deadline := time.Now().Add(autostartTimeout)
+	for !serverListening(addr) {
+		if time.Now().After(deadline) {
+			return errors.New("the started server doesn't accept connections")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// defaultWaitTimeout is how long --wait waits without a timeout.
+const defaultWaitTimeout = 30 * time.Second
+
+// waitTimeout is the value of --wait, which can be given without one.
+type waitTimeout time.Duration
+
+func (w *waitTimeout) IsBoolFlag() bool { return true }
+
+func (w *waitTimeout) Set(s string) error {
+	switch s {
+	case "true":
+		*w = waitTimeout(defaultWaitTimeout)
+	case "false":
+		*w = 0
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid timeout %q, expected a duration as in 10s", s)
+		}
+		*w = waitTimeout(d)
+	}
+	return nil
+}
+
+func (w *waitTimeout) String() string {
+	return time.Duration(*w).String()
+}
+
+// waitForServer waits up to timeout for a server to listen on addr,
+// retrying with an exponential backoff.
+func waitForServer(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 50 * time.Millisecond
+	for !serverListening(addr) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("no server listening on %s after %s", addr, timeout)
+		}
+		time.Sleep(min(backoff, remaining))
+		backoff = min(2*backoff, 2*time.Second)
+	}
+	return nil
+}
+
+// serverListening reports whether a server may listen on addr, false only
+// when nothing does. The other errors are left for connecting to report.
+func serverListening(addr string) bool {
+	conn, err := transport.Dial(addr, nil)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	return !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// flatpakSpawnUsage is the help of the flatpak-spawn compatibility mode.
+const flatpakSpawnUsage = `Usage: hrun [options] --compat flatpak-spawn [flatpak-spawn options] command [args...]
+       flatpak-spawn [flatpak-spawn options] command [args...]
+
+Run a command on the host through hrun, taking the options of flatpak-spawn.
+
+Options:
+  --host             Run the command on the host, which is required.
+  --env=VAR=VALUE    Set an environment variable for the command.
+  --directory=DIR    Run the command in this directory.
+  --forward-fd=FD    Forward a file descriptor, stdin, stdout and stderr
+                     are always forwarded and only they can be.
+  --watch-bus        Accepted, the command ends along with the client.
+  -v, --verbose      Accepted and ignored.
+`
+
+// flatpakSpawnSandboxOptions are the options of flatpak-spawn only making
+// sense for a sandbox, refused by hrun.
+var flatpakSpawnSandboxOptions = []string{
+	"--sandbox", "--no-network", "--clear-env", "--latest-version",
+	"--expose-pids", "--share-pids", "--sandbox-flag", "--sandbox-expose",
+	"--sandbox-expose-ro", "--sandbox-expose-path", "--sandbox-expose-path-ro",
+	"--sandbox-a11y-own-name", "--app-path", "--usr-path", "--unset-env",
+}
+
+// flatpakSpawn is a command line of flatpak-spawn, as hrun runs it.
+type flatpakSpawn struct {
+	command []string
+	env     []string
+	cwd     string
+}
+
+// splitCompatArgs splits the arguments of hrun, os.Args, into its own
+// options and the ones of the flatpak-spawn compatibility mode: all of them
+// when invoked as flatpak-spawn, the ones after --compat flatpak-spawn
+// otherwise. compat reports whether the mode is on.
+func splitCompatArgs(args []string) (hrunArgs, compatArgs []string, compat bool, err error) {
+	if strings.TrimSuffix(filepath.Base(args[0]), ".exe") == "flatpak-spawn" {
+		return nil, args[1:], true, nil
+	}
+	// Walk the options of hrun like the flag package, skipping the values
+	// of the options taking one, up to the command
+	args = args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == "compat" {
+			rest := args[i+1:]
+			if !hasValue {
+				if len(rest) == 0 {
+					return nil, nil, false, errors.New("the --compat option requires a mode, flatpak-spawn")
+				}
+				value, rest = rest[0], rest[1:]
+			}
+			if value != "flatpak-spawn" {
+				return nil, nil, false, fmt.Errorf("unknown compatibility mode %q, expected flatpak-spawn", value)
+			}
+			return args[:i], rest, true, nil
+		}
+		f := flag.CommandLine.Lookup(name)
+		if f == nil || hasValue {
+			continue
+		}
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolFlag.IsBoolFlag() {
+			i++
+		}
+	}
+	return args, nil, false, nil
+}
+
+// parseFlatpakSpawn parses the options of flatpak-spawn and the command
+// following them, returning flag.ErrHelp when the help is asked.
+func parseFlatpakSpawn(args []string) (*flatpakSpawn, error) {
+	spawn := &flatpakSpawn{}
+	host := false
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue && (name == "--env" || name == "--directory" || name == "--forward-fd") {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("the %s option requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		switch {
+		case name == "-h" || name == "--help":
+			return nil, flag.ErrHelp
+		case name == "--host":
+			host = true
+		case name == "--env":
+			if !strings.Contains(value, "=") {
+				return nil, fmt.Errorf("invalid --env %q, expected VAR=VALUE", value)
+			}
+			spawn.env = append(spawn.env, value)
+		case name == "--directory":
+			spawn.cwd = value
+		case name == "--forward-fd":
+			fd, err := strconv.Atoi(value)
+			if err != nil || fd < 0 {
+				return nil, fmt.Errorf("invalid --forward-fd %q, expected a file descriptor", value)
+			}
+			if fd > 2 {
+				return nil, fmt.Errorf("file descriptor %d can't be forwarded, only stdin, stdout and stderr are", fd)
+			}
+		case name == "--watch-bus" || name == "-v" || name == "--verbose":
+			// Nothing to do, the command already ends with the client
+		case slices.Contains(flatpakSpawnSandboxOptions, name):
+			return nil, fmt.Errorf("the %s option is for sandboxes, hrun only runs commands on the host", name)
+		default:
+			return nil, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	if !host {
+		return nil, errors.New("the --host option is required, hrun only runs commands on the host")
+	}
+	if i == len(args) {
+		return nil, errors.New("no command given")
+	}
+	spawn.command = args[i:]
+	return spawn, nil
+}
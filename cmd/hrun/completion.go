@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// completionSubcommands are the subcommands of hrun, completed along with
+// the host commands.
+var completionSubcommands = []string{
+	"serve", "exec", "shell", "enter", "attach", "ls", "kill", "ping",
+	"status", "stop", "shim", "replay", "admin", "install-service",
+	"completion",
+}
+
+// The completion scripts complete the options of hrun, then its
+// subcommands and the commands allowed by the server, as listed by
+// "hrun completion commands", or any command when it allows any, and
+// finally the arguments of the host command as files.
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for hrun, as in: source <(hrun completion bash)
+
+_hrun_commands() {
+	local commands
+	commands=$(hrun completion commands 2>/dev/null)
+	if [[ -n $commands ]]; then
+		compgen -W "$commands" -- "$1"
+	else
+		compgen -c -- "$1"
+	fi
+}
+
+_hrun() {
+	local cur=${COMP_WORDS[COMP_CWORD]} word i command=
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		word=${COMP_WORDS[i]}
+		case $word in
+		--) command=-- ;;
+		{{.ValueOptions}}) [[ -z $command ]] && ((i++)) ;;
+		-*) ;;
+		exec) [[ -z $command ]] && command=exec || { command=$word; break; } ;;
+		*) [[ -z $command || $command == exec || $command == -- ]] && { command=$word; break; } ;;
+		esac
+	done
+	case $command in
+	"" | exec | --)
+		if [[ $cur == -* && $command != -- ]]; then
+			COMPREPLY=($(compgen -W "{{.Options}}" -- "$cur"))
+		elif [[ -z $command ]]; then
+			COMPREPLY=($(compgen -W "{{.Subcommands}}" -- "$cur") $(_hrun_commands "$cur"))
+		else
+			COMPREPLY=($(_hrun_commands "$cur"))
+		fi
+		;;
+	completion)
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+		;;
+	*)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		;;
+	esac
+}
+
+complete -o filenames -o bashdefault -F _hrun hrun
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef hrun
+# zsh completion for hrun, as in: source <(hrun completion zsh)
+
+_hrun() {
+	local -a options subcommands commands
+	local word command= i
+	options=({{.Options}})
+	subcommands=({{.Subcommands}})
+	for ((i = 2; i < CURRENT; i++)); do
+		word=${words[i]}
+		case $word in
+		--) command=-- ;;
+		{{.ValueOptions}}) [[ -z $command ]] && ((i++)) ;;
+		-*) ;;
+		exec) [[ -z $command ]] && command=exec || { command=$word; break } ;;
+		*) [[ -z $command || $command == exec || $command == -- ]] && { command=$word; break } ;;
+		esac
+	done
+	case $command in
+	"" | exec | --)
+		if [[ $PREFIX == -* && $command != -- ]]; then
+			compadd -- $options
+			return
+		fi
+		[[ -z $command ]] && compadd -- $subcommands
+		commands=(${(f)"$(hrun completion commands 2>/dev/null)"})
+		if (( ${#commands} )); then
+			compadd -- $commands
+		else
+			_command_names -e
+		fi
+		;;
+	completion)
+		compadd -- bash zsh fish
+		;;
+	*)
+		_files
+		;;
+	esac
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+	_hrun "$@"
+else
+	compdef _hrun hrun
+fi
+`)),
+	"fish": template.Must(template.New("fish").Parse(`# fish completion for hrun, as in: hrun completion fish | source
+
+# Print the word completed as the host command, if any yet, or exec
+function __hrun_command
+	set -l tokens (commandline -opc)
+	set -e tokens[1]
+	set -l command
+	set -l skip 0
+	for token in $tokens
+		if test $skip = 1
+			set skip 0
+		else if test "$token" = --
+			set command --
+		else if contains -- $token {{.ValueOptionList}}; and test -z "$command"
+			set skip 1
+		else if string match -q -- '-*' $token
+		else if test -z "$command"; and test $token = exec
+			set command exec
+		else if test -z "$command"; or contains -- $command exec --
+			echo $token
+			return
+		end
+	end
+	echo $command
+end
+
+# Tell whether the word completed as the host command is one of the
+# arguments, "" when there's none yet
+function __hrun_is
+	set -l command (__hrun_command)
+	contains -- "$command" $argv
+end
+
+function __hrun_commands
+	set -l commands (hrun completion commands 2>/dev/null)
+	if test (count $commands) -gt 0
+		printf '%s\n' $commands
+	else
+		__fish_complete_command
+	end
+end
+
+complete -c hrun -f
+{{range .FishOptions}}complete -c hrun -n '__hrun_is "" exec' {{.}}
+{{end}}complete -c hrun -n '__hrun_is ""' -a '{{.Subcommands}}'
+complete -c hrun -n '__hrun_is "" exec --' -a '(__hrun_commands)'
+complete -c hrun -n '__hrun_is completion' -a 'bash zsh fish'
+complete -c hrun -n 'not __hrun_is "" exec -- completion' -F
+`)),
+}
+
+// writeCompletion writes the completion script for shell, bash, zsh or
+// fish.
+func writeCompletion(w io.Writer, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("no completion for %q, only for bash, zsh and fish", shell)
+	}
+
+	var options, valueOptions, fishOptions []string
+	flag.VisitAll(func(f *flag.Flag) {
+		name, fishOption := "--"+f.Name, "-l "+f.Name
+		if len(f.Name) == 1 {
+			name, fishOption = "-"+f.Name, "-s "+f.Name
+		}
+		options = append(options, name)
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolFlag.IsBoolFlag() {
+			valueOptions = append(valueOptions, name)
+			fishOption += " -r"
+		}
+		fishOptions = append(fishOptions, fishOption+" -d "+shellQuote(f.Usage))
+	})
+	return script.Execute(w, map[string]any{
+		"Options":         strings.Join(options, " "),
+		"ValueOptions":    strings.Join(valueOptions, "|"),
+		"ValueOptionList": strings.Join(valueOptions, " "),
+		"Subcommands":     strings.Join(completionSubcommands, " "),
+		"FishOptions":     fishOptions,
+	})
+}
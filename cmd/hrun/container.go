@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// hostRoot is where distrobox and toolbox containers mount the root of the
+// host.
+const hostRoot = "/run/host"
+
+// inContainer reports whether hrun runs in a distrobox or toolbox
+// container, which mount the host at hostRoot.
+func inContainer() bool {
+	if _, err := os.Stat(hostRoot); err != nil {
+		return false
+	}
+	if _, err := os.Stat("/run/.toolboxenv"); err == nil {
+		return true
+	}
+	// distrobox sets it in every container it enters
+	return os.Getenv("CONTAINER_ID") != ""
+}
+
+// hostSocket returns the default socket of the server on the host, as
+// mounted in the container, when socket doesn't exist there: the runtime
+// directory of the user, or /tmp, under hostRoot.
+func hostSocket(socket string) string {
+	if _, err := os.Stat(socket); err == nil {
+		return socket
+	}
+	uid := os.Getuid()
+	candidates := []string{
+		filepath.Join(hostRoot, socket),
+		filepath.Join(hostRoot, "run", "user", strconv.Itoa(uid), "hrun", "hrun.sock"),
+		filepath.Join(hostRoot, "tmp", fmt.Sprintf("hrun-%d.sock", uid)),
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return socket
+}
+
+// hostAccount returns the login shell and the home directory of the user
+// on the host, read from its passwd file in containers, or its $SHELL and
+// home elsewhere. They are empty when unknown.
+func hostAccount() (shell, home string) {
+	if !inContainer() {
+		home, _ = os.UserHomeDir()
+		return os.Getenv("SHELL"), home
+	}
+	data, err := os.ReadFile(filepath.Join(hostRoot, "etc", "passwd"))
+	if err == nil {
+		uid := strconv.Itoa(os.Getuid())
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) == 7 && fields[2] == uid {
+				return fields[6], fields[5]
+			}
+		}
+	}
+	// Users of a directory service aren't listed, their shell in the
+	// container is only good when the host has it too
+	shell = os.Getenv("SHELL")
+	if _, err := os.Stat(filepath.Join(hostRoot, shell)); shell == "" || err != nil {
+		shell = "/bin/sh"
+	}
+	home, _ = os.UserHomeDir()
+	return shell, home
+}
@@ -0,0 +1,98 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// daemonReadyEnv is the file descriptor the daemon reports on once it
+// accepts connections.
+const daemonReadyEnv = "HRUN_DAEMON_READY"
+
+// daemonize starts the server again in the background, in a session of
+// its own, and waits for it to accept connections. The errors of the
+// daemon are shown until then. It returns the exit code of the parent.
+func daemonize() int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding the hrun binary:", err)
+		return 1
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting the daemon:", err)
+		return 1
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting the daemon:", err)
+		return 1
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting the daemon:", err)
+		return 1
+	}
+
+	// The daemon keeps the working directory, for the relative paths of
+	// the options
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonReadyEnv+"=3")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = stderrWriter
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	readyWriter.Close()
+	stderrWriter.Close()
+	devNull.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting the daemon:", err)
+		return 1
+	}
+
+	relayed := make(chan struct{})
+	go func() {
+		io.Copy(os.Stderr, stderrReader)
+		close(relayed)
+	}()
+	if _, err := readyReader.Read(make([]byte, 1)); err != nil {
+		state, _ := cmd.Process.Wait()
+		<-relayed
+		fmt.Fprintln(os.Stderr, "The server exited before accepting connections:", state)
+		return 1
+	}
+	<-relayed
+	return 0
+}
+
+// daemonReady tells the parent that started the daemon it accepts
+// connections, and detaches stderr from it. Without --log-file, the logs
+// are lost from then on.
+func daemonReady() {
+	value := os.Getenv(daemonReadyEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(daemonReadyEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		unix.Dup2(int(devNull.Fd()), int(os.Stderr.Fd()))
+		devNull.Close()
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// daemonReadyEnv is never set on Windows.
+const daemonReadyEnv = "HRUN_DAEMON_READY"
+
+// daemonize is not available on Windows, where the server runs as a
+// service instead.
+func daemonize() int {
+	fmt.Fprintln(os.Stderr, "The --daemon option is not available on Windows, run the server as a service instead")
+	return 2
+}
+
+func daemonReady() {}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// optionEnv returns the environment variable setting the default of a
+// client option, as HRUN_KEEPALIVE_INTERVAL for --keepalive-interval.
+func optionEnv(name string) string {
+	return "HRUN_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envOptions returns the client options taking their default from the
+// environment: the ones of the connection and of the sessions, but -t and
+// -T, whose variables would be the same.
+func envOptions() []string {
+	options := append(slices.Clone(connectionOptions), sessionOptions...)
+	slices.Sort(options)
+	return slices.DeleteFunc(slices.Compact(options), func(name string) bool {
+		return len(name) == 1
+	})
+}
+
+// envAliases are the other variables accepted for an option, when its own
+// isn't set.
+var envAliases = map[string]string{
+	"connect": "HRUN_TARGET",
+}
+
+// optionFromEnv returns the value of the variable of an option, or of its
+// alias, and the name of the variable.
+func optionFromEnv(name string) (string, string) {
+	variable := optionEnv(name)
+	if value := os.Getenv(variable); value != "" {
+		return value, variable
+	}
+	if alias, ok := envAliases[name]; ok {
+		return os.Getenv(alias), alias
+	}
+	return "", variable
+}
+
+// setOptionsFromEnv sets the client options from their environment
+// variables, before the command line overrides them, so that wrappers and
+// container images can configure every invocation, the shims included.
+// Being defaults, the values don't count as set, and don't override the
+// configuration of the server. HRUN_ENV, whose option adds up, is left to
+// setEnvFromEnv.
+func setOptionsFromEnv() error {
+	for _, name := range envOptions() {
+		value, variable := optionFromEnv(name)
+		if value == "" || name == "env" {
+			continue
+		}
+		if err := flag.Lookup(name).Value.Set(value); err != nil {
+			return fmt.Errorf("invalid $%s %q: %w", variable, value, err)
+		}
+	}
+	return nil
+}
+
+// setEnvFromEnv forwards the variables HRUN_ENV lists separated by spaces,
+// unless --env is given, which replaces them rather than adding up. It's
+// called once the command line is parsed, subcommand included.
+func setEnvFromEnv(subcommandFlags *flag.FlagSet) {
+	set := false
+	visitOptions(subcommandFlags, func(name string) {
+		set = set || name == "env"
+	})
+	if set {
+		return
+	}
+	for _, variable := range strings.Fields(os.Getenv(optionEnv("env"))) {
+		flag.Lookup("env").Value.Set(variable)
+	}
+}
+
+// envServerArgs returns the server options set from the environment and not
+// on the command line as arguments, for the units of install-service to
+// start the server with the options the command runs with.
+func envServerArgs() []string {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var args []string
+	for _, name := range envOptions() {
+		value, _ := optionFromEnv(name)
+		if value != "" && !set[name] && slices.Contains(serverOptions, name) {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+	return args
+}
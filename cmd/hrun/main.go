@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/mirkobrombin/hrun/pkg/client"
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/server"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+func main() {
+	helpFlag := flag.Bool("h", false, "Display help")
+	helpFlagLong := flag.Bool("help", false, "Display help")
+	versionFlag := flag.Bool("version", false, "Print the version of hrun")
+	startFlag := flag.Bool("start", false, "Start the server")
+	daemonFlag := flag.Bool("daemon", false, "Start the server in the background")
+	pidFileFlag := flag.String("pid-file", "", "Write the PID of the server to this file")
+	socketFlag := flag.String("socket", transport.DefaultSocket(), "Specify an alternative socket path")
+	socketModeFlag := flag.String("socket-mode", "", "Permissions of the socket, as in 0660")
+	socketOwnerFlag := flag.String("socket-owner", "", "Owner of the socket, by name or UID")
+	socketGroupFlag := flag.String("socket-group", "", "Group of the socket, by name or GID")
+	adminSocketFlag := flag.String("admin-socket", "", "Specify the admin socket path")
+	connectFlag := flag.String("connect", "", "Connect to this address instead of the socket, as in tcp://host:7070")
+	autostartFlag := flag.Bool("autostart", false, "Start the server when it isn't running")
+	autostartCmdFlag := flag.String("autostart-cmd", "", "Command starting the server for --autostart")
+	var waitFlag waitTimeout
+	flag.Var(&waitFlag, "wait", "Wait for the server to listen, up to this long")
+	masterFlag := flag.Bool("M", false, "Keep a master connection open, carrying the commands of the other clients")
+	listFlag := flag.Bool("list", false, "List the commands the server allows")
+	serverInfoFlag := flag.Bool("server-info", false, "Print the version, features and limits of the server as JSON")
+	configFlag := flag.String("config", "", "Load server settings from a YAML, JSON or TOML file")
+	confirmFlag := flag.Bool("confirm", false, "Ask in the terminal to approve the commands outside of the allowlist")
+	confirmDesktopFlag := flag.Bool("confirm-desktop", false, "Ask with a desktop notification to approve the commands outside of the allowlist")
+	regoPolicyFlag := flag.String("rego-policy", "", "Rego policy file deciding whether to run each command")
+	opaFlag := flag.String("opa", "", "Absolute path of the opa binary evaluating the Rego policy")
+	authHookFlag := flag.String("auth-hook", "", "Executable or HTTP webhook deciding whether to run each command")
+	maxSessionsFlag := flag.Int("max-sessions", 0, "Maximum number of sessions running at once")
+	maxUserSessionsFlag := flag.Int("max-user-sessions", 0, "Maximum number of sessions running at once for each user")
+	idleTimeoutFlag := flag.Duration("idle-timeout", 0, "Terminate the sessions without input nor output for this long")
+	maxDurationFlag := flag.Duration("max-duration", 0, "Terminate the sessions running for this long")
+	var maxOutputFlag server.ByteSize
+	flag.Var(&maxOutputFlag, "max-output", "Maximum output of each session, as in 100M")
+	onOutputLimitFlag := flag.String("on-output-limit", "", "What happens to a session reaching --max-output: truncate or kill")
+	rateLimitFlag := flag.Float64("rate-limit", 0, "Connections per second each user may open")
+	rateBurstFlag := flag.Int("rate-burst", 0, "Connections each user may open at once, beyond the rate limit")
+	polkitFlag := flag.String("polkit", "", "Ask polkit about the commands outside of the allowlist: check or prompt")
+	recordDirFlag := flag.String("record-dir", "", "Record the sessions as asciicast files in this directory")
+	auditLogFlag := flag.String("audit-log", "", "Append a JSON record of every command request to this file")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address")
+	pprofAddrFlag := flag.String("pprof-addr", "", "Serve the runtime profiles on this address")
+	otlpEndpointFlag := flag.String("otlp-endpoint", "", "Export traces to this OpenTelemetry collector")
+	logLevelFlag := flag.String("log-level", "info", "Server log level: debug, info, warn or error")
+	logFormatFlag := flag.String("log-format", "text", "Server log format: text or json")
+	logBackendFlag := flag.String("log-backend", "", "Where the server logs go: stderr, journald or syslog")
+	logFileFlag := flag.String("log-file", "", "Write the server logs to this file instead of stderr")
+	logMaxSizeFlag := flag.Int("log-max-size", 10, "Rotate the log file once it reaches this size, in MiB")
+	logMaxBackupsFlag := flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+	splitStderrFlag := flag.Bool("split-stderr", false, "Keep the command stderr separate from the terminal output")
+	noPTYFlag := flag.Bool("T", false, "Disable pty allocation")
+	forcePTYFlag := flag.Bool("t", false, "Force pty allocation")
+	loginFlag := flag.Bool("l", false, "Open the shell of the user as a login shell")
+	loginFlagLong := flag.Bool("login", false, "Open the shell of the user as a login shell")
+	persistFlag := flag.Bool("persist", false, "Keep the command running if the connection is lost")
+	onDisconnectFlag := flag.String("on-disconnect", "", "What happens to the command when the connection is lost: keep, hup or kill")
+	usageFlag := flag.Bool("usage", false, "Print the resources used by the command once it exited")
+	timeoutFlag := flag.Duration("timeout", 0, "Have the host command terminated after this long")
+	keepaliveIntervalFlag := flag.Duration("keepalive-interval", protocol.DefaultKeepaliveInterval, "How often to ping the peer of a session")
+	keepaliveTimeoutFlag := flag.Duration("keepalive-timeout", protocol.DefaultKeepaliveTimeout, "Give up on the peer of a session silent for this long")
+	resumeTimeoutFlag := flag.Duration("resume-timeout", protocol.DefaultResumeTimeout, "How long a session can be resumed once its connection is lost")
+	attachFlag := flag.String("attach", "", "Reattach to a running session")
+	nameFlag := flag.String("name", "", "Name the session so it can be reattached by name")
+	escapeCharFlag := flag.String("escape-char", "~", "Set the escape character, or none to disable it")
+	tokenFileFlag := flag.String("token-file", "", "File with the client tokens, or with the token of this client")
+	tlsCertFlag := flag.String("tls-cert", "", "TLS certificate presented over TCP or QUIC")
+	tlsKeyFlag := flag.String("tls-key", "", "Private key of the TLS certificate")
+	tlsCAFlag := flag.String("tls-ca", "", "Certificate authorities verifying the TLS peer")
+	sshHostKeyFlag := flag.String("ssh-host-key", "", "Private host key of the SSH listener")
+	sshAuthorizedKeysFlag := flag.String("ssh-authorized-keys", "", "Keys of the clients allowed by the SSH listener")
+	tlsAllowedNames := make([]string, 0)
+	flag.Func("tls-allowed-name", "Only serve the TLS clients with this subject alternative name (can be used multiple times)", func(name string) error {
+		tlsAllowedNames = append(tlsAllowedNames, name)
+		return nil
+	})
+	listenAddrs := make([]string, 0)
+	flag.Func("listen", "Listen on this address instead of the socket, as in tcp://0.0.0.0:7070 (can be used multiple times)", func(addr string) error {
+		listenAddrs = append(listenAddrs, addr)
+		return nil
+	})
+	allowedCmds := make([]string, 0)
+	flag.Func("allowed-cmd", "Specify allowed command or pattern (can be used multiple times)", func(cmd string) error {
+		allowedCmds = append(allowedCmds, cmd)
+		return nil
+	})
+	deniedCmds := make([]string, 0)
+	flag.Func("denied-cmd", "Specify denied command or pattern (can be used multiple times)", func(cmd string) error {
+		deniedCmds = append(deniedCmds, cmd)
+		return nil
+	})
+	allowedEnv := make([]string, 0)
+	flag.Func("allowed-env", "Specify environment variable clients may set (can be used multiple times)", func(name string) error {
+		allowedEnv = append(allowedEnv, name)
+		return nil
+	})
+	var allowedUIDs, allowedGIDs []int
+	flag.Func("allowed-uid", "Only serve this user, by name or UID (can be used multiple times)", func(name string) error {
+		uid, err := server.LookupUID(name)
+		allowedUIDs = append(allowedUIDs, uid)
+		return err
+	})
+	flag.Func("allowed-gid", "Only serve members of this group, by name or GID (can be used multiple times)", func(name string) error {
+		gid, err := server.LookupGID(name)
+		allowedGIDs = append(allowedGIDs, gid)
+		return err
+	})
+	env := make([]string, 0)
+	flag.Func("env", "Forward an environment variable as NAME or NAME=value (can be used multiple times)", func(variable string) error {
+		if strings.Contains(variable, "=") {
+			env = append(env, variable)
+		} else if value, ok := os.LookupEnv(variable); ok {
+			env = append(env, variable+"="+value)
+		}
+		return nil
+	})
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+
+	// Invoked through a link named after a host command, every argument is
+	// one of the command. In the flatpak-spawn compatibility mode, the
+	// options following hrun ones are the ones of flatpak-spawn.
+	var hrunArgs, compatArgs []string
+	var compat bool
+	shim := shimName(os.Args[0])
+	if shim == "" {
+		var err error
+		if hrunArgs, compatArgs, compat, err = splitCompatArgs(os.Args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if err := setOptionsFromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flag.CommandLine.Parse(hrunArgs)
+
+	// Help message
+	if *helpFlag || *helpFlagLong {
+		flag.Usage()
+		return
+	}
+	if *versionFlag {
+		printVersion()
+		return
+	}
+
+	// The subcommands with options of their own take them after their
+	// name, args being what follows them
+	subcommand := flag.Arg(0)
+	if argsStart := len(os.Args) - flag.NArg(); argsStart > 0 && os.Args[argsStart-1] == "--" {
+		// "hrun -- ls" runs ls on the host instead of the subcommand
+		subcommand = ""
+	}
+	args := flag.Args()
+	var subcommandFlags *flag.FlagSet
+	watch := new(bool)
+	switch subcommand {
+	case "serve":
+		subcommandFlags = newSubcommandFlags(subcommand, serveUsage, serverOptions)
+	case "exec":
+		subcommandFlags = newSubcommandFlags(subcommand, execUsage, connectionOptions, sessionOptions)
+	case "shell":
+		subcommandFlags = newSubcommandFlags(subcommand, shellUsage, connectionOptions, sessionOptions, shellOptions)
+	case "attach":
+		subcommandFlags = newSubcommandFlags(subcommand, attachUsage, connectionOptions, attachOptions)
+		watch = subcommandFlags.Bool("watch", false, "Only watch the output, without sending input")
+	case "admin":
+		subcommandFlags = newSubcommandFlags(subcommand, adminUsage, adminOptions)
+	}
+	if subcommandFlags != nil {
+		subcommandFlags.Parse(args[1:])
+		args = subcommandFlags.Args()
+	}
+	setEnvFromEnv(subcommandFlags)
+	switch {
+	case subcommand == "serve" && len(args) > 0,
+		subcommand == "exec" && len(args) == 0,
+		subcommand == "shell" && len(args) > 0,
+		subcommand == "attach" && len(args) != 1,
+		subcommand == "admin" && len(args) == 0:
+		subcommandFlags.Usage()
+		os.Exit(2)
+	case subcommand == "serve":
+		*startFlag = true
+	}
+	if compat && *startFlag {
+		fmt.Fprintln(os.Stderr, "The --compat option can't be used with --start")
+		os.Exit(2)
+	}
+	// The completion scripts don't need the server, unlike the commands
+	// they complete
+	if subcommand == "completion" && flag.NArg() == 2 && flag.Arg(1) != "commands" {
+		if err := writeCompletion(os.Stdout, flag.Arg(1)); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing the completion:", err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	// Server mode
+	if *startFlag {
+		// Flags explicitly set on the command line override the config file
+		overrides := func(cfg *server.Config) {
+			visitOptions(subcommandFlags, func(name string) {
+				switch name {
+				case "socket":
+					cfg.Socket = *socketFlag
+				case "socket-mode":
+					cfg.SocketMode = *socketModeFlag
+				case "socket-owner":
+					cfg.SocketOwner = *socketOwnerFlag
+				case "socket-group":
+					cfg.SocketGroup = *socketGroupFlag
+				case "admin-socket":
+					cfg.AdminSocket = *adminSocketFlag
+				case "listen":
+					cfg.Listen = listenAddrs
+				case "allowed-cmd":
+					cfg.AllowedCmds = allowedCmds
+				case "denied-cmd":
+					cfg.DeniedCmds = deniedCmds
+				case "allowed-env":
+					cfg.AllowedEnv = allowedEnv
+				case "allowed-uid":
+					cfg.AllowedUIDs = allowedUIDs
+				case "allowed-gid":
+					cfg.AllowedGIDs = allowedGIDs
+				case "record-dir":
+					cfg.RecordDir = *recordDirFlag
+				case "audit-log":
+					cfg.AuditLog = *auditLogFlag
+				case "pid-file":
+					cfg.PIDFile = *pidFileFlag
+				case "keepalive-interval":
+					cfg.KeepaliveInterval = *keepaliveIntervalFlag
+				case "keepalive-timeout":
+					cfg.KeepaliveTimeout = *keepaliveTimeoutFlag
+				case "resume-timeout":
+					cfg.ResumeTimeout = *resumeTimeoutFlag
+				case "rego-policy":
+					cfg.RegoPolicy = *regoPolicyFlag
+				case "opa":
+					cfg.OPA = *opaFlag
+				case "auth-hook":
+					cfg.AuthHook = *authHookFlag
+				case "max-sessions":
+					cfg.MaxSessions = *maxSessionsFlag
+				case "max-user-sessions":
+					cfg.MaxUserSessions = *maxUserSessionsFlag
+				case "idle-timeout":
+					cfg.IdleTimeout = *idleTimeoutFlag
+				case "max-duration":
+					cfg.MaxDuration = *maxDurationFlag
+				case "max-output":
+					cfg.MaxOutput = maxOutputFlag
+				case "on-output-limit":
+					cfg.OnOutputLimit = *onOutputLimitFlag
+				case "rate-limit":
+					cfg.RateLimit = *rateLimitFlag
+				case "rate-burst":
+					cfg.RateBurst = *rateBurstFlag
+				case "polkit":
+					cfg.Polkit = *polkitFlag
+				case "token-file":
+					cfg.TokenFile = *tokenFileFlag
+				case "tls-cert":
+					cfg.TLSCert = *tlsCertFlag
+				case "tls-key":
+					cfg.TLSKey = *tlsKeyFlag
+				case "tls-ca":
+					cfg.TLSCA = *tlsCAFlag
+				case "tls-allowed-name":
+					cfg.TLSAllowedNames = tlsAllowedNames
+				case "ssh-host-key":
+					cfg.SSHHostKey = *sshHostKeyFlag
+				case "ssh-authorized-keys":
+					cfg.SSHAuthorizedKeys = *sshAuthorizedKeysFlag
+				case "metrics-addr":
+					cfg.MetricsAddr = *metricsAddrFlag
+				case "pprof-addr":
+					cfg.PprofAddr = *pprofAddrFlag
+				case "log-backend":
+					cfg.LogBackend = *logBackendFlag
+				case "otlp-endpoint":
+					cfg.OTLPEndpoint = *otlpEndpointFlag
+				case "on-disconnect":
+					cfg.OnDisconnect = *onDisconnectFlag
+				}
+			})
+		}
+
+		srv := &server.Server{ConfigPath: *configFlag, Overrides: overrides, Ready: daemonReady}
+		if err := srv.Reload(); err != nil {
+			slog.Error("Error loading configuration", "err", err)
+			os.Exit(1)
+		}
+
+		if *confirmFlag || *confirmDesktopFlag {
+			path, err := server.ApprovedCmdsPath()
+			if err != nil {
+				log.Fatal(err)
+			}
+			approved, err := server.LoadApprovedCmds(path)
+			if err != nil {
+				log.Fatalf("Error reading the approved commands: %v", err)
+			}
+			switch {
+			case *confirmFlag && *confirmDesktopFlag:
+				log.Fatal("The --confirm and --confirm-desktop options can't be used together")
+			case *confirmDesktopFlag:
+				srv.Approver = server.NewNotifier(approved)
+			case !term.IsTerminal(int(os.Stdin.Fd())):
+				log.Fatal("The --confirm option needs the server to run in a terminal")
+			default:
+				srv.Approver = server.NewConfirmer(os.Stdin, os.Stderr, approved)
+			}
+		}
+
+		// Refuse to start twice, then go to the background with the config
+		// checked
+		if pidFile := srv.Config().PIDFile; pidFile != "" {
+			if err := server.CheckPIDFile(pidFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *daemonFlag && os.Getenv(daemonReadyEnv) == "" {
+			if *confirmFlag {
+				log.Fatal("The --daemon option can't be used with --confirm")
+			}
+			os.Exit(daemonize())
+		}
+
+		// Set up the logs once the config file picked their backend
+		level, err := server.ParseLogLevel(*logLevelFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.LogLevel.Set(level)
+		backend := srv.Config().LogBackend
+		var logOutput io.Writer = os.Stderr
+		if *logFileFlag != "" {
+			if backend != server.LogBackendStderr {
+				log.Fatalf("The --log-file option can't be used with the %s log backend", backend)
+			}
+			logFile, err := server.OpenRotatingFile(*logFileFlag, int64(*logMaxSizeFlag)<<20, *logMaxBackupsFlag)
+			if err != nil {
+				log.Fatalf("Error opening the log file: %v", err)
+			}
+			defer logFile.Close()
+			logOutput = logFile
+		}
+		if err := server.SetupLogging(backend, *logFormatFlag, logOutput); err != nil {
+			log.Fatal(err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+		defer stop()
+		go reloadOnHangup(srv)
+		if err := srv.Serve(ctx); err != nil {
+			slog.Error("Error starting the server", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Client mode
+	token, err := client.ReadClientToken(*tokenFileFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the token file:", err)
+		os.Exit(2)
+	}
+	creds := client.Credentials{Token: token}
+	if *tlsCertFlag != "" || *tlsKeyFlag != "" || *tlsCAFlag != "" {
+		creds.TLS, err = transport.ClientTLSConfig(*tlsCertFlag, *tlsKeyFlag, *tlsCAFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading the TLS certificates:", err)
+			os.Exit(2)
+		}
+	}
+	// The client reaches the server on its socket, or on another address
+	address := *socketFlag
+	if *connectFlag != "" {
+		address = *connectFlag
+	}
+	defaultSocket := address == transport.DefaultSocket()
+	// In distrobox and toolbox containers, the default socket may only be
+	// reachable through the mount of the host
+	if defaultSocket && inContainer() {
+		address = hostSocket(address)
+	}
+	if defaultSocket {
+		if err := transport.CheckSocketOwner(address); err != nil {
+			fmt.Fprintln(os.Stderr, "Refusing to connect to the default socket:", err)
+			os.Exit(2)
+		}
+	}
+	attach := *attachFlag
+	// Start the server or wait for it before talking to it, replaying and
+	// installing the service don't
+	if subcommand != "replay" && subcommand != "install-service" {
+		if *autostartFlag {
+			if err := autostartServer(address, *autostartCmdFlag); err != nil {
+				fmt.Fprintln(os.Stderr, "Error starting the server:", err)
+				os.Exit(protocol.ExitConnectionError)
+			}
+		}
+		if waitFlag > 0 {
+			if err := waitForServer(address, time.Duration(waitFlag)); err != nil {
+				fmt.Fprintln(os.Stderr, "Error waiting for the server:", err)
+				os.Exit(protocol.ExitConnectionError)
+			}
+		}
+	}
+	if *masterFlag {
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] -M")
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		os.Exit(client.RunMaster(ctx, address, creds, *keepaliveIntervalFlag, *keepaliveTimeoutFlag))
+	}
+	if *listFlag {
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] --list")
+			os.Exit(2)
+		}
+		os.Exit(client.ListAllowed(address, creds))
+	}
+	if *serverInfoFlag {
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] --server-info")
+			os.Exit(2)
+		}
+		os.Exit(client.PrintServerInfo(address, creds))
+	}
+	switch subcommand {
+	case "attach":
+		attach = args[0]
+	case "ls":
+		os.Exit(client.ListSessions(address, creds))
+	case "replay":
+		replayFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+		speed := replayFlags.Float64("speed", 1, "Playback speed multiplier")
+		replayFlags.Parse(flag.Args()[1:])
+		if replayFlags.NArg() != 1 || *speed <= 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun replay [--speed N] <file.cast>")
+			os.Exit(2)
+		}
+		os.Exit(replayCast(replayFlags.Arg(0), *speed))
+	case "kill":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun kill <name|id>")
+			os.Exit(2)
+		}
+		os.Exit(client.KillSession(address, creds, flag.Arg(1)))
+	case "install-service":
+		serviceFlags := flag.NewFlagSet("install-service", flag.ExitOnError)
+		system := serviceFlags.Bool("system", false, "Install a system service instead of a user one")
+		withSocket := serviceFlags.Bool("socket-unit", false, "Also install a socket unit starting the server on demand")
+		toStdout := serviceFlags.Bool("print", false, "Print the units instead of installing them")
+		serviceFlags.Parse(flag.Args()[1:])
+		if serviceFlags.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [server options] install-service [--system] [--socket-unit] [--print]")
+			os.Exit(2)
+		}
+		if *withSocket && len(listenAddrs) > 0 {
+			fmt.Fprintln(os.Stderr, "A socket unit only creates the unix socket, it can't be used with --listen")
+			os.Exit(2)
+		}
+		// The server options are the ones of the environment and the
+		// arguments before the subcommand
+		socket := &server.Config{Socket: *socketFlag, SocketMode: *socketModeFlag, SocketOwner: *socketOwnerFlag, SocketGroup: *socketGroupFlag}
+		serverArgs := append(envServerArgs(), os.Args[1:len(os.Args)-flag.NArg()]...)
+		os.Exit(installService(serverArgs, socket, *system, *withSocket, *toStdout))
+	case "shim":
+		shimFlags := flag.NewFlagSet("shim", flag.ExitOnError)
+		dir := shimFlags.String("dir", "", "Directory of the shims")
+		script := shimFlags.Bool("script", false, "Write scripts running hrun with the options before shim instead of links")
+		force := shimFlags.Bool("force", false, "Replace the existing files")
+		shimFlags.Parse(flag.Args()[1:])
+		commands := shimFlags.Args()
+		for _, command := range commands {
+			if strings.ContainsRune(command, filepath.Separator) || shimName(command) == "" {
+				fmt.Fprintf(os.Stderr, "Can't create a shim named %q\n", command)
+				os.Exit(2)
+			}
+		}
+		// Without commands, the ones of the allowlist of the server
+		if len(commands) == 0 {
+			allowlist, code := client.QueryAllowlist(address, creds)
+			if allowlist == nil {
+				os.Exit(code)
+			}
+			if len(allowlist.Allowed) == 0 {
+				fmt.Fprintln(os.Stderr, "The server allows any command, name the ones to create shims for")
+				os.Exit(2)
+			}
+			if commands = shimCommands(allowlist); len(commands) == 0 {
+				fmt.Fprintln(os.Stderr, "The allowlist of the server only has patterns, name the commands to create shims for")
+				os.Exit(2)
+			}
+		}
+		if *dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error finding the shim directory:", err)
+				os.Exit(1)
+			}
+			*dir = filepath.Join(home, ".local", "bin")
+		}
+		// The scripts run hrun with the options given before shim
+		os.Exit(installShims(*dir, commands, os.Args[1:len(os.Args)-flag.NArg()], *script, *force))
+	case "ping":
+		pingFlags := flag.NewFlagSet("ping", flag.ExitOnError)
+		count := pingFlags.Int("count", 1, "Number of pings, 0 to ping until interrupted")
+		interval := pingFlags.Duration("interval", time.Second, "Time between pings")
+		timeout := pingFlags.Duration("timeout", 5*time.Second, "Time to wait for each answer")
+		pingFlags.Parse(flag.Args()[1:])
+		if pingFlags.NArg() != 0 || *count < 0 || *interval <= 0 || *timeout <= 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] ping [--count N] [--interval D] [--timeout D]")
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		os.Exit(client.PingServer(ctx, address, creds, *count, *interval, *timeout))
+	case "status":
+		statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+		jsonOutput := statusFlags.Bool("json", false, "Print the status as JSON")
+		statusFlags.Parse(flag.Args()[1:])
+		if statusFlags.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] status [--json]")
+			os.Exit(2)
+		}
+		os.Exit(client.ShowStatus(address, creds, *jsonOutput))
+	case "stop":
+		stopFlags := flag.NewFlagSet("stop", flag.ExitOnError)
+		now := stopFlags.Bool("now", false, "Terminate the running commands instead of waiting for them")
+		stopFlags.Parse(flag.Args()[1:])
+		if stopFlags.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] stop [--now]")
+			os.Exit(2)
+		}
+		os.Exit(client.StopServer(address, creds, *now))
+	case "completion":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun completion <bash|zsh|fish>")
+			os.Exit(2)
+		}
+		// The commands allowed by the server, for the completion scripts,
+		// none when it allows any
+		allowlist, code := client.QueryAllowlist(address, creds)
+		if allowlist == nil {
+			os.Exit(code)
+		}
+		if len(allowlist.Allowed) > 0 {
+			for _, command := range shimCommands(allowlist) {
+				fmt.Println(command)
+			}
+		}
+		os.Exit(0)
+	case "admin":
+		adminSocket := *adminSocketFlag
+		if adminSocket == "" {
+			adminSocket = (&server.Config{Socket: *socketFlag}).AdminSocketPath()
+		}
+		os.Exit(client.RunAdmin(adminSocket, args))
+	}
+
+	var command []string
+	var cwd string
+	var login bool
+	switch {
+	case shim != "":
+		command = append([]string{shim}, os.Args[1:]...)
+	case subcommand == "enter" || *loginFlag || *loginFlagLong:
+		if subcommand == "enter" && flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: hrun [options] enter")
+			os.Exit(2)
+		}
+		if subcommand != "enter" && (subcommand == "exec" || len(args) > 0) {
+			fmt.Fprintln(os.Stderr, "The --login option opens a shell, it takes no command")
+			os.Exit(2)
+		}
+		// A login shell of the host user, in its home
+		if runtime.GOOS == "windows" {
+			command = []string{os.Getenv("ComSpec")}
+			break
+		}
+		shell, home := hostAccount()
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		command, cwd, login = []string{shell}, home, true
+	case compat:
+		spawn, err := parseFlatpakSpawn(compatArgs)
+		if errors.Is(err, flag.ErrHelp) {
+			fmt.Print(flatpakSpawnUsage)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "flatpak-spawn:", err)
+			os.Exit(2)
+		}
+		command, cwd = spawn.command, spawn.cwd
+		env = append(env, spawn.env...)
+	case subcommand == "exec":
+		command = args
+	case subcommand == "shell" || len(args) == 0:
+		if runtime.GOOS == "windows" {
+			command = []string{os.Getenv("ComSpec")}
+		} else {
+			shell, _ := hostAccount()
+			command = []string{"sh", "-c", shell}
+		}
+	default:
+		command = args
+	}
+
+	if *noPTYFlag && *forcePTYFlag {
+		fmt.Fprintln(os.Stderr, "The -T and -t options can't be used together")
+		os.Exit(2)
+	}
+
+	// Without an explicit choice, only allocate a pty when used from a
+	// terminal so pipelines like "echo x | hrun cat" just stream the data
+	noPTY := *noPTYFlag
+	if !*noPTYFlag && !*forcePTYFlag {
+		noPTY = !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd()))
+	}
+
+	// Named sessions are meant to be reattached, so they are kept unless
+	// told otherwise
+	onDisconnect := *onDisconnectFlag
+	if onDisconnect == "" && (*persistFlag || *nameFlag != "") {
+		onDisconnect = protocol.OnDisconnectKeep
+	}
+	if onDisconnect != "" && !protocol.ValidOnDisconnect(onDisconnect) {
+		fmt.Fprintln(os.Stderr, "The --on-disconnect option must be keep, hup or kill")
+		os.Exit(2)
+	}
+
+	escapeChar := client.NoEscapeChar
+	switch {
+	case *escapeCharFlag == "none":
+	case len(*escapeCharFlag) == 1:
+		escapeChar = int((*escapeCharFlag)[0])
+	default:
+		fmt.Fprintln(os.Stderr, "The escape character must be a single character or none")
+		os.Exit(2)
+	}
+
+	c := &client.Client{
+		Socket:      address,
+		Credentials: creds,
+		EscapeChar:  escapeChar,
+		Attach:      attach,
+		Watch:       *watch,
+
+		KeepaliveInterval: *keepaliveIntervalFlag,
+		KeepaliveTimeout:  *keepaliveTimeoutFlag,
+		ResumeTimeout:     *resumeTimeoutFlag,
+	}
+	os.Exit(c.Run(context.Background(), protocol.Command{
+		Command:      command,
+		SplitStderr:  *splitStderrFlag,
+		NoPTY:        noPTY,
+		Env:          env,
+		Cwd:          cwd,
+		Persistent:   onDisconnect == protocol.OnDisconnectKeep,
+		OnDisconnect: onDisconnect,
+		Name:         *nameFlag,
+		Usage:        *usageFlag,
+		Timeout:      timeoutFlag.Seconds(),
+		Login:        login,
+	}))
+}
+
+// reloadOnHangup reloads the configuration of srv on every SIGHUP.
+func reloadOnHangup(srv *server.Server) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	for range hupCh {
+		slog.Info("Reload signal received, reloading configuration")
+		if err := srv.Reload(); err != nil {
+			slog.Error("Error reloading configuration, keeping the previous one", "err", err)
+			continue
+		}
+		slog.Info("Configuration reloaded")
+	}
+}
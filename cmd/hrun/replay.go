@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/mirkobrombin/hrun/pkg/server"
+)
+
+// maxCastLine bounds a single line of a recording, output events are
+// rarely larger than the 32 KiB read by the server.
+const maxCastLine = 4 << 20
+
+// replayKey is a key pressed during a replay.
+type replayKey int
+
+const (
+	replayPause replayKey = iota
+	replayQuit
+)
+
+// replayCast plays an asciicast v2 recording on the terminal, with the
+// delays between events divided by speed. When stdin is a terminal, space
+// pauses and resumes the playback and q stops it.
+func replayCast(path string, speed float64) int {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("Error opening the recording:", err)
+		return 1
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxCastLine)
+	if !scanner.Scan() {
+		log.Println("Error reading the recording: missing header")
+		return 1
+	}
+	var header server.CastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		log.Println("Error decoding the recording header:", err)
+		return 1
+	}
+	if header.Version != 2 {
+		log.Printf("Unsupported asciicast version %d", header.Version)
+		return 1
+	}
+
+	// Read single keys to control the playback, the output then needs
+	// explicit carriage returns
+	keys := make(chan replayKey)
+	rawMode := term.IsTerminal(int(os.Stdin.Fd()))
+	if rawMode {
+		oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			log.Println("Error setting terminal to raw mode:", err)
+			return 1
+		}
+		defer term.Restore(int(os.Stdin.Fd()), oldState)
+		go readReplayKeys(keys)
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var event []any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			log.Printf("Skipping malformed event: %s", scanner.Bytes())
+			continue
+		}
+		at, _ := event[0].(float64)
+		eventType, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if eventType != "o" {
+			continue
+		}
+
+		if !waitReplay(time.Duration((at-last)/speed*float64(time.Second)), keys) {
+			fmt.Fprint(os.Stderr, "\r\nReplay stopped.\r\n")
+			return 0
+		}
+		last = at
+
+		out := []byte(data)
+		if rawMode {
+			out = bytes.ReplaceAll(bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+		}
+		os.Stdout.Write(out)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("Error reading the recording:", err)
+		return 1
+	}
+	return 0
+}
+
+// waitReplay waits for the next event, honoring pauses. It returns false
+// when the user stops the playback.
+func waitReplay(delay time.Duration, keys <-chan replayKey) bool {
+	if delay < 0 {
+		delay = 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	started := time.Now()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case key := <-keys:
+			if key == replayQuit {
+				return false
+			}
+
+			// Pause until space is pressed again, then wait for the rest
+			// of the delay
+			timer.Stop()
+			delay -= time.Since(started)
+			if key = <-keys; key == replayQuit {
+				return false
+			}
+			started = time.Now()
+			timer.Reset(max(delay, 0))
+		}
+	}
+}
+
+// readReplayKeys translates the keys pressed by the user to playback
+// controls.
+func readReplayKeys(keys chan<- replayKey) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(buf); err != nil {
+			return
+		}
+		switch buf[0] {
+		case ' ':
+			keys <- replayPause
+		case 'q', 3: // Ctrl-C
+			keys <- replayQuit
+		}
+	}
+}
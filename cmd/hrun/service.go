@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mirkobrombin/hrun/pkg/server"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// serviceUnit runs the server with the flags of the command line, as a
+// Type=notify service.
+const serviceUnit = `[Unit]
+Description=hrun server
+Documentation=https://github.com/mirkobrombin/hrun
+
+[Service]
+Type=notify
+ExecStart=%s
+ExecReload=kill -HUP $MAINPID
+Restart=on-failure
+WatchdogSec=30s
+%s`
+
+// socketUnit creates the socket of the server, starting it on the first
+// connection.
+const socketUnit = `[Unit]
+Description=hrun server socket
+
+[Socket]
+ListenStream=%s
+SocketMode=%s
+%s
+[Install]
+WantedBy=sockets.target
+`
+
+// installService writes the systemd units running the server with flags,
+// for the user or the whole system, along with a socket unit creating the
+// socket of cfg, with its permissions, when requested. With toStdout, the
+// units are printed instead.
+func installService(flags []string, cfg *server.Config, system, withSocket, toStdout bool) int {
+	socket := cfg.Socket
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding the hrun binary:", err)
+		return 1
+	}
+	if withSocket && (transport.IsNamedPipe(socket) || transport.IsAbstractSocket(socket) || !filepath.IsAbs(socket)) {
+		fmt.Fprintln(os.Stderr, "A socket unit needs an absolute --socket path")
+		return 2
+	}
+	// The default socket depends on who runs hrun, systemd runs the system
+	// units without a runtime directory
+	if withSocket && system && socket == transport.DefaultSocket() {
+		fmt.Fprintln(os.Stderr, "A system socket unit needs a --socket path")
+		return 2
+	}
+
+	// The server is started with the flags given before install-service
+	argv := []string{systemdQuote(self), "--start"}
+	for _, arg := range flags {
+		if arg != "--start" && arg != "-start" {
+			argv = append(argv, systemdQuote(arg))
+		}
+	}
+	install := "\n[Install]\nWantedBy=default.target\n"
+	if system {
+		install = "\n[Install]\nWantedBy=multi-user.target\n"
+	}
+	// Socket activated services are enabled through their socket
+	if withSocket {
+		install = ""
+	}
+	units := [][2]string{{"hrun.service", fmt.Sprintf(serviceUnit, strings.Join(argv, " "), install)}}
+	if withSocket {
+		mode := cfg.SocketMode
+		if mode == "" {
+			mode = "0600"
+		}
+		ownership := ""
+		if cfg.SocketOwner != "" {
+			ownership += "SocketUser=" + cfg.SocketOwner + "\n"
+		}
+		if cfg.SocketGroup != "" {
+			ownership += "SocketGroup=" + cfg.SocketGroup + "\n"
+		}
+		units = append(units, [2]string{"hrun.socket", fmt.Sprintf(socketUnit, strings.ReplaceAll(socket, "%", "%%"), mode, ownership)})
+	}
+
+	if toStdout {
+		for _, unit := range units {
+			fmt.Printf("# %s\n%s\n", unit[0], unit[1])
+		}
+		return 0
+	}
+
+	dir := "/etc/systemd/system"
+	if !system {
+		config, err := os.UserConfigDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error finding the user units:", err)
+			return 1
+		}
+		dir = filepath.Join(config, "systemd", "user")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating the unit directory:", err)
+		return 1
+	}
+	for _, unit := range units {
+		path := filepath.Join(dir, unit[0])
+		if err := os.WriteFile(path, []byte(unit[1]), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing the unit:", err)
+			return 1
+		}
+		fmt.Println("Wrote", path)
+	}
+
+	systemctl := "systemctl --user"
+	if system {
+		systemctl = "systemctl"
+	}
+	enable := "hrun.service"
+	if withSocket {
+		enable = "hrun.socket"
+	}
+	fmt.Printf("Enable it with: %s daemon-reload && %s enable --now %s\n", systemctl, systemctl, enable)
+	return 0
+}
+
+// systemdQuote quotes an argument of ExecStart, escaping the specifiers
+// and variables systemd would expand.
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\;") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + replacer.Replace(arg) + `"`
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// shimScript runs a host command through hrun with the options of the
+// command line that created it.
+const shimScript = `#!/bin/sh
+exec %s -- %s "$@"
+`
+
+// shimName returns the host command hrun stands for when invoked through a
+// link named after it, as docker for a link named docker, or "" when
+// invoked as hrun or as flatpak-spawn.
+func shimName(argv0 string) string {
+	name := strings.TrimSuffix(filepath.Base(argv0), ".exe")
+	if name == "hrun" || name == "flatpak-spawn" {
+		return ""
+	}
+	return name
+}
+
+// shimCommands returns the commands of allowlist a shim can stand for:
+// the allowed names and the binaries of the allowed paths, without globs
+// nor regular expressions, and the aliases, unless they are denied.
+func shimCommands(allowlist *protocol.Allowlist) []string {
+	var commands []string
+	for _, pattern := range allowlist.Allowed {
+		if strings.HasPrefix(pattern, "^") || strings.ContainsAny(pattern, `*?[\`) {
+			continue
+		}
+		commands = append(commands, filepath.Base(pattern))
+	}
+	for name := range allowlist.Aliases {
+		commands = append(commands, name)
+	}
+	commands = slices.DeleteFunc(commands, func(name string) bool {
+		for _, pattern := range allowlist.Denied {
+			if matched, _ := path.Match(pattern, name); matched && !strings.Contains(pattern, "/") {
+				return true
+			}
+		}
+		return shimName(name) == ""
+	})
+	sort.Strings(commands)
+	return slices.Compact(commands)
+}
+
+// installShims creates a shim in dir for each command, a link to hrun or,
+// with script, a script running hrun with options, and returns the exit
+// code for the client. Existing files are only replaced with force.
+func installShims(dir string, commands, options []string, script, force bool) int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding the hrun binary:", err)
+		return 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating the shim directory:", err)
+		return 1
+	}
+	argv := []string{shellQuote(self)}
+	for _, option := range options {
+		argv = append(argv, shellQuote(option))
+	}
+
+	code := 0
+	for _, command := range commands {
+		shim := filepath.Join(dir, command)
+		if target, err := os.Readlink(shim); err == nil && target == self && !script {
+			continue
+		}
+		if _, err := os.Lstat(shim); err == nil {
+			if !force {
+				fmt.Fprintf(os.Stderr, "Skipping %s, the file exists (use --force to replace it)\n", shim)
+				code = 1
+				continue
+			}
+			if err := os.Remove(shim); err != nil {
+				fmt.Fprintln(os.Stderr, "Error replacing the shim:", err)
+				return 1
+			}
+		}
+		if script {
+			err = os.WriteFile(shim, []byte(fmt.Sprintf(shimScript, strings.Join(argv, " "), shellQuote(command))), 0755)
+		} else {
+			err = os.Symlink(self, shim)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating the shim:", err)
+			return 1
+		}
+		fmt.Println("Created", shim)
+	}
+	return code
+}
+
+// shellQuote quotes an argument for sh.
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\$`;&|<>()*?[]{}~#!") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// The options of the subcommands, by group, named as the hrun options they
+// are. The bare form of hrun takes all of them.
+var (
+	serverOptions = []string{
+		"daemon", "pid-file", "config", "allowed-cmd", "denied-cmd",
+		"confirm", "confirm-desktop", "rego-policy", "opa", "auth-hook", "polkit",
+		"allowed-env", "allowed-uid", "allowed-gid", "token-file",
+		"max-sessions", "max-user-sessions", "idle-timeout", "max-duration",
+		"max-output", "on-output-limit", "rate-limit", "rate-burst",
+		"socket", "socket-mode", "socket-owner", "socket-group", "listen",
+		"tls-cert", "tls-key", "tls-ca", "tls-allowed-name", "ssh-host-key",
+		"ssh-authorized-keys", "admin-socket", "record-dir", "audit-log",
+		"metrics-addr", "pprof-addr", "log-level", "log-format",
+		"log-backend", "log-file", "log-max-size", "log-max-backups",
+		"otlp-endpoint", "keepalive-interval", "keepalive-timeout",
+		"resume-timeout", "on-disconnect",
+	}
+	connectionOptions = []string{
+		"socket", "connect", "token-file", "tls-cert", "tls-key", "tls-ca",
+		"autostart", "autostart-cmd", "wait",
+	}
+	attachOptions = []string{
+		"escape-char", "keepalive-interval", "keepalive-timeout",
+		"resume-timeout",
+	}
+	sessionOptions = []string{
+		"split-stderr", "T", "t", "env", "usage", "timeout",
+		"keepalive-interval", "keepalive-timeout", "resume-timeout",
+		"persist", "on-disconnect", "name", "escape-char",
+	}
+	shellOptions = []string{"l", "login"}
+	adminOptions = []string{"socket", "admin-socket"}
+)
+
+// newSubcommandFlags returns the flag set of a subcommand, taking the hrun
+// options of the groups given and printing usage for --help.
+func newSubcommandFlags(name, usage string, groups ...[]string) *flag.FlagSet {
+	flags := flag.NewFlagSet("hrun "+name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	for _, group := range groups {
+		for _, option := range group {
+			if flags.Lookup(option) != nil {
+				continue
+			}
+			f := flag.CommandLine.Lookup(option)
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	return flags
+}
+
+// visitOptions calls visit with the name of every hrun option set on the
+// command line, before the subcommand or, in its flag set, after it.
+func visitOptions(subcommandFlags *flag.FlagSet, visit func(name string)) {
+	flag.Visit(func(f *flag.Flag) {
+		visit(f.Name)
+	})
+	if subcommandFlags != nil {
+		subcommandFlags.Visit(func(f *flag.Flag) {
+			visit(f.Name)
+		})
+	}
+}
+
+// printVersion prints the version of hrun, with the commit and the date of
+// the build when known, for bug reports.
+func printVersion() {
+	build := protocol.ReadBuild()
+	fmt.Println("hrun", build.Version)
+	if build.Commit != "" {
+		fmt.Println("Commit:    ", build.Commit)
+	}
+	if build.Date != "" {
+		fmt.Println("Built:     ", build.Date)
+	}
+	fmt.Printf("Go:         %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("Protocol:   %d (down to %d)\n", protocol.ProtocolVersion, protocol.MinProtocolVersion)
+}
+
+const usage = `Usage: hrun [options] [command] [args...]
+       hrun <subcommand> [options] [args...]
+
+Run commands on the host from a container or a sandbox, through the hrun
+server running there. Without a subcommand, hrun runs the command given, or
+a shell on the host, as hrun exec and hrun shell do.
+
+Subcommands:
+  serve              Start the server.
+  exec               Run a command on the host.
+  shell              Open a shell on the host.
+  enter              Open a login shell of the user on the host, in its
+                     home directory.
+  attach             Reattach to a session.
+  ls                 List the sessions on the host.
+  kill <name|id>     Terminate a session, with SIGTERM and then SIGKILL
+                     after 5 seconds.
+  ping [--count N] [--interval D] [--timeout D]
+                     Check that the server answers, printing the time to
+                     connect and the round trip, --count times (0 until
+                     interrupted) every --interval, waiting up to --timeout
+                     (default: 5s) for each answer. It fails when one goes
+                     unanswered.
+  status [--json]    Show the state of the server.
+  stop [--now]       Shut the server down once the running commands exited,
+                     or right away terminating them with --now. Like status,
+                     only for root and the user running the server.
+  shim [--dir DIR] [--script] [--force] [command...]
+                     Link the given commands, or the ones allowed by the
+                     server, to hrun in --dir (default: ~/.local/bin), or
+                     with --script write scripts running them with the
+                     options given before shim, replacing existing files
+                     with --force.
+  replay [--speed N] <file.cast>
+                     Play a session recording.
+  admin              Manage the server through the admin socket.
+  completion <bash|zsh|fish>
+                     Print the completion script of a shell, completing
+                     the commands allowed by the server, as printed by
+                     "hrun completion commands".
+  install-service [--system] [--socket-unit] [--print]
+                     Write a systemd user service, or a system one with
+                     --system, starting the server with the options given
+                     before install-service or by HRUN_ variables, and a
+                     socket unit starting it on demand with --socket-unit.
+
+Run "hrun <subcommand> --help" for the options of serve, exec, shell, attach
+and admin. The others take the connection options before the subcommand,
+as in "hrun --socket /tmp/hrun.sock ls".
+
+Options:
+  -h, --help         Display this help message.
+  --version          Print the version of hrun, the commit and the date of
+                     its build, to compare with the "Version", "Commit" and
+                     "BuildDate" of --server-info.
+  --start            Start the server, taking the options of hrun serve.
+  -M                 Keep a master connection to the server open until
+                     interrupted, carrying the commands of the other hrun
+                     invocations with the same --socket or --connect, which
+                     then skip connecting and authenticating.
+  --list             List the commands the server allows this client to
+                     run, with the policies applying to its user, the
+                     denied ones and the aliases.
+  --server-info      Print the version of the server, the protocol versions
+                     and features it supports, what is enabled in its
+                     configuration and the limits applying to this client,
+                     as JSON.
+  -l, --login        Open the shell of the user on the host as a login
+                     shell, reading its profile, in its home directory,
+                     like hrun enter.
+  --attach           Reattach to a running session by name or ID, like
+                     hrun attach.
+  --compat           Take the options of another tool after this one, only
+                     flatpak-spawn for now: --host, --env=VAR=VALUE,
+                     --directory and --forward-fd for stdin, stdout and
+                     stderr, as in "hrun --compat flatpak-spawn --host ls".
+                     It is also on when hrun is invoked as flatpak-spawn.
+` + connectionOptionsUsage + sessionOptionsUsage + `
+The connection and session options take their default from HRUN_ and their
+name in the environment, as HRUN_SOCKET, HRUN_CONNECT or HRUN_TIMEOUT, but
+-t and -T. HRUN_TARGET is also accepted for --connect. HRUN_ENV lists the
+variables of --env separated by spaces, which --env replaces.
+
+Use -- to run a host command named like a subcommand, as in "hrun -- ls".
+In distrobox and toolbox containers, the shell and the default socket are
+the ones of the host, found through its mount in /run/host. Invoked through
+a link with another name, as docker, hrun runs the command of that name on
+the host with all of its arguments, taking no option of its own.
+`
+
+const serveUsage = `Usage: hrun serve [options]
+
+Start the server, running the commands of the clients on the host. The
+options can also be set in the configuration file, the ones given here
+taking precedence.
+
+Options:
+  --daemon           Run the server in the background once it accepts
+                     connections. Its logs are lost without --log-file or
+                     another --log-backend.
+  --pid-file         Write the PID of the server to this file while it runs,
+                     refusing to start if it names a running server.
+  --config           Load the settings from a YAML, JSON or TOML file
+                     (default: ~/.config/hrun/server.yaml or
+                     /etc/hrun/config.yaml, if they exist).
+  --allowed-cmd      Specify allowed command (can be used multiple times).
+                     Globs like podman* match the command name, which must
+                     then be sent without a path. Globs with a slash, like
+                     /usr/bin/*, and regular expressions starting with ^
+                     match the absolute path of the binary.
+  --denied-cmd       Specify denied command (can be used multiple times),
+                     with the same patterns as --allowed-cmd. Denied
+                     commands are checked first, so a permissive allowlist
+                     can still block binaries like rm or dd. A name also
+                     denies the binary when the client sends a path to it.
+  --confirm          Ask in the terminal running the server to approve every
+                     command outside of the allowlist. Answering always
+                     remembers the command in
+                     ~/.config/hrun/approved_cmds, so it runs without
+                     asking from then on.
+  --confirm-desktop  Like --confirm, but ask with a desktop notification
+                     with Approve, Always allow and Deny actions, through
+                     the session bus.
+  --rego-policy      Rego policy file deciding whether to run every allowed
+                     command, evaluated with --opa. Its hrun package gets
+                     the same input as --auth-hook and defines allow, and
+                     optionally reason, argv, cwd and env.
+  --opa              Absolute path of the opa binary evaluating
+                     --rego-policy, which is never looked up in the PATH.
+  --auth-hook        Executable, or http(s) URL of a webhook, receiving every
+                     allowed command as JSON (uid, gid, pid, argv, cwd and
+                     env) and answering with {"allow": true} or false, an
+                     optional reason and replacement argv, cwd or env.
+                     Commands are denied when it fails.
+  --polkit           Ask polkit whether the client may run a command outside
+                     of the allowlist instead of denying it: check only
+                     runs it if polkit allows it right away, prompt also
+                     lets the desktop ask the user for a password.
+  --allowed-env      Specify environment variable clients may set, glob
+                     patterns like LC_* are supported (can be used multiple
+                     times). If none is given, any variable is accepted.
+                     The variables of the dynamic loader and the startup
+                     files of shells and interpreters, as LD_PRELOAD and
+                     BASH_ENV, are always dropped.
+  --allowed-uid      Only serve this user, by name or UID (can be used
+                     multiple times).
+  --allowed-gid      Only serve members of this group, by name or GID (can
+                     be used multiple times). Without --allowed-uid and
+                     --allowed-gid, anyone who can open the socket is
+                     served.
+  --token-file       Only serve the clients presenting one of the tokens in
+                     this file, one per line optionally preceded by a
+                     client name.
+  --max-sessions     Maximum number of sessions running at once, further
+                     commands get a busy error (default: unlimited).
+  --max-user-sessions
+                     Maximum number of sessions running at once for each
+                     user (default: unlimited).
+  --idle-timeout     Terminate the sessions without input nor output for this
+                     long, as in 30m (default: never).
+  --max-duration     Terminate the sessions running for this long, with
+                     SIGTERM and then SIGKILL (default: never).
+  --max-output       Maximum output sent for each session, in bytes or with a
+                     K, M, G or T suffix, as in 100M (default: unlimited).
+                     The rest is dropped and the client is told the output
+                     was truncated.
+  --on-output-limit  What happens to a session reaching --max-output:
+                     truncate keeps the command running, kill terminates it
+                     (default: truncate).
+  --rate-limit       Connections per second each user, or each address
+                     over the network, may open, so a misbehaving script
+                     can't spawn thousands of commands (default:
+                     unlimited). Clients over the limit get a rate-limited
+                     error, network ones are disconnected.
+  --rate-burst       Connections each user may open at once before the rate
+                     limit applies (default: a second worth of them).
+  --socket           Listen on this socket (default:
+                     $XDG_RUNTIME_DIR/hrun/hrun.sock, /tmp/hrun-UID.sock
+                     without it, \\.\pipe\hrun on Windows), an abstract
+                     socket on Linux when starting with @.
+  --socket-mode      Permissions of the socket file, as in 0660 (default:
+                     from the umask).
+  --socket-owner     Owner of the socket file, by name or UID (default: the
+                     server user).
+  --socket-group     Group of the socket file, by name or GID, so its
+                     members can connect with --socket-mode 0660.
+  --listen           Listen on this address instead of the socket, either
+                     tcp://host:port, quic://host:port (requiring
+                     --tls-cert), vsock://cid:port (any as the CID accepts
+                     every VM), ws://host:port serving a browser terminal,
+                     ssh://host:port serving SSH clients, grpc://host:port
+                     serving the gRPC interface of hrun.proto,
+                     varlink:///path serving the org.hrun.Exec varlink
+                     interface, dbus://session or dbus://system owning
+                     org.hrun.Server on that bus, launchd://name for a
+                     unix socket of the launchd job on macOS, or
+                     unix:///path. Clients other than unix, varlink and
+                     D-Bus ones can't be identified, so --token-file,
+                     client certificates over TCP or QUIC, or SSH keys,
+                     are required. Can be used multiple times, to listen
+                     on several addresses.
+  --tls-cert         With --listen on TCP or QUIC, the certificate of the
+                     server, which then requires clients to present one
+                     signed by --tls-ca, optional over QUIC.
+  --tls-key          The private key of --tls-cert.
+  --tls-ca           Certificate authorities verifying the client
+                     certificates.
+  --tls-allowed-name Only serve the TLS clients whose certificate has this
+                     DNS, URI or email subject alternative name (can be used
+                     multiple times).
+  --ssh-host-key     With --listen on SSH, the private host key of the
+                     server, as written by ssh-keygen.
+  --ssh-authorized-keys
+                     With --listen on SSH, the authorized_keys file of the
+                     clients, the key comments naming them in the logs.
+  --admin-socket     Specify the admin socket path, only usable by root and
+                     the server user (default: the socket path followed
+                     by .admin).
+  --record-dir       Record the output of every session, with timings, as an
+                     asciicast v2 file in this directory. Recordings can be
+                     played with asciinema.
+  --audit-log        Append a JSON record of every command request to this
+                     file: who asked for which command, whether it was
+                     allowed, and for the allowed ones their start, end,
+                     exit code and traffic.
+  --metrics-addr     Serve Prometheus metrics on this address, as in
+                     localhost:9464, under /metrics.
+  --pprof-addr       Serve the runtime profiles of the server, like its CPU
+                     usage and goroutines, on this address under
+                     /debug/pprof/, for go tool pprof.
+  --log-level        Log level: debug, info, warn or error (default: info).
+                     It can be changed while running with
+                     "hrun admin set-log-level".
+  --log-format       Log format: text or json (default: text). Every line
+                     about a session carries its ID, owner UID and command.
+  --log-backend      Where the logs go: stderr, journald with every field of
+                     the lines kept as a journal field, or syslog (default:
+                     stderr).
+  --log-file         Write the logs to this file instead of stderr, rotating
+                     it as file.1, file.2... once it reaches --log-max-size
+                     MiB (default: 10), keeping --log-max-backups old files
+                     (default: 5).
+  --otlp-endpoint    Export traces of the sessions to an OpenTelemetry
+                     collector with OTLP over HTTP, as in
+                     http://localhost:4318 (default:
+                     $OTEL_EXPORTER_OTLP_ENDPOINT).
+  --keepalive-interval
+                     How often the server pings the clients during a
+                     session, 0 to never (default: 15s).
+  --keepalive-timeout
+                     Drop the connection of a client silent for this long,
+                     as after a container was frozen, 0 to never (default:
+                     45s), and apply the --on-disconnect policy of the
+                     session.
+  --resume-timeout   How long a session waits for its client to resume it
+                     once the connection is lost, before applying the
+                     --on-disconnect policy, 0 to never (default: 1m).
+  --on-disconnect    The policy for the clients that don't pick one: keep,
+                     hup or kill, as for hrun exec (default: kill).
+`
+
+const execUsage = `Usage: hrun exec [options] command [args...]
+
+Run a command on the host, in a pty when stdin and stdout are both
+terminals, and exit with its exit code. "hrun [options] command" does the
+same.
+
+Options:
+` + connectionOptionsUsage + sessionOptionsUsage
+
+const shellUsage = `Usage: hrun shell [options]
+
+Open a shell on the host, the one of the user in distrobox and toolbox
+containers, $SHELL otherwise. "hrun [options]" does the same, and
+"hrun enter" opens a login shell in the home directory instead.
+
+Options:
+  -l, --login        Open it as a login shell, in the home directory, as
+                     "hrun enter" does.
+` + connectionOptionsUsage + sessionOptionsUsage
+
+const attachUsage = `Usage: hrun attach [options] <name|id>
+
+Reattach to a running session by name or ID, replaying the output produced
+while detached.
+
+Options:
+  --watch            Only stream the output of the session, leaving it to
+                     its client. The input is ignored.
+  --escape-char      Set the escape character, or "none" to disable it
+                     (default: ~).
+  --keepalive-interval, --keepalive-timeout, --resume-timeout
+                     As for hrun exec.
+` + connectionOptionsUsage
+
+const adminUsage = `Usage: hrun admin [options] <operation> [args...]
+
+Manage the server through the admin socket, only usable by root and the
+user running the server.
+
+Operations:
+  list-sessions      List the sessions.
+  kill-session <name|id>
+                     Terminate a session.
+  reload-config      Load the configuration file again, as SIGHUP does.
+  set-log-level <level>
+                     Change the log level: debug, info, warn or error.
+  drain              Refuse new commands and stop the server once the
+                     running ones exited.
+  stats [--json]     Print the server counters.
+  status [--json]    Show the state of the server.
+  stop [--now]       Like drain, or terminate the running commands right
+                     away with --now.
+
+Options:
+  --admin-socket     Specify the admin socket path (default: the socket path
+                     followed by .admin).
+  --socket           The socket of the server, whose admin socket is used.
+`
+
+// connectionOptionsUsage and sessionOptionsUsage describe the options of
+// the clients, reaching the server and running commands.
+const connectionOptionsUsage = `  --socket           Connect to this socket (default:
+                     $XDG_RUNTIME_DIR/hrun/hrun.sock, /tmp/hrun-UID.sock
+                     without it, \\.\pipe\hrun on Windows), an abstract
+                     socket on Linux when starting with @. The default
+                     socket of another user is refused.
+  --connect          Connect to this address instead of the socket, as in
+                     tcp://host:7070.
+  --token-file       The file holding the token this client presents
+                     (default: $HRUN_TOKEN).
+  --tls-cert         The certificate this client presents over TCP or QUIC.
+  --tls-key          The private key of --tls-cert.
+  --tls-ca           Certificate authorities verifying the server
+                     certificate (default: the system ones).
+  --autostart        Start the server when nothing listens on its socket,
+                     in the background with hrun --start --daemon, or with
+                     --autostart-cmd, which distrobox and toolbox
+                     containers require.
+  --autostart-cmd    Command starting the server for --autostart, returning
+                     once it's started, as in
+                     "flatpak-spawn --host hrun --start --daemon".
+  --wait[=timeout]   Wait for the server to listen instead of failing right
+                     away, retrying with an increasing delay, up to timeout
+                     as in 2m (default: 30s).
+`
+
+const sessionOptionsUsage = `  --split-stderr     Keep the command stderr separate from the terminal output.
+  -T                 Disable pty allocation, useful to pipe binary data.
+  -t                 Force pty allocation.
+                     By default a pty is only used when stdin and stdout
+                     are both terminals.
+  --env              Forward an environment variable to the host command,
+                     as NAME to use the local value or NAME=value (can be
+                     used multiple times). TERM and COLORTERM always are.
+  --usage            Print the CPU time and peak memory used by the host
+                     command once it exited.
+  --timeout          Have the server terminate the host command after this
+                     long, as in 60s, exiting with status 124.
+  --keepalive-interval
+                     How often the client and the server ping each other
+                     during a session, 0 to never (default: 15s).
+  --keepalive-timeout
+                     Drop the connection once the other end was silent for
+                     this long, as after a container was frozen, 0 to
+                     never (default: 45s). The server then applies the
+                     --on-disconnect policy of the session.
+  --resume-timeout   How long the client tries to reconnect and resume the
+                     session once the connection is lost, replaying the
+                     output it missed, 0 to never (default: 1m).
+  --persist          Keep the command running on the host if the connection
+                     is lost, buffering its output until a client reattaches.
+  --on-disconnect    What happens to the host command when the connection is
+                     lost: keep it running like --persist, hup to send it
+                     SIGHUP, or kill to also send SIGTERM and SIGKILL if it
+                     doesn't exit (default: kill).
+  --name             Name the session, so it can be reattached with
+                     "hrun attach <name>". Named sessions keep running if
+                     the connection is lost, like with --persist.
+  --escape-char      Set the escape character for interactive sessions, or
+                     "none" to disable it (default: ~). At the start of a
+                     line, ~. closes the connection, ~d detaches leaving
+                     the host command running and ~? lists the sequences.
+`
@@ -0,0 +1,498 @@
+// Package client runs commands on the host through an hrun server,
+// attached to the terminal of the process.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// Client runs commands on the host through a server, configured by its
+// fields.
+type Client struct {
+	// Socket is the socket path or the address of the server
+	Socket string
+	// Dial, when set, connects to the server instead of Socket, like
+	// the Dial method of a transport.MemListener
+	Dial func(ctx context.Context) (net.Conn, error)
+	// Credentials authenticate the client to servers requiring them
+	Credentials Credentials
+	// EscapeChar starts the escape sequences, NoEscapeChar disables them
+	EscapeChar int
+	// Attach is the name or ID of a running session to reattach to,
+	// instead of running a new command
+	Attach string
+	// Watch only streams the output of the Attach session, without
+	// forwarding any input
+	Watch bool
+	// KeepaliveInterval is how often the server is pinged, never when
+	// zero. The connection is given up after KeepaliveTimeout without
+	// hearing from it, never when zero.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	// ResumeTimeout is how long the client tries to resume the session
+	// once its connection is lost, never when zero
+	ResumeTimeout time.Duration
+}
+
+// Credentials are what a client presents to the server.
+type Credentials struct {
+	// Token answers the challenge of servers requiring one
+	Token string
+	// TLS secures the TCP connections, which are in clear when nil
+	TLS *tls.Config
+}
+
+// Run runs the command on the host, attached to the terminal of the
+// process, and returns the exit code the client should terminate with.
+// The command is given up on once ctx is done, and its deadline, if any,
+// also bounds the command on the host.
+func (c *Client) Run(ctx context.Context, cmd protocol.Command) int {
+	// Connect to the server
+	conn, frames, hello, err := connect(ctx, c.dialer(), c.Credentials)
+	if err != nil {
+		log.Println("Error connecting to the host:", err)
+		return protocol.ExitConnectionError
+	}
+	// The connection is replaced when the session is resumed
+	link := newClientLink(conn)
+	defer link.Close()
+	frames = protocol.NewFrameWriter(link)
+
+	// Give up on the command once ctx is done
+	var canceled atomic.Bool
+	stopCancel := context.AfterFunc(ctx, func() {
+		canceled.Store(true)
+		link.Close()
+	})
+	defer stopCancel()
+
+	// Get the initial terminal size, raw mode and resize forwarding only
+	// make sense when the input is an actual terminal
+	interactive := !cmd.NoPTY && term.IsTerminal(int(os.Stdin.Fd()))
+	if interactive {
+		initialWidth, initialHeight, err := term.GetSize(int(os.Stdin.Fd()))
+		if err != nil {
+			log.Println("Error getting initial terminal size:", err)
+			return protocol.ExitConnectionError
+		}
+		cmd.Width = uint16(initialWidth)
+		cmd.Height = uint16(initialHeight)
+		// Before it's made raw, the mode of the terminal is the one the
+		// command expects
+		if hello.Has(protocol.FeatureTermios) {
+			if termios, err := protocol.ReadTermios(int(os.Stdin.Fd())); err == nil {
+				cmd.Termios = termios
+			}
+		}
+	}
+
+	// Send the command to the server
+	if cmd.Cwd == "" {
+		if cwd, err := os.Getwd(); err == nil {
+			cmd.Cwd = cwd
+		}
+	}
+	if cmd.Term == "" {
+		cmd.Term, cmd.ColorTerm = os.Getenv("TERM"), os.Getenv("COLORTERM")
+	}
+	if cmd.Locale == nil {
+		for _, variable := range os.Environ() {
+			if name, _, _ := strings.Cut(variable, "="); protocol.IsLocaleVariable(name) {
+				cmd.Locale = append(cmd.Locale, variable)
+			}
+		}
+	}
+	if cmd.Name != "" && !hello.Has(protocol.FeatureSessions) {
+		log.Println("The server doesn't support named sessions")
+		return protocol.ExitConnectionError
+	}
+	if cmd.OnDisconnect != "" && cmd.OnDisconnect != protocol.OnDisconnectKeep && !hello.Has(protocol.FeatureOnDisconnect) {
+		log.Println("The server doesn't support on-disconnect policies, ignoring --on-disconnect")
+	}
+	if deadline, ok := ctx.Deadline(); ok && c.Attach == "" && hello.Has(protocol.FeatureTimeout) {
+		if remaining := time.Until(deadline).Seconds(); remaining > 0 && (cmd.Timeout == 0 || remaining < cmd.Timeout) {
+			cmd.Timeout = remaining
+		}
+	}
+	if cmd.Timeout > 0 && !hello.Has(protocol.FeatureTimeout) {
+		log.Println("The server doesn't support timeouts")
+		return protocol.ExitConnectionError
+	}
+	if cmd.Usage && !hello.Has(protocol.FeatureUsage) {
+		log.Println("The server doesn't report resource usage, ignoring --usage")
+	}
+	if cmd.Login && !hello.Has(protocol.FeatureLogin) {
+		// Older servers can't name it, but shells take -l for the same
+		cmd.Login = false
+		cmd.Command = append(cmd.Command, "-l")
+	}
+	if len(cmd.Env) > 0 && !hello.Has(protocol.FeatureEnv) {
+		log.Println("The server doesn't support environment forwarding, ignoring --env")
+		cmd.Env = nil
+	}
+	if c.Attach != "" {
+		if !hello.Has(protocol.FeatureSessions) {
+			log.Println("The server doesn't support reattaching to sessions")
+			return protocol.ExitConnectionError
+		}
+		if c.Watch && !hello.Has(protocol.FeatureWatch) {
+			log.Println("The server doesn't support watching sessions")
+			return protocol.ExitConnectionError
+		}
+		err = frames.WriteJSON(protocol.FrameAttach, &protocol.Attach{ID: c.Attach, Offset: -1, Watch: c.Watch})
+	} else {
+		err = frames.WriteRequest(&cmd)
+	}
+	if err != nil {
+		log.Println("Error sending command to the server:", err)
+		return protocol.ExitConnectionError
+	}
+
+	// Learn which session we are attached to, or why we are not
+	session := protocol.SessionInfo{NoPTY: cmd.NoPTY, Persistent: cmd.Persistent}
+	if hello.Has(protocol.FeatureSessions) {
+		frameType, payload, err := protocol.ReadFrame(conn)
+		if err != nil {
+			log.Println("Error reading the server response:", err)
+			return protocol.ExitConnectionError
+		}
+		switch frameType {
+		case protocol.FrameSession:
+			if err := json.Unmarshal(payload, &session); err != nil {
+				log.Println("Error decoding the session:", err)
+				return protocol.ExitConnectionError
+			}
+		case protocol.FrameError:
+			return reportError(payload)
+		case protocol.FrameExit:
+			code, _ := protocol.DecodeExit(payload)
+			return code
+		default:
+			log.Printf("Unexpected frame type %d from the server", frameType)
+			return protocol.ExitConnectionError
+		}
+	}
+	if c.Attach != "" {
+		interactive = !session.NoPTY && term.IsTerminal(int(os.Stdin.Fd()))
+	}
+	if c.Watch {
+		// Watchers leave the terminal alone, so Ctrl-C stops watching
+		interactive = false
+		fmt.Fprintf(os.Stderr, "Watching session %s, press Ctrl-C to stop.\n", session.Ref())
+	}
+
+	if interactive {
+		restore, err := setupTerminal(frames)
+		if err != nil {
+			return protocol.ExitConnectionError
+		}
+		defer restore()
+	}
+
+	// Forward the signals received by the client to the host command
+	if hello.Has(protocol.FeatureSignals) && !c.Watch {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, protocol.SignalList()...)
+		defer signal.Stop(sigCh)
+		go func() {
+			for sig := range sigCh {
+				if name, ok := protocol.SignalName(sig); ok {
+					frames.WriteFrame(protocol.FrameSignal, []byte(name))
+				}
+			}
+		}()
+	}
+
+	// Forward the input to the server, followed by the end of input. In
+	// interactive sessions the input is watched for escape sequences.
+	var closedByUser atomic.Bool
+	go func() {
+		if c.Watch {
+			return
+		}
+		var err error
+		if interactive && c.EscapeChar != NoEscapeChar {
+			err = copyInputWithEscapes(frames, byte(c.EscapeChar), hello.Has(protocol.FeatureDetach), func() {
+				closedByUser.Store(true)
+				link.Close()
+			})
+		} else {
+			err = protocol.CopyToFrames(frames, protocol.FrameData, os.Stdin)
+		}
+		if err != nil {
+			log.Println("Error copying data to the server:", err)
+		}
+		frames.WriteFrame(protocol.FrameEOF, nil)
+	}()
+
+	// Ping the server, and give up on the connection once it stops
+	// answering
+	var alive *protocol.Keepalive
+	var unresponsive atomic.Bool
+	stopKeepalive := func() {}
+	defer func() { stopKeepalive() }()
+	startKeepalive := func(hello *protocol.Hello) {
+		alive = nil
+		if hello.Has(protocol.FeatureKeepalive) {
+			alive = protocol.NewKeepalive(c.KeepaliveInterval, c.KeepaliveTimeout)
+		}
+		kaCtx, cancel := context.WithCancel(ctx)
+		stopKeepalive = cancel
+		go func(alive *protocol.Keepalive) {
+			if err := alive.Run(kaCtx, frames); err != nil {
+				unresponsive.Store(true)
+				link.drop()
+			}
+		}(alive)
+	}
+	startKeepalive(hello)
+
+	// Print the output until the server reports the exit code, counting it
+	// so a lost session resumes where it was
+	received := session.Offset
+	timedOut := false
+	for {
+		frameType, payload, err := protocol.ReadFrame(link)
+		if err != nil {
+			if canceled.Load() {
+				fmt.Fprintf(os.Stderr, "\r\nhrun: %v\r\n", ctx.Err())
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return protocol.ExitTimeout
+				}
+				return protocol.ExitConnectionError
+			}
+			// Whatever ended the connection, the session can be resumed
+			if !closedByUser.Load() && session.Token != "" && c.ResumeTimeout > 0 {
+				fmt.Fprintf(os.Stderr, "\r\nhrun: connection lost, resuming session %s...\r\n", session.Ref())
+				link.drop()
+				stopKeepalive()
+				r, err := resumeSession(ctx, c, &session, received, c.ResumeTimeout)
+				if err == nil {
+					link.replace(r.conn)
+					unresponsive.Store(false)
+					startKeepalive(r.hello)
+					received = r.info.Offset
+					fmt.Fprint(os.Stderr, "hrun: session resumed.\r\n")
+					// The terminal may have been resized meanwhile
+					if interactive {
+						if width, height, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+							frames.WriteResize(uint16(width), uint16(height))
+						}
+					}
+					continue
+				}
+				log.Println("Error resuming the session:", err)
+			}
+			if closedByUser.Load() {
+				fmt.Fprint(os.Stderr, "Connection closed.\r\n")
+			} else if unresponsive.Load() {
+				fmt.Fprintf(os.Stderr, "Connection lost, the host didn't answer for %s.\r\n", c.KeepaliveTimeout)
+			} else if !errors.Is(err, io.EOF) {
+				log.Println("Error copying data from the server:", err)
+			}
+			if session.Persistent && !closedByUser.Load() {
+				fmt.Fprintf(os.Stderr, "Connection lost, session %s keeps running on the host, reattach with: hrun attach %[1]s\r\n", session.Ref())
+			}
+			return protocol.ExitConnectionError
+		}
+		alive.Seen()
+
+		switch frameType {
+		case protocol.FramePing:
+			frames.WritePong(payload)
+		case protocol.FramePong:
+		case protocol.FrameData:
+			received += int64(len(payload))
+			os.Stdout.Write(payload)
+		case protocol.FrameStderr:
+			received += int64(len(payload))
+			os.Stderr.Write(payload)
+		case protocol.FrameDetach:
+			if session.ID != "" {
+				fmt.Fprintf(os.Stderr, "Detached from session %s, reattach with: hrun attach %[1]s\r\n", session.Ref())
+			} else {
+				fmt.Fprint(os.Stderr, "Detached, the command keeps running on the host.\r\n")
+			}
+			return 0
+		case protocol.FrameError:
+			return reportError(payload)
+		case protocol.FrameUsage:
+			var usage protocol.Usage
+			if err := json.Unmarshal(payload, &usage); err == nil {
+				fmt.Fprintf(os.Stderr, "hrun: %.2fs user, %.2fs system, %s max RSS\r\n",
+					usage.UserSeconds, usage.SystemSeconds, protocol.FormatBytes(usage.MaxRSS<<10))
+			}
+		case protocol.FrameTruncated:
+			var truncated protocol.Truncated
+			if err := json.Unmarshal(payload, &truncated); err == nil {
+				fmt.Fprintf(os.Stderr, "\r\nhrun: output truncated after %s\r\n", protocol.FormatBytes(truncated.Limit))
+			}
+		case protocol.FrameClose:
+			fmt.Fprintf(os.Stderr, "hrun: %s\r\n", payload)
+			timedOut = string(payload) == protocol.CloseTimeout
+		case protocol.FrameExit:
+			code, err := protocol.DecodeExit(payload)
+			if err != nil {
+				log.Println("Error decoding exit code:", err)
+				return protocol.ExitConnectionError
+			}
+			if timedOut {
+				return protocol.ExitTimeout
+			}
+			return code
+		}
+	}
+}
+
+// dialer returns how the client connects to the server, Dial or else
+// dialing Socket.
+func (c *Client) dialer() func(context.Context) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial
+	}
+	return dialSocket(c.Socket, c.Credentials)
+}
+
+// dialSocket returns a dialer for addr, a socket path or an address
+// accepted by transport.ParseAddress. The master connection to addr is used
+// when one is open.
+func dialSocket(addr string, creds Credentials) func(context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialMaster(addr)
+		if err != nil {
+			conn, err = transport.DialContext(ctx, addr, creds.TLS)
+		}
+		return conn, err
+	}
+}
+
+// connect dials the server with dial, and negotiates the protocol version
+// and features with it, answering its challenge with the token if it
+// requires one. Both connecting and negotiating are given up on once ctx
+// is done.
+func connect(ctx context.Context, dial func(context.Context) (net.Conn, error), creds Credentials) (net.Conn, *protocol.FrameWriter, *protocol.Hello, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	frames, hello, err := handshake(conn, creds)
+	if !stop() {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, nil, nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return conn, frames, hello, nil
+}
+
+// handshake negotiates with the server on a new connection, closing it on
+// failure.
+func handshake(conn net.Conn, creds Credentials) (*protocol.FrameWriter, *protocol.Hello, error) {
+	frames := protocol.NewFrameWriter(conn)
+	if err := protocol.WritePreamble(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := frames.WriteHello(&protocol.Hello{Version: protocol.ProtocolVersion, Features: protocol.SupportedFeatures}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	hello, err := protocol.ReadHello(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("negotiating with the server: %w", err)
+	}
+	if hello.Challenge != nil {
+		if creds.Token == "" {
+			conn.Close()
+			return nil, nil, errors.New("the server requires a token, set $HRUN_TOKEN or use --token-file")
+		}
+		if err := frames.WriteFrame(protocol.FrameAuth, protocol.AuthProof(creds.Token, hello.Challenge)); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return frames, hello, nil
+}
+
+// reportError prints the error sent by the server and returns the exit
+// code for it.
+func reportError(payload []byte) int {
+	var errMsg protocol.ErrorMessage
+	if err := json.Unmarshal(payload, &errMsg); err != nil {
+		log.Println("Error decoding the server error:", err)
+		return protocol.ExitConnectionError
+	}
+	log.Printf("Error from the server: %s", errMsg.Message)
+	return protocol.ExitConnectionError
+}
+
+// setupTerminal puts the local terminal in raw mode and forwards its size
+// changes to the server, starting with the current one. The returned
+// function restores the terminal.
+func setupTerminal(frames *protocol.FrameWriter) (func(), error) {
+	// Send the terminal size now and whenever it changes
+	sendTerminalSize := func() {
+		width, height, err := term.GetSize(int(os.Stdin.Fd()))
+		if err != nil {
+			log.Println("Error getting terminal size:", err)
+			return
+		}
+
+		err = frames.WriteResize(uint16(width), uint16(height))
+		if err != nil {
+			log.Println("Error sending terminal size to the server:", err)
+		}
+	}
+
+	restoreTerminal := prepareTerminal(sendTerminalSize)
+
+	// Set the terminal to raw mode
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Println("Error setting terminal to raw mode:", err)
+		restoreTerminal()
+		return nil, err
+	}
+
+	return func() {
+		restoreTerminal()
+		_ = term.Restore(int(os.Stdin.Fd()), oldState)
+	}, nil
+}
+
+// ReadClientToken returns the token the client presents, read from path
+// when given or from $HRUN_TOKEN.
+func ReadClientToken(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("HRUN_TOKEN"), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
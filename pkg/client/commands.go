@@ -0,0 +1,361 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// query sends a single request frame to the server and returns the
+// payload of the answer, which must be of the same type. On failure, the
+// error is reported and the exit code for the client is returned.
+func query(socket string, creds Credentials, feature string, frameType byte, request any) ([]byte, int) {
+	conn, frames, hello, err := connect(context.Background(), dialSocket(socket, creds), creds)
+	if err != nil {
+		log.Println("Error connecting to the host:", err)
+		return nil, protocol.ExitConnectionError
+	}
+	defer conn.Close()
+
+	if !hello.Has(feature) {
+		log.Printf("The server doesn't support the %s feature", feature)
+		return nil, protocol.ExitConnectionError
+	}
+	if err := frames.WriteJSON(frameType, request); err != nil {
+		log.Println("Error sending request to the server:", err)
+		return nil, protocol.ExitConnectionError
+	}
+
+	answerType, payload, err := protocol.ReadFrame(conn)
+	if err != nil {
+		log.Println("Error reading the server response:", err)
+		return nil, protocol.ExitConnectionError
+	}
+	switch answerType {
+	case frameType:
+		return payload, 0
+	case protocol.FrameError:
+		return nil, reportError(payload)
+	default:
+		log.Printf("Unexpected frame type %d from the server", answerType)
+		return nil, protocol.ExitConnectionError
+	}
+}
+
+// ListSessions prints the sessions running on the server and returns the
+// exit code for the client.
+func ListSessions(socket string, creds Credentials) int {
+	payload, code := query(socket, creds, protocol.FeatureList, protocol.FrameList, nil)
+	if payload == nil {
+		return code
+	}
+
+	var sessions []protocol.SessionStatus
+	if err := json.Unmarshal(payload, &sessions); err != nil {
+		log.Println("Error decoding the session list:", err)
+		return protocol.ExitConnectionError
+	}
+	printSessions(sessions)
+	return 0
+}
+
+// QueryAllowlist returns the commands the server allows the client to run.
+// On failure, the error is reported and the exit code for the client is
+// returned.
+func QueryAllowlist(socket string, creds Credentials) (*protocol.Allowlist, int) {
+	payload, code := query(socket, creds, protocol.FeatureAllowlist, protocol.FrameAllowlist, nil)
+	if payload == nil {
+		return nil, code
+	}
+	var allowlist protocol.Allowlist
+	if err := json.Unmarshal(payload, &allowlist); err != nil {
+		log.Println("Error decoding the allowlist:", err)
+		return nil, protocol.ExitConnectionError
+	}
+	return &allowlist, 0
+}
+
+// QueryServerInfo returns the version, features and limits of the server,
+// or nil and the exit code for the client on failure.
+func QueryServerInfo(socket string, creds Credentials) (*protocol.ServerInfo, int) {
+	payload, code := query(socket, creds, protocol.FeatureInfo, protocol.FrameInfo, nil)
+	if payload == nil {
+		return nil, code
+	}
+	var info protocol.ServerInfo
+	if err := json.Unmarshal(payload, &info); err != nil {
+		log.Println("Error decoding the server info:", err)
+		return nil, protocol.ExitConnectionError
+	}
+	return &info, 0
+}
+
+// PrintServerInfo prints the server info as indented JSON and returns the
+// exit code for the client.
+func PrintServerInfo(socket string, creds Credentials) int {
+	info, code := QueryServerInfo(socket, creds)
+	if info == nil {
+		return code
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(info); err != nil {
+		log.Println("Error printing the server info:", err)
+		return 1
+	}
+	return 0
+}
+
+// ListAllowed prints the commands the server allows the client to run and
+// returns the exit code for the client.
+func ListAllowed(socket string, creds Credentials) int {
+	allowlist, code := QueryAllowlist(socket, creds)
+	if allowlist == nil {
+		return code
+	}
+	if len(allowlist.Allowed) == 0 {
+		fmt.Println("Allowed commands: any")
+	} else {
+		fmt.Println("Allowed commands:")
+		for _, pattern := range allowlist.Allowed {
+			fmt.Println("  " + pattern)
+		}
+	}
+	if len(allowlist.Denied) > 0 {
+		fmt.Println("Denied commands:")
+		for _, pattern := range allowlist.Denied {
+			fmt.Println("  " + pattern)
+		}
+	}
+	if len(allowlist.Aliases) > 0 {
+		fmt.Println("Aliases:")
+		names := make([]string, 0, len(allowlist.Aliases))
+		for name := range allowlist.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, name := range names {
+			fmt.Fprintf(tw, "  %s\t%s\n", name, strings.Join(allowlist.Aliases[name], " "))
+		}
+		tw.Flush()
+	}
+	return 0
+}
+
+// printSessions prints a table of sessions.
+func printSessions(sessions []protocol.SessionStatus) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPID\tUID\tSTARTED\tSIZE\tSTATUS\tCOMMAND")
+	for _, session := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			session.ID,
+			orDash(session.Name),
+			session.PID,
+			formatUID(session.UID),
+			session.StartedAt.Local().Format("2006-01-02 15:04:05"),
+			formatSize(session),
+			formatState(session),
+			strings.Join(session.Command, " "),
+		)
+	}
+	tw.Flush()
+}
+
+// KillSession terminates a session on the server and returns the exit
+// code for the client.
+func KillSession(socket string, creds Credentials, ref string) int {
+	payload, code := query(socket, creds, protocol.FeatureKill, protocol.FrameKill, &protocol.Kill{ID: ref})
+	if payload == nil {
+		return code
+	}
+	var session protocol.SessionStatus
+	if err := json.Unmarshal(payload, &session); err != nil {
+		log.Println("Error decoding the killed session:", err)
+		return protocol.ExitConnectionError
+	}
+	name := session.Name
+	if name == "" {
+		name = session.ID
+	}
+	fmt.Printf("Session %s terminated with code %d\n", name, session.ExitCode)
+	return 0
+}
+
+// RunAdmin runs an operation on the admin socket and returns the exit
+// code for the client.
+func RunAdmin(socket string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: hrun admin <list-sessions|kill-session|reload-config|set-log-level|drain|stats|status|stop> [args...]")
+		return 2
+	}
+	req := protocol.AdminRequest{Op: args[0]}
+	jsonOutput := false
+	switch {
+	case (req.Op == protocol.AdminStats || req.Op == protocol.AdminStatus) && len(args) == 2 && args[1] == "--json":
+		jsonOutput = true
+	case req.Op == protocol.AdminStop && len(args) == 2 && args[1] == "--now":
+		req.Now = true
+	case req.Op == protocol.AdminKillSession && len(args) == 2:
+		req.Session = args[1]
+	case req.Op == protocol.AdminSetLogLevel && len(args) == 2:
+		req.Level = args[1]
+	case req.Op == protocol.AdminKillSession:
+		fmt.Fprintln(os.Stderr, "Usage: hrun admin kill-session <name|id>")
+		return 2
+	case req.Op == protocol.AdminSetLogLevel:
+		fmt.Fprintln(os.Stderr, "Usage: hrun admin set-log-level <debug|info|warn|error>")
+		return 2
+	case len(args) != 1:
+		fmt.Fprintf(os.Stderr, "Unexpected arguments for %s\n", req.Op)
+		return 2
+	}
+
+	resp, code := queryAdmin(socket, Credentials{}, &req)
+	if resp == nil {
+		return code
+	}
+	printAdminResponse(&req, resp, jsonOutput)
+	return 0
+}
+
+// ShowStatus prints the state of the server, asked on its socket, and
+// returns the exit code for the client.
+func ShowStatus(socket string, creds Credentials, jsonOutput bool) int {
+	req := protocol.AdminRequest{Op: protocol.AdminStatus}
+	resp, code := queryAdmin(socket, creds, &req)
+	if resp == nil {
+		return code
+	}
+	printAdminResponse(&req, resp, jsonOutput)
+	return 0
+}
+
+// StopServer asks the server to shut down once the running commands
+// exited, or right away terminating them when now is set, and returns the
+// exit code for the client.
+func StopServer(socket string, creds Credentials, now bool) int {
+	req := protocol.AdminRequest{Op: protocol.AdminStop, Now: now}
+	resp, code := queryAdmin(socket, creds, &req)
+	if resp == nil {
+		return code
+	}
+	printAdminResponse(&req, resp, false)
+	return 0
+}
+
+// queryAdmin runs an admin operation, returning the response or the exit
+// code for the client on failure.
+func queryAdmin(socket string, creds Credentials, req *protocol.AdminRequest) (*protocol.AdminResponse, int) {
+	payload, code := query(socket, creds, protocol.FeatureAdmin, protocol.FrameAdmin, req)
+	if payload == nil {
+		return nil, code
+	}
+	var resp protocol.AdminResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		log.Println("Error decoding the admin response:", err)
+		return nil, protocol.ExitConnectionError
+	}
+	return &resp, 0
+}
+
+// printAdminResponse prints the response to an admin operation, as JSON
+// for scripts when jsonOutput is set.
+func printAdminResponse(req *protocol.AdminRequest, resp *protocol.AdminResponse, jsonOutput bool) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	switch {
+	case req.Op == protocol.AdminListSessions:
+		printSessions(resp.Sessions)
+	case resp.Stats != nil && jsonOutput:
+		encoder.Encode(resp.Stats)
+	case resp.Stats != nil:
+		printStats(resp.Stats)
+	case resp.Status != nil && jsonOutput:
+		encoder.Encode(resp.Status)
+	case resp.Status != nil:
+		printStatus(resp.Status)
+	}
+	if resp.Message != "" {
+		fmt.Println(resp.Message)
+	}
+}
+
+// printStatus prints the state of the server.
+func printStatus(status *protocol.ServerStatus) {
+	state := "running"
+	if status.Draining {
+		state = "draining"
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "State:\t%s\n", state)
+	fmt.Fprintf(tw, "PID:\t%d\n", status.PID)
+	fmt.Fprintf(tw, "Version:\t%s\n", status.Version)
+	fmt.Fprintf(tw, "Uptime:\t%s\n", time.Since(status.StartedAt).Round(time.Second))
+	fmt.Fprintf(tw, "Listening on:\t%s\n", strings.Join(status.Addresses, ", "))
+	fmt.Fprintf(tw, "Config file:\t%s\n", orDash(status.Config))
+	fmt.Fprintf(tw, "Sessions:\t%d, %d running\n", status.Sessions, status.RunningSessions)
+	tw.Flush()
+}
+
+// printStats prints the server counters.
+func printStats(stats *protocol.Stats) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Uptime:\t%s\n", time.Since(stats.StartedAt).Round(time.Second))
+	fmt.Fprintf(tw, "Sessions:\t%d\n", stats.Sessions)
+	fmt.Fprintf(tw, "Active sessions:\t%d\n", stats.ActiveSessions)
+	fmt.Fprintf(tw, "Denied commands:\t%d\n", stats.DeniedCommands)
+	fmt.Fprintf(tw, "Input:\t%s\n", protocol.FormatBytes(stats.BytesIn))
+	fmt.Fprintf(tw, "Output:\t%s\n", protocol.FormatBytes(stats.BytesOut))
+	average := time.Duration(stats.AverageSessionSeconds * float64(time.Second))
+	fmt.Fprintf(tw, "Average session duration:\t%s\n", average.Round(time.Millisecond))
+	tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatUID(uid int) string {
+	if uid < 0 {
+		return "-"
+	}
+	return strconv.Itoa(uid)
+}
+
+func formatSize(session protocol.SessionStatus) string {
+	if session.NoPTY || session.Width == 0 || session.Height == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dx%d", session.Width, session.Height)
+}
+
+func formatState(session protocol.SessionStatus) string {
+	var state string
+	switch {
+	case session.Exited:
+		state = fmt.Sprintf("exited (%d)", session.ExitCode)
+	case session.State == protocol.SessionDraining.String():
+		state = "draining"
+	case session.Attached:
+		state = "attached"
+	default:
+		state = "detached"
+	}
+	if session.Watchers > 0 {
+		state += fmt.Sprintf(", %d watching", session.Watchers)
+	}
+	return state
+}
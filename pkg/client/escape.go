@@ -0,0 +1,123 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// escapeAction is what the user asked for with an escape sequence.
+type escapeAction int
+
+const (
+	escapeNone escapeAction = iota
+	// escapeClose closes the connection, like ~. in OpenSSH
+	escapeClose
+	// escapeDetach leaves the host command running without the client
+	escapeDetach
+	// escapeHelp lists the supported escape sequences
+	escapeHelp
+)
+
+// NoEscapeChar disables the escape sequences.
+const NoEscapeChar = -1
+
+// escapeFilter looks for escape sequences in the terminal input. As in
+// OpenSSH, the escape character is only recognized at the start of a
+// line, and typing it twice sends it once.
+type escapeFilter struct {
+	escape      byte
+	atLineStart bool
+	pending     bool
+}
+
+func newEscapeFilter(escape byte) *escapeFilter {
+	return &escapeFilter{escape: escape, atLineStart: true}
+}
+
+// Filter returns the input to forward to the server and the requested
+// action. Closing and detaching stop the filtering, as the rest of the
+// input is no longer relevant.
+func (f *escapeFilter) Filter(in []byte) ([]byte, escapeAction) {
+	action := escapeNone
+	out := make([]byte, 0, len(in))
+	for _, b := range in {
+		if f.pending {
+			f.pending = false
+			switch b {
+			case '.':
+				return out, escapeClose
+			case 'd':
+				return out, escapeDetach
+			case '?':
+				action = escapeHelp
+				continue
+			case f.escape:
+				out = append(out, b)
+				f.atLineStart = false
+				continue
+			default:
+				out = append(out, f.escape)
+			}
+		} else if f.atLineStart && b == f.escape {
+			f.pending = true
+			continue
+		}
+
+		out = append(out, b)
+		f.atLineStart = b == '\r' || b == '\n'
+	}
+	return out, action
+}
+
+// escapeHelpText lists the escape sequences, with the line endings a raw
+// terminal needs.
+func escapeHelpText(escape byte) string {
+	return fmt.Sprintf("Supported escape sequences:\r\n"+
+		" %[1]c.  - close the connection\r\n"+
+		" %[1]cd  - detach, leaving the host command running\r\n"+
+		" %[1]c?  - this message\r\n"+
+		" %[1]c%[1]c  - send the escape character\r\n", escape)
+}
+
+// copyInputWithEscapes forwards the terminal input to the server, acting
+// on the escape sequences typed by the user. closeConn is called when the
+// user asks to close the connection.
+func copyInputWithEscapes(frames *protocol.FrameWriter, escape byte, canDetach bool, closeConn func()) error {
+	filter := newEscapeFilter(escape)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			out, action := filter.Filter(buf[:n])
+			if len(out) > 0 {
+				if werr := frames.WriteFrame(protocol.FrameData, out); werr != nil {
+					return werr
+				}
+			}
+
+			switch action {
+			case escapeClose:
+				closeConn()
+				return nil
+			case escapeDetach:
+				if !canDetach {
+					fmt.Fprint(os.Stderr, "The server doesn't support detaching.\r\n")
+					continue
+				}
+				return frames.WriteFrame(protocol.FrameDetach, nil)
+			case escapeHelp:
+				fmt.Fprint(os.Stderr, escapeHelpText(escape))
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// addressHash names the master connection to addr.
+func addressHash(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(sum[:8])
+}
+
+// dialMaster connects to the master connection to addr, failing when
+// there's none.
+func dialMaster(addr string) (net.Conn, error) {
+	path := masterSocket(addr)
+	if err := transport.CheckSocketOwner(path); err != nil {
+		return nil, err
+	}
+	return transport.Dial(path, nil)
+}
+
+// RunMaster keeps a connection to the server at addr open and carries the
+// connections of the other clients over it, until ctx is done or the
+// connection is lost. It returns the exit code of the client.
+func RunMaster(ctx context.Context, addr string, creds Credentials, keepaliveInterval, keepaliveTimeout time.Duration) int {
+	// Only one master per address, the clients of another one would be
+	// left behind
+	path := masterSocket(addr)
+	listener, err := transport.Listen(path, nil)
+	if errors.Is(err, transport.ErrServerRunning) {
+		fmt.Fprintln(os.Stderr, "A master connection to", addr, "is already open")
+		return 1
+	}
+	if err == nil && !transport.IsNamedPipe(path) {
+		err = os.Chmod(path, 0600)
+	}
+	if err != nil {
+		log.Println("Error creating the control socket:", err)
+		return 1
+	}
+	defer listener.Close()
+
+	conn, err := transport.DialContext(ctx, addr, creds.TLS)
+	if err != nil {
+		log.Println("Error connecting to the host:", err)
+		return protocol.ExitConnectionError
+	}
+	frames, hello, err := handshake(conn, creds)
+	if err != nil {
+		log.Println("Error connecting to the host:", err)
+		return protocol.ExitConnectionError
+	}
+	defer conn.Close()
+	if !hello.Has(protocol.FeatureMux) {
+		log.Println("The server doesn't support multiplexing connections")
+		return protocol.ExitConnectionError
+	}
+	if err := frames.WriteFrame(protocol.FrameMux, nil); err != nil {
+		log.Println("Error sending the request to the server:", err)
+		return protocol.ExitConnectionError
+	}
+	frameType, payload, err := protocol.ReadFrame(conn)
+	switch {
+	case err != nil:
+		log.Println("Error reading the server response:", err)
+		return protocol.ExitConnectionError
+	case frameType == protocol.FrameError:
+		return reportError(payload)
+	case frameType != protocol.FrameMux:
+		log.Printf("Unexpected frame type %d from the server", frameType)
+		return protocol.ExitConnectionError
+	}
+
+	m := protocol.NewMux(conn, frames, nil)
+	if hello.Has(protocol.FeatureKeepalive) {
+		m.Alive = protocol.NewKeepalive(keepaliveInterval, keepaliveTimeout)
+	}
+	var unresponsive atomic.Bool
+	kaCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		if err := m.Alive.Run(kaCtx, frames); err != nil {
+			unresponsive.Store(true)
+			conn.Close()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	go func() {
+		m.Run()
+		listener.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Master connection to %s open, press Ctrl-C to close it.\n", addr)
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go forwardToMux(local, m)
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return 0
+	case unresponsive.Load():
+		fmt.Fprintf(os.Stderr, "Connection lost, the host didn't answer for %s.\n", keepaliveTimeout)
+	default:
+		fmt.Fprintln(os.Stderr, "Connection to the host lost.")
+	}
+	return protocol.ExitConnectionError
+}
+
+// forwardToMux carries a local connection over a new channel, until either
+// end closes it.
+func forwardToMux(local net.Conn, m *protocol.Mux) {
+	defer local.Close()
+	ch, err := m.Open()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go func() {
+		io.Copy(ch, local)
+		ch.Close()
+	}()
+	io.Copy(local, ch)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// masterSocket returns the control socket of the master connection to
+// addr, next to the default socket.
+func masterSocket(addr string) string {
+	name := "master-" + addressHash(addr) + ".sock"
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "hrun", name)
+	}
+	return fmt.Sprintf("/tmp/hrun-%d-%s", os.Getuid(), name)
+}
@@ -0,0 +1,6 @@
+package client
+
+// masterSocket returns the control pipe of the master connection to addr.
+func masterSocket(addr string) string {
+	return `\\.\pipe\hrun-master-` + addressHash(addr)
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// PingServer checks that the server answers, count times every interval,
+// or until ctx is done when count is zero. Each ping opens a connection
+// and gives up after timeout. The time to connect and the round trip of
+// the ping are printed, and the exit code for the client is returned: zero
+// when every ping was answered.
+func PingServer(ctx context.Context, socket string, creds Credentials, count int, interval, timeout time.Duration) int {
+	sent, received := 0, 0
+	var total time.Duration
+	for seq := 1; count == 0 || seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		sent++
+		connected, rtt, err := ping(ctx, socket, creds, seq, timeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				sent--
+				break
+			}
+			log.Printf("No answer from %s: %v", socket, err)
+			continue
+		}
+		received++
+		total += rtt
+		fmt.Printf("Pong from %s: seq=%d connect=%s time=%s\n", socket, seq, formatLatency(connected), formatLatency(rtt))
+	}
+	if sent > 1 {
+		fmt.Printf("%d pings sent, %d answered", sent, received)
+		if received > 0 {
+			fmt.Printf(", average time %s", formatLatency(total/time.Duration(received)))
+		}
+		fmt.Println()
+	}
+	if sent == 0 || received < sent {
+		return protocol.ExitConnectionError
+	}
+	return 0
+}
+
+// ping connects to the server and pings it once, returning how long
+// connecting took and the round trip of the ping.
+func ping(ctx context.Context, socket string, creds Credentials, seq int, timeout time.Duration) (time.Duration, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	conn, frames, hello, err := connect(ctx, dialSocket(socket, creds), creds)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		return 0, 0, err
+	}
+	defer conn.Close()
+	connected := time.Since(start)
+	if !hello.Has(protocol.FeaturePing) {
+		return 0, 0, fmt.Errorf("the server doesn't support the %s feature", protocol.FeaturePing)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	payload := []byte(strconv.Itoa(seq))
+	start = time.Now()
+	if err := frames.WriteFrame(protocol.FramePing, payload); err != nil {
+		return 0, 0, err
+	}
+	frameType, answer, err := protocol.ReadFrame(conn)
+	rtt := time.Since(start)
+	switch {
+	case ctx.Err() != nil:
+		return 0, 0, fmt.Errorf("timed out after %s", timeout)
+	case err != nil:
+		return 0, 0, err
+	case frameType == protocol.FrameError:
+		var errMsg protocol.ErrorMessage
+		if err := json.Unmarshal(answer, &errMsg); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, &errMsg
+	case frameType != protocol.FramePong || string(answer) != string(payload):
+		return 0, 0, fmt.Errorf("unexpected answer, frame type %d", frameType)
+	}
+	return connected, rtt, nil
+}
+
+// formatLatency rounds a latency to a readable precision.
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// clientLink is the connection of a client to its session, replaced by a
+// new one when the session is resumed. Writes wait while it's lost.
+type clientLink struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+	// lost is set from the loss of the connection until it's replaced
+	lost   bool
+	closed bool
+}
+
+func newClientLink(conn net.Conn) *clientLink {
+	l := &clientLink{conn: conn}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Read reads from the current connection. Only the goroutine replacing the
+// connection reads, so a frame is never split across connections.
+func (l *clientLink) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	return conn.Read(p)
+}
+
+// Write writes to the current connection, writing again to the next one
+// when it fails, until the link is closed.
+func (l *clientLink) Write(p []byte) (int, error) {
+	for {
+		l.mu.Lock()
+		for l.lost && !l.closed {
+			l.cond.Wait()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		conn := l.conn
+		l.mu.Unlock()
+
+		if _, err := conn.Write(p); err == nil {
+			return len(p), nil
+		}
+		l.mu.Lock()
+		if l.conn == conn {
+			l.lost = true
+		}
+		l.mu.Unlock()
+	}
+}
+
+// drop gives up on the current connection, holding the writes until it's
+// replaced or the link closed. The connection stays open meanwhile, so a
+// server that was only frozen doesn't see the client leave before it
+// resumes the session.
+func (l *clientLink) drop() {
+	l.mu.Lock()
+	l.lost = true
+	conn := l.conn
+	l.mu.Unlock()
+	conn.SetDeadline(time.Now())
+}
+
+// replace resumes the writes on a new connection.
+func (l *clientLink) replace(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		conn.Close()
+		return
+	}
+	l.conn.Close()
+	l.conn = conn
+	l.lost = false
+	l.cond.Broadcast()
+}
+
+// Close closes the connection, failing the writes from then on. It is safe
+// to call more than once.
+func (l *clientLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+	return l.conn.Close()
+}
+
+// resumed is a session resumed on a new connection.
+type resumed struct {
+	conn  net.Conn
+	hello *protocol.Hello
+	info  *protocol.SessionInfo
+	err   error
+}
+
+// resumeSession reconnects to the server until timeout passes or ctx is
+// done, and resumes the session from offset.
+func resumeSession(ctx context.Context, c *Client, session *protocol.SessionInfo, offset int64, timeout time.Duration) (*resumed, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := 250 * time.Millisecond
+	for {
+		// An attempt can hang as long as the network is down
+		attempt := make(chan *resumed, 1)
+		go func() {
+			attempt <- resumeOnce(ctx, c, session, offset)
+		}()
+		abandon := func() {
+			go func() {
+				if r := <-attempt; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+		}
+		var r *resumed
+		select {
+		case r = <-attempt:
+		case <-time.After(time.Until(deadline)):
+			abandon()
+			return nil, fmt.Errorf("no answer from the server after %s", timeout)
+		case <-ctx.Done():
+			abandon()
+			return nil, ctx.Err()
+		}
+		if r.err == nil {
+			return r, nil
+		}
+		// The server answered, it won't change its mind, or it's gone along
+		// with its sessions
+		var errMsg *protocol.ErrorMessage
+		if errors.As(r.err, &errMsg) && errMsg.Code != protocol.ErrorRateLimited {
+			return nil, r.err
+		}
+		if errors.Is(r.err, syscall.ECONNREFUSED) || errors.Is(r.err, fs.ErrNotExist) {
+			return nil, r.err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= backoff {
+			return nil, r.err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(2*backoff, 2*time.Second)
+	}
+}
+
+// resumeOnce connects to the server and asks to resume the session.
+func resumeOnce(ctx context.Context, c *Client, session *protocol.SessionInfo, offset int64) *resumed {
+	conn, frames, hello, err := connect(ctx, c.dialer(), c.Credentials)
+	if err != nil {
+		return &resumed{err: err}
+	}
+	fail := func(err error) *resumed {
+		conn.Close()
+		return &resumed{err: err}
+	}
+	if !hello.Has(protocol.FeatureResume) {
+		return fail(&protocol.ErrorMessage{Code: protocol.ErrorUnavailable, Message: "the server doesn't support resuming sessions"})
+	}
+	if err := frames.WriteJSON(protocol.FrameAttach, &protocol.Attach{ID: session.ID, Offset: offset, Token: session.Token}); err != nil {
+		return fail(err)
+	}
+
+	frameType, payload, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return fail(err)
+	}
+	switch frameType {
+	case protocol.FrameSession:
+		var info protocol.SessionInfo
+		if err := json.Unmarshal(payload, &info); err != nil {
+			return fail(err)
+		}
+		return &resumed{conn: conn, hello: hello, info: &info}
+	case protocol.FrameError:
+		var errMsg protocol.ErrorMessage
+		if err := json.Unmarshal(payload, &errMsg); err != nil {
+			return fail(err)
+		}
+		return fail(&errMsg)
+	}
+	return fail(fmt.Errorf("unexpected frame type %d from the server", frameType))
+}
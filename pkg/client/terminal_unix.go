@@ -0,0 +1,25 @@
+//go:build unix
+
+package client
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// prepareTerminal calls sendSize now and on every SIGWINCH, until the
+// returned function is called.
+func prepareTerminal(sendSize func()) func() {
+	sigwinchChan := make(chan os.Signal, 1)
+	signal.Notify(sigwinchChan, syscall.SIGWINCH)
+	sigwinchChan <- syscall.SIGWINCH
+	go func() {
+		for range sigwinchChan {
+			sendSize()
+		}
+	}()
+	return func() {
+		signal.Stop(sigwinchChan)
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/term"
+)
+
+// terminalPollInterval is how often the console size is checked, Windows
+// has no SIGWINCH to tell.
+const terminalPollInterval = 250 * time.Millisecond
+
+// prepareTerminal lets the console render the escape sequences of the
+// command, and calls sendSize now and whenever the console is resized,
+// until the returned function is called.
+func prepareTerminal(sendSize func()) func() {
+	stdout := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	restoreMode := func() {}
+	if windows.GetConsoleMode(stdout, &mode) == nil {
+		if windows.SetConsoleMode(stdout, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil {
+			restoreMode = func() { windows.SetConsoleMode(stdout, mode) }
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		width, height, _ := term.GetSize(int(os.Stdin.Fd()))
+		sendSize()
+		ticker := time.NewTicker(terminalPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			w, h, err := term.GetSize(int(os.Stdin.Fd()))
+			if err == nil && (w != width || h != height) {
+				width, height = w, h
+				sendSize()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		restoreMode()
+	}
+}
@@ -0,0 +1,5 @@
+// Package hrunpb holds the gRPC interface of hrun, generated from
+// hrun.proto, for the Go clients of a server listening on grpc://.
+package hrunpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative hrun.proto
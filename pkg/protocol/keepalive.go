@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Default keepalive settings, on both ends of a connection.
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultKeepaliveTimeout  = 45 * time.Second
+)
+
+// DefaultResumeTimeout is how long a lost session can be resumed, on both
+// ends of a connection.
+const DefaultResumeTimeout = time.Minute
+
+var errPeerUnresponsive = errors.New("peer unresponsive")
+
+// Keepalive pings the peer of a connection, so a half-open one is noticed,
+// as after a container was frozen. A nil Keepalive does nothing, when the
+// peer doesn't support it.
+type Keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+	// lastSeen is when the last frame was received, in Unix nanoseconds
+	lastSeen atomic.Int64
+	// held counts the reasons to not read the frames of the peer, during
+	// which it can't be blamed for not being seen
+	held atomic.Int32
+}
+
+// NewKeepalive returns a keepalive pinging every interval and giving up on
+// the peer after timeout without a frame, nil when interval is zero.
+func NewKeepalive(interval, timeout time.Duration) *Keepalive {
+	if interval <= 0 {
+		return nil
+	}
+	k := &Keepalive{interval: interval, timeout: timeout}
+	k.Seen()
+	return k
+}
+
+// Seen records that a frame was received from the peer.
+func (k *Keepalive) Seen() {
+	if k == nil {
+		return
+	}
+	k.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Hold suspends the timeout while the frames of the peer are held back on
+// this end, as when the command isn't reading the input sent before them,
+// until the returned function is called.
+func (k *Keepalive) Hold() func() {
+	if k == nil {
+		return func() {}
+	}
+	k.held.Add(1)
+	return func() {
+		k.Seen()
+		k.held.Add(-1)
+	}
+}
+
+// Run pings the peer every interval until ctx is done, and returns
+// errPeerUnresponsive once nothing was received from it for timeout.
+func (k *Keepalive) Run(ctx context.Context, frames *FrameWriter) error {
+	if k == nil {
+		return nil
+	}
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	// The writes block once the peer stops reading, the pings are sent
+	// aside so the timeout still applies
+	var pinging atomic.Bool
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if k.timeout > 0 && k.held.Load() == 0 && time.Since(time.Unix(0, k.lastSeen.Load())) > k.timeout {
+				return errPeerUnresponsive
+			}
+			if pinging.CompareAndSwap(false, true) {
+				go func() {
+					frames.WriteFrame(FramePing, nil)
+					pinging.Store(false)
+				}()
+			}
+		}
+	}
+}
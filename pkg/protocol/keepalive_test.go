@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveHold(t *testing.T) {
+	tests := []struct {
+		name string
+		hold bool
+		want error
+	}{
+		{"unresponsive", false, errPeerUnresponsive},
+		{"held", true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := NewKeepalive(10*time.Millisecond, 50*time.Millisecond)
+			if test.hold {
+				defer k.Hold()()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err := k.Run(ctx, NewFrameWriter(io.Discard)); !errors.Is(err, test.want) {
+				t.Errorf("Run() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
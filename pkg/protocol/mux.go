@@ -0,0 +1,276 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errMuxClosed = errors.New("multiplexed connection closed")
+
+// maxChannelBuffer bounds what a channel buffers until read. Without flow
+// control between the ends, a channel whose reader doesn't keep up is
+// closed rather than let grow without bound.
+const maxChannelBuffer = 4 << 20
+
+// Mux carries several hrun connections, its channels, over a single one.
+// The client opens the channels, numbered in increasing order, and either
+// end can close them.
+type Mux struct {
+	conn   net.Conn
+	frames *FrameWriter
+	// onOpen serves the channels opened by the peer, nil on the client
+	onOpen func(*MuxChannel)
+	// Alive pings the peer, nil when it doesn't support it
+	Alive *Keepalive
+	// MaxChannels bounds the channels the peer may have open at once,
+	// unbounded when zero. The ones opened past it are closed right away.
+	MaxChannels int
+
+	mu       sync.Mutex
+	channels map[uint32]*MuxChannel
+	// lastID is the ID of the last channel opened
+	lastID uint32
+	closed bool
+}
+
+func NewMux(conn net.Conn, frames *FrameWriter, onOpen func(*MuxChannel)) *Mux {
+	return &Mux{conn: conn, frames: frames, onOpen: onOpen, channels: make(map[uint32]*MuxChannel)}
+}
+
+// Run dispatches the frames of the connection to the channels until it's
+// closed, then closes them all.
+func (m *Mux) Run() error {
+	defer m.shutdown()
+	for {
+		frameType, payload, err := ReadFrame(m.conn)
+		if err != nil {
+			return err
+		}
+		m.Alive.Seen()
+		if frameType == FramePing {
+			m.frames.WritePong(payload)
+			continue
+		}
+		if (frameType != FrameChannel && frameType != FrameChannelClose) || len(payload) < 4 {
+			continue
+		}
+		id := binary.BigEndian.Uint32(payload)
+
+		m.mu.Lock()
+		ch := m.channels[id]
+		opened := false
+		// Channels are opened in order, the data of a channel closed
+		// meanwhile doesn't open it again
+		refused := false
+		if ch == nil && frameType == FrameChannel && m.onOpen != nil && id > m.lastID {
+			if m.MaxChannels > 0 && len(m.channels) >= m.MaxChannels {
+				m.lastID = id
+				refused = true
+			} else {
+				ch = m.newChannel(id)
+				opened = true
+			}
+		}
+		if frameType == FrameChannelClose {
+			delete(m.channels, id)
+		}
+		m.mu.Unlock()
+		if refused {
+			m.frames.WriteFrame(FrameChannelClose, binary.BigEndian.AppendUint32(nil, id))
+			continue
+		}
+		if ch == nil {
+			continue
+		}
+
+		if frameType == FrameChannelClose {
+			ch.closeRemote()
+			continue
+		}
+		if !ch.receive(payload[4:]) {
+			ch.Close()
+			continue
+		}
+		if opened {
+			m.onOpen(ch)
+		}
+	}
+}
+
+// Open opens a new channel to the peer.
+func (m *Mux) Open() (*MuxChannel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errMuxClosed
+	}
+	return m.newChannel(m.lastID + 1), nil
+}
+
+// newChannel adds the channel with the given ID. The caller holds m.mu.
+func (m *Mux) newChannel(id uint32) *MuxChannel {
+	ch := &MuxChannel{mux: m, id: id}
+	ch.cond = sync.NewCond(&ch.mu)
+	m.channels[id] = ch
+	m.lastID = id
+	return ch
+}
+
+// shutdown closes the connection along with its channels.
+func (m *Mux) shutdown() {
+	m.mu.Lock()
+	m.closed = true
+	channels := m.channels
+	m.channels = make(map[uint32]*MuxChannel)
+	m.mu.Unlock()
+	m.conn.Close()
+	for _, ch := range channels {
+		ch.closeRemote()
+	}
+}
+
+// MuxChannel is a connection carried by a Mux. What the peer sends is
+// buffered until read, so a slow channel doesn't hold the other ones.
+type MuxChannel struct {
+	mux *Mux
+	id  uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// eof is set once the peer closed the channel, closed once it was
+	// closed here
+	eof    bool
+	closed bool
+	// deadline is the read deadline, timer wakes the readers up at it
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// receive buffers data sent by the peer, reporting false when it would
+// overflow the buffer.
+func (c *MuxChannel) receive(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	if c.buf.Len()+len(data) > maxChannelBuffer {
+		return false
+	}
+	c.buf.Write(data)
+	c.cond.Broadcast()
+	return true
+}
+
+func (c *MuxChannel) closeRemote() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eof = true
+	c.cond.Broadcast()
+}
+
+func (c *MuxChannel) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.buf.Len() > 0:
+			return c.buf.Read(p)
+		case c.eof:
+			return 0, io.EOF
+		case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+// Write sends the data in as many frames as needed.
+func (c *MuxChannel) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed, eof := c.closed, c.eof
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if eof {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+maxFrameSize-4)]
+		payload := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(chunk)), c.id)
+		if err := c.mux.frames.WriteFrame(FrameChannel, append(payload, chunk...)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close closes the channel on both ends, it is safe to call more than
+// once.
+func (c *MuxChannel) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	eof := c.eof
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	m := c.mux
+	m.mu.Lock()
+	delete(m.channels, c.id)
+	m.mu.Unlock()
+	if !eof {
+		m.frames.WriteFrame(FrameChannelClose, binary.BigEndian.AppendUint32(nil, c.id))
+	}
+	return nil
+}
+
+func (c *MuxChannel) LocalAddr() net.Addr  { return c.mux.conn.LocalAddr() }
+func (c *MuxChannel) RemoteAddr() net.Addr { return c.mux.conn.RemoteAddr() }
+
+func (c *MuxChannel) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *MuxChannel) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline does nothing, the writes of every channel go to the
+// same connection.
+func (c *MuxChannel) SetWriteDeadline(t time.Time) error {
+	return nil
+}
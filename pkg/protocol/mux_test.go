@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newMuxPair returns the client end of a multiplexed connection whose
+// server end opens its channels without ever reading them.
+func newMuxPair(t *testing.T, maxChannels int) *Mux {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	client := NewMux(clientConn, NewFrameWriter(clientConn), nil)
+	server := NewMux(serverConn, NewFrameWriter(serverConn), func(*MuxChannel) {})
+	server.MaxChannels = maxChannels
+	go client.Run()
+	go server.Run()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	return client
+}
+
+// readResult reads from a channel for a while, returning the error.
+func readResult(ch *MuxChannel) error {
+	ch.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := ch.Read(make([]byte, 1))
+	return err
+}
+
+func TestMuxLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxChannels int
+		channels    int
+		size        int
+		// closed tells which channels the server closes
+		closed []bool
+	}{
+		{"within the limits", 2, 2, 1024, []bool{false, false}},
+		{"too many channels", 1, 2, 1, []bool{false, true}},
+		{"unbounded channels", 0, 3, 1, []bool{false, false, false}},
+		{"buffer overflow", 0, 1, maxChannelBuffer + 1, []bool{true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newMuxPair(t, test.maxChannels)
+			for i := 0; i < test.channels; i++ {
+				ch, err := client.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The writes fail once the server closed the channel
+				ch.Write(make([]byte, test.size))
+				err = readResult(ch)
+				if test.closed[i] && !errors.Is(err, io.EOF) {
+					t.Errorf("channel %d: Read() = %v, want EOF", i, err)
+				}
+				if !test.closed[i] && !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("channel %d: Read() = %v, want it still open", i, err)
+				}
+			}
+		})
+	}
+}
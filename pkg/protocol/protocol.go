@@ -0,0 +1,860 @@
+// Package protocol implements the wire protocol between the hrun clients
+// and servers: the frames, the handshake negotiating the version and the
+// features, and the messages the frames carry.
+package protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolVersion is the latest protocol version spoken, it is bumped on
+// every incompatible change to the wire format. The server still accepts
+// clients down to MinProtocolVersion.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Features negotiated during the hello exchange. Version 1 peers don't
+// send a hello and implicitly support LegacyFeatures.
+const (
+	FeatureResize       = "resize"
+	FeatureExitCode     = "exit-code"
+	FeatureSplitStderr  = "split-stderr"
+	FeatureNoPTY        = "no-pty"
+	FeatureEnv          = "env"
+	FeatureCwd          = "cwd"
+	FeatureSignals      = "signals"
+	FeatureDetach       = "detach"
+	FeatureSessions     = "sessions"
+	FeatureList         = "list"
+	FeatureKill         = "kill"
+	FeatureWatch        = "watch"
+	FeatureOnDisconnect = "on-disconnect"
+	FeatureAdmin        = "admin"
+	FeatureUsage        = "usage"
+	FeatureAuth         = "auth"
+	FeatureCloseReason  = "close-reason"
+	FeatureTimeout      = "timeout"
+	FeatureOutputLimit  = "output-limit"
+	FeatureKeepalive    = "keepalive"
+	FeatureResume       = "resume"
+	FeatureMux          = "mux"
+	FeatureAllowlist    = "allowlist"
+	FeatureInfo         = "info"
+	FeaturePing         = "ping"
+	FeatureTermios      = "termios"
+	FeatureLogin        = "login"
+)
+
+var LegacyFeatures = []string{
+	FeatureResize,
+	FeatureExitCode,
+	FeatureSplitStderr,
+	FeatureNoPTY,
+	FeatureEnv,
+	FeatureCwd,
+}
+
+// SupportedFeatures lists the features this build implements.
+var SupportedFeatures = []string{
+	FeatureResize,
+	FeatureExitCode,
+	FeatureSplitStderr,
+	FeatureNoPTY,
+	FeatureEnv,
+	FeatureCwd,
+	FeatureSignals,
+	FeatureDetach,
+	FeatureSessions,
+	FeatureList,
+	FeatureKill,
+	FeatureWatch,
+	FeatureOnDisconnect,
+	FeatureAdmin,
+	FeatureUsage,
+	FeatureAuth,
+	FeatureCloseReason,
+	FeatureTimeout,
+	FeatureOutputLimit,
+	FeatureKeepalive,
+	FeatureResume,
+	FeatureMux,
+	FeatureAllowlist,
+	FeatureInfo,
+	FeaturePing,
+	FeatureTermios,
+	FeatureLogin,
+}
+
+// protocolMagic starts every connection, followed by a single byte with
+// the protocol version spoken by the client.
+var protocolMagic = []byte("HRUN")
+
+// Frame types. Every frame is a one-byte type followed by a 4-byte
+// big-endian payload length and the payload itself.
+const (
+	// FrameData carries the terminal output from the server, or the
+	// input from the client
+	FrameData byte = iota + 1
+	// FrameExit carries the command exit code as a 4-byte big-endian int
+	FrameExit
+	// FrameStderr carries the command stderr when it is split from the
+	// terminal output
+	FrameStderr
+	// FrameRequest carries the JSON encoded Command, it is the first frame
+	// sent by the client
+	FrameRequest
+	// FrameResize carries the new terminal width and height as two
+	// 2-byte big-endian ints
+	FrameResize
+	// FrameEOF tells the server the client input is over
+	FrameEOF
+	// FrameHello carries the JSON encoded Hello, exchanged right after the
+	// preamble from protocol version 2
+	FrameHello
+	// FrameSignal carries the name of a signal to deliver to the command,
+	// like "INT" or "TERM"
+	FrameSignal
+	// FrameDetach asks the server to keep the command running after the
+	// client disconnects, the server echoes it back once detached
+	FrameDetach
+	// FrameAttach carries the JSON encoded Attach, sent by the client
+	// instead of FrameRequest to reattach to a running session
+	FrameAttach
+	// FrameSession carries the JSON encoded SessionInfo, sent by the
+	// server once the client is attached to a session
+	FrameSession
+	// FrameError carries the JSON encoded ErrorMessage, sent by the server
+	// when the request can't be served
+	FrameError
+	// FrameList is sent by the client instead of FrameRequest to list the
+	// sessions, the server answers with the JSON encoded []SessionStatus
+	FrameList
+	// FrameKill carries the JSON encoded Kill, sent by the client instead
+	// of FrameRequest to terminate a session. The server answers with the
+	// JSON encoded SessionStatus once the command exited.
+	FrameKill
+	// FrameAdmin carries the JSON encoded AdminRequest, accepted on the
+	// admin socket and, for the status and stop operations, from root and
+	// the server user instead of FrameRequest. The server answers with the
+	// JSON encoded AdminResponse.
+	FrameAdmin
+	// FrameUsage carries the JSON encoded Usage of the command, sent right
+	// before FrameExit when the request asked for it
+	FrameUsage
+	// FrameAuth carries the client answer to the challenge of the server
+	// hello, the HMAC-SHA256 of the challenge keyed by the client token.
+	// It is sent right before the request.
+	FrameAuth
+	// FrameClose carries why the server terminated the command, as text,
+	// sent right before FrameExit
+	FrameClose
+	// FrameTruncated carries the JSON encoded Truncated, sent once when
+	// the output of the command reached the server limit
+	FrameTruncated
+	// FramePing asks the peer to answer with FramePong, sent by both ends
+	// of a session so half-open connections are noticed. Clients checking
+	// that the server is alive send it instead of FrameRequest.
+	FramePing
+	// FramePong answers FramePing, echoing its payload
+	FramePong
+	// FrameMux is sent by the client instead of FrameRequest to carry
+	// several connections over this one, the server echoes it back. Only
+	// channel frames and pings follow.
+	FrameMux
+	// FrameChannel carries the 4-byte big-endian ID of a channel followed
+	// by its data. The first one with a new ID, always sent by the client,
+	// opens the channel.
+	FrameChannel
+	// FrameChannelClose carries the 4-byte big-endian ID of a channel
+	// closed by the sender
+	FrameChannelClose
+	// FrameAllowlist is sent by the client instead of FrameRequest to get
+	// the commands it may run, the server answers with the JSON encoded
+	// Allowlist applying to it
+	FrameAllowlist
+	// FrameInfo is sent by the client instead of FrameRequest to get the
+	// version, features and limits of the server, which answers with the
+	// JSON encoded ServerInfo
+	FrameInfo
+)
+
+// maxFrameSize bounds the payload of a single frame so a corrupted length
+// can't make the reader allocate unbounded memory.
+const maxFrameSize = 1 << 20
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// Command is the request sent by the client to run a command on the host.
+type Command struct {
+	Command []string
+	Width   uint16
+	Height  uint16
+
+	// SplitStderr asks the server to send stderr as separate frames
+	// instead of mixing it into the terminal output
+	SplitStderr bool
+	// NoPTY asks the server to run the command with plain pipes instead
+	// of a pty, stdout and stderr are always sent separately
+	NoPTY bool
+	// Env holds the NAME=value variables to set for the command, subject
+	// to the server allowlist
+	Env []string
+	// Cwd is the working directory of the command, the one of the client
+	// unless given, used when it also exists on the host
+	Cwd string
+	// Termios is the mode of the terminal of the client, for the pty of
+	// the command
+	Termios *Termios `json:",omitempty"`
+	// Term and ColorTerm are the TERM and COLORTERM of the client, set for
+	// the command instead of the ones of the server, so that its colors
+	// and terminfo match the terminal showing it. Env overrides them.
+	Term      string `json:",omitempty"`
+	ColorTerm string `json:",omitempty"`
+	// Login runs the command as a login shell, with a dash before the
+	// name in its argv[0] as login does, so that it reads the profiles
+	Login bool `json:",omitempty"`
+	// Locale holds the LANG, LANGUAGE and LC_* variables of the client, as
+	// NAME=value, set for the command instead of the ones of the server
+	// unless its configuration says otherwise. Env overrides them.
+	Locale []string `json:",omitempty"`
+	// Persistent keeps the command running when the client disconnects,
+	// so it can be reattached later. It is the same as OnDisconnect set to
+	// OnDisconnectKeep, kept for older servers.
+	Persistent bool
+	// OnDisconnect is what happens to the command when the client goes
+	// away, the server policy applies when empty
+	OnDisconnect string
+	// Name identifies the session for reattaching, besides its ID
+	Name string
+	// Usage asks the server to report the resources used by the command
+	// once it exited
+	Usage bool
+	// Timeout asks the server to terminate the command after that many
+	// seconds, never when zero
+	Timeout float64
+}
+
+// Usage is the resources used by a command and its reaped children.
+type Usage struct {
+	UserSeconds   float64
+	SystemSeconds float64
+	// MaxRSS is the peak resident set size, in KiB
+	MaxRSS int64
+}
+
+// Truncated tells the client the output of its command went past the
+// server limit, the output after Limit bytes is dropped.
+type Truncated struct {
+	Limit int64
+	// Killed is true when the command is terminated as well
+	Killed bool
+}
+
+// Policies applied to a command when its client goes away.
+const (
+	// OnDisconnectKeep leaves the command running, so it can be
+	// reattached later
+	OnDisconnectKeep = "keep"
+	// OnDisconnectHup sends SIGHUP to the command, leaving it to decide
+	// whether to exit
+	OnDisconnectHup = "hup"
+	// OnDisconnectKill sends SIGHUP to the command, then SIGTERM and
+	// SIGKILL if it is still running after a grace period
+	OnDisconnectKill = "kill"
+)
+
+// ValidOnDisconnect reports whether policy is a known on-disconnect policy.
+func ValidOnDisconnect(policy string) bool {
+	return policy == OnDisconnectKeep || policy == OnDisconnectHup || policy == OnDisconnectKill
+}
+
+// Attach asks to reattach to a running session.
+type Attach struct {
+	// ID is the ID or the name of the session
+	ID string
+	// Offset is the amount of output already received, a negative value
+	// resumes from what the server last sent
+	Offset int64
+	// Watch only streams the output, leaving the session to its client.
+	// The input of watchers is ignored.
+	Watch bool
+	// Token is the one of SessionInfo, given by clients resuming the
+	// session after losing their connection
+	Token string `json:",omitempty"`
+}
+
+// Kill asks to terminate a session.
+type Kill struct {
+	// ID is the ID or the name of the session
+	ID string
+}
+
+// Allowlist is what a client may run, as the server decides for it.
+type Allowlist struct {
+	// Allowed are the patterns of the allowed commands, as in podman,
+	// podman* or /usr/bin/*. When empty, any command not denied is.
+	Allowed []string
+	// Denied are the patterns of the denied commands, checked first
+	Denied []string
+	// Aliases are the commands the server expands, by name, allowed when
+	// their expansion is
+	Aliases map[string][]string `json:",omitempty"`
+}
+
+// ServerInfo describes a server, to tell apart mismatched deployments.
+type ServerInfo struct {
+	// Version is the version of hrun the server was built from, Commit
+	// and BuildDate the revision and the date of the build, as in Build
+	Version   string
+	Commit    string `json:",omitempty"`
+	BuildDate string `json:",omitempty"`
+	GoVersion string
+	OS        string
+	Arch      string
+	// Protocol and MinProtocol are the newest and oldest protocol versions
+	// the server speaks, Features the features it supports
+	Protocol    int
+	MinProtocol int
+	Features    []string
+	// Enabled lists the optional checks and services of the server
+	// configuration, as in token or polkit
+	Enabled []string `json:",omitempty"`
+	// Limits are the ones applying to the client
+	Limits Limits
+}
+
+// Limits are the limits of a server, each of them unlimited when zero.
+type Limits struct {
+	// RateLimit is how many connections per second each user may open,
+	// with bursts of up to RateBurst
+	RateLimit float64
+	RateBurst int
+	// MaxSessions caps the sessions running at once, MaxUserSessions the
+	// ones of each user
+	MaxSessions     int
+	MaxUserSessions int
+	// IdleTimeoutSeconds and MaxDurationSeconds terminate the sessions
+	// idle or running for that long
+	IdleTimeoutSeconds float64
+	MaxDurationSeconds float64
+	// MaxOutput bounds the output of each session, in bytes, and
+	// OnOutputLimit is what happens past it
+	MaxOutput     int64
+	OnOutputLimit string `json:",omitempty"`
+	// KeepaliveIntervalSeconds is how often the clients are pinged, and
+	// KeepaliveTimeoutSeconds how long they may stay silent
+	KeepaliveIntervalSeconds float64
+	KeepaliveTimeoutSeconds  float64
+	// ResumeTimeoutSeconds is how long sessions wait for their client to
+	// come back after losing its connection
+	ResumeTimeoutSeconds float64
+}
+
+// Operations accepted on the admin socket.
+const (
+	AdminListSessions = "list-sessions"
+	AdminKillSession  = "kill-session"
+	AdminReloadConfig = "reload-config"
+	AdminSetLogLevel  = "set-log-level"
+	AdminDrain        = "drain"
+	AdminStats        = "stats"
+	AdminStatus       = "status"
+	AdminStop         = "stop"
+)
+
+// AdminRequest asks the server for an administrative operation.
+type AdminRequest struct {
+	Op string
+	// Session is the ID or name of the session to kill
+	Session string `json:",omitempty"`
+	// Level is the new log level
+	Level string `json:",omitempty"`
+	// Now stops the server right away, terminating the running commands
+	// instead of waiting for them
+	Now bool `json:",omitempty"`
+}
+
+// AdminResponse is the result of an admin operation.
+type AdminResponse struct {
+	Sessions []SessionStatus `json:",omitempty"`
+	Stats    *Stats          `json:",omitempty"`
+	Status   *ServerStatus   `json:",omitempty"`
+	Message  string          `json:",omitempty"`
+}
+
+// ServerStatus is the state of a running server.
+type ServerStatus struct {
+	PID       int
+	Version   string
+	StartedAt time.Time
+	// Draining is true once the server refuses new commands, to shut down
+	// when the running ones exited
+	Draining bool
+	// Addresses are the ones the server listens on, Config its config file
+	Addresses []string
+	Config    string `json:",omitempty"`
+	// Sessions is the number of sessions, RunningSessions the ones whose
+	// command didn't exit yet
+	Sessions        int
+	RunningSessions int
+}
+
+// Stats are the server counters since it started.
+type Stats struct {
+	StartedAt time.Time
+	// Sessions is the number of commands started, ActiveSessions the ones
+	// still running
+	Sessions       int64
+	ActiveSessions int
+	// DeniedCommands is the number of commands refused by the policy
+	DeniedCommands int64
+	// BytesIn is the input sent to the commands, BytesOut their output
+	BytesIn  int64
+	BytesOut int64
+	// AverageSessionSeconds is the average run time of the finished
+	// sessions
+	AverageSessionSeconds float64
+}
+
+// SessionInfo describes the session a client is attached to.
+type SessionInfo struct {
+	ID         string
+	Name       string
+	NoPTY      bool
+	Persistent bool
+	// Offset is the amount of output produced before what the server
+	// sends next
+	Offset int64 `json:",omitempty"`
+	// Token lets the client resume the session once its connection is
+	// lost, only given to clients supporting it
+	Token string `json:",omitempty"`
+}
+
+// SessionStatus describes a session on the server, as listed by FrameList.
+type SessionStatus struct {
+	ID      string
+	Name    string
+	Command []string
+	PID     int
+	// UID is the user ID of the client that started the session, -1 when
+	// unknown
+	UID       int
+	StartedAt time.Time
+	// Width and Height are the current pty size, zero without a pty
+	Width        uint16
+	Height       uint16
+	NoPTY        bool
+	Persistent   bool
+	OnDisconnect string
+	// State is the lifecycle stage, like "running" or "closed"
+	State    string
+	Attached bool
+	// Watchers is the number of read-only clients
+	Watchers int
+	Exited   bool
+	ExitCode int
+}
+
+// Ref returns how the user can refer to the session, preferring its name.
+func (s *SessionInfo) Ref() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.ID
+}
+
+// Error codes sent in ErrorMessage.
+const (
+	ErrorDenied      = "denied"
+	ErrorNotFound    = "not-found"
+	ErrorInvalid     = "invalid"
+	ErrorConflict    = "conflict"
+	ErrorUnavailable = "unavailable"
+	ErrorRateLimited = "rate-limited"
+	ErrorBusy        = "busy"
+)
+
+// ErrorMessage tells the client why its request can't be served.
+type ErrorMessage struct {
+	Code    string
+	Message string
+}
+
+func (e *ErrorMessage) Error() string {
+	return e.Message
+}
+
+// Hello advertises the protocol version and the features of a peer. The
+// server answers the client hello with the negotiated values.
+type Hello struct {
+	Version  int
+	Features []string
+	// Challenge is a random nonce sent by servers requiring a token, the
+	// client proves it knows one by answering with FrameAuth
+	Challenge []byte `json:",omitempty"`
+}
+
+// Negotiate returns the hello the server sends back to a client, with the
+// highest common version and the features both sides support.
+func (h *Hello) Negotiate() *Hello {
+	negotiated := &Hello{Version: min(h.Version, ProtocolVersion)}
+	for _, feature := range h.Features {
+		if hasFeature(SupportedFeatures, feature) {
+			negotiated.Features = append(negotiated.Features, feature)
+		}
+	}
+	return negotiated
+}
+
+// Has reports whether the feature was advertised.
+func (h *Hello) Has(feature string) bool {
+	return hasFeature(h.Features, feature)
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// WritePreamble writes the magic and the protocol version that open every
+// connection.
+func WritePreamble(w io.Writer) error {
+	_, err := w.Write(append(append([]byte{}, protocolMagic...), ProtocolVersion))
+	return err
+}
+
+// ReadPreamble reads the connection preamble and returns the protocol
+// version of the client, failing if it is too old to be served.
+func ReadPreamble(r io.Reader) (int, error) {
+	preamble := make([]byte, len(protocolMagic)+1)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(preamble[:len(protocolMagic)], protocolMagic) {
+		return 0, errors.New("not an hrun client")
+	}
+	version := int(preamble[len(protocolMagic)])
+	if version < MinProtocolVersion {
+		return 0, fmt.Errorf("unsupported protocol version %d", version)
+	}
+	return version, nil
+}
+
+// FrameSender is implemented by everything frames can be sent to.
+type FrameSender interface {
+	WriteFrame(frameType byte, payload []byte) error
+}
+
+// FrameWriter serializes frames written from multiple goroutines.
+type FrameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// ponging is set while a pong is being sent
+	ponging atomic.Bool
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame writes a single frame of the given type.
+func (fw *FrameWriter) WriteFrame(frameType byte, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return errFrameTooLarge
+	}
+
+	frame := make([]byte, 5+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	_, err := fw.w.Write(frame)
+	return err
+}
+
+// WritePong answers a ping aside: the writes block while the peer isn't
+// reading, and the loop reading its frames must go on meanwhile for the
+// keepalive to see them. The pings received while a pong is still pending
+// are answered by it.
+func (fw *FrameWriter) WritePong(payload []byte) {
+	if !fw.ponging.CompareAndSwap(false, true) {
+		return
+	}
+	payload = bytes.Clone(payload)
+	go func() {
+		fw.WriteFrame(FramePong, payload)
+		fw.ponging.Store(false)
+	}()
+}
+
+// WriteRequest sends the command to run.
+func (fw *FrameWriter) WriteRequest(cmd *Command) error {
+	return fw.WriteJSON(FrameRequest, cmd)
+}
+
+// WriteHello sends the version and the features of this side.
+func (fw *FrameWriter) WriteHello(hello *Hello) error {
+	return fw.WriteJSON(FrameHello, hello)
+}
+
+// WriteJSON sends a frame with a JSON encoded payload.
+func (fw *FrameWriter) WriteJSON(frameType byte, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fw.WriteFrame(frameType, payload)
+}
+
+// WriteError tells the client why its request can't be served.
+func (fw *FrameWriter) WriteError(code, message string) error {
+	return fw.WriteJSON(FrameError, &ErrorMessage{Code: code, Message: message})
+}
+
+// WriteResize sends the new terminal size.
+func (fw *FrameWriter) WriteResize(width, height uint16) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload, width)
+	binary.BigEndian.PutUint16(payload[2:], height)
+	return fw.WriteFrame(FrameResize, payload)
+}
+
+// WriteExit sends the exit code of the command.
+func (fw *FrameWriter) WriteExit(code int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(int32(code)))
+	return fw.WriteFrame(FrameExit, payload)
+}
+
+// DecodeRequest decodes the payload of a FrameRequest frame.
+func DecodeRequest(payload []byte) (*Command, error) {
+	var cmd Command
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// DecodeHello decodes the payload of a FrameHello frame.
+func DecodeHello(payload []byte) (*Hello, error) {
+	var hello Hello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return nil, err
+	}
+	return &hello, nil
+}
+
+// ReadHello reads the next frame, expecting a hello.
+func ReadHello(r io.Reader) (*Hello, error) {
+	frameType, payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if frameType != FrameHello {
+		return nil, fmt.Errorf("expected a hello, got frame type %d", frameType)
+	}
+	return DecodeHello(payload)
+}
+
+// DecodeResize decodes the payload of a FrameResize frame.
+func DecodeResize(payload []byte) (uint16, uint16, error) {
+	if len(payload) != 4 {
+		return 0, 0, errors.New("invalid resize frame")
+	}
+	return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), nil
+}
+
+// DecodeExit decodes the payload of a FrameExit frame.
+func DecodeExit(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return 0, errors.New("invalid exit frame")
+	}
+	return int(int32(binary.BigEndian.Uint32(payload))), nil
+}
+
+// ReadFrame reads a single frame, returning its type and payload.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, errFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// CopyToFrames reads from r until EOF and writes everything as frames of
+// the given type.
+func CopyToFrames(fw FrameSender, frameType byte, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := fw.WriteFrame(frameType, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// SessionState is the lifecycle stage of a session. A session only moves
+// forward through the states.
+type SessionState int
+
+const (
+	// SessionNegotiating is a session being set up, before its command
+	// started
+	SessionNegotiating SessionState = iota
+	// SessionRunning is a session whose command is running
+	SessionRunning
+	// SessionDraining is a session whose command exited, while its
+	// remaining output is sent
+	SessionDraining
+	// SessionClosed is a session whose exit code is known and whose
+	// resources were released
+	SessionClosed
+)
+
+func (st SessionState) String() string {
+	switch st {
+	case SessionNegotiating:
+		return "negotiating"
+	case SessionRunning:
+		return "running"
+	case SessionDraining:
+		return "draining"
+	case SessionClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("SessionState(%d)", int(st))
+}
+
+// Exit codes of the client, besides the one of the command.
+const (
+	// ExitCommandNotFound is reported when the command can't be started
+	ExitCommandNotFound = 127
+	// ExitTimeout is returned when the server terminated the command
+	// because of --timeout or max_duration, like timeout(1) does
+	ExitTimeout = 124
+	// ExitConnectionError is returned when the session ends without an
+	// exit code from the server
+	ExitConnectionError = 255
+)
+
+// CloseTimeout is the FrameClose reason of the commands the server
+// terminated because of their timeout or of max_duration, the one clients
+// exit with ExitTimeout for.
+const CloseTimeout = "command timed out, terminated"
+
+// AuthProof answers a challenge with the token, without revealing it.
+func AuthProof(token string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("hrun auth\x00"))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// The build metadata, which builds may set with -ldflags, as in
+// -X github.com/mirkobrombin/hrun/pkg/protocol.version=v1.2.0, read from
+// the build info of the binary otherwise.
+var version, commit, buildDate string
+
+// Build describes the build of the running binary.
+type Build struct {
+	// Version is the version of the hrun module, (devel) when built from
+	// a source tree
+	Version string
+	// Commit is the revision built, suffixed with -dirty when the tree
+	// had changes, and Date the time of the build or of the commit, in
+	// RFC 3339, both empty when unknown
+	Commit string `json:",omitempty"`
+	Date   string `json:",omitempty"`
+}
+
+// ReadBuild returns the build metadata of the running binary.
+func ReadBuild() Build {
+	build := Build{Version: version, Commit: commit, Date: buildDate}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if build.Version == "" {
+			build.Version = info.Main.Version
+		}
+		modified := false
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				build.Commit = setting.Value
+			case setting.Key == "vcs.time" && build.Date == "":
+				build.Date = setting.Value
+			case setting.Key == "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && commit == "" && build.Commit != "" {
+			build.Commit += "-dirty"
+		}
+	}
+	if build.Version == "" {
+		build.Version = "(devel)"
+	}
+	return build
+}
+
+// BuildVersion returns the version of the hrun module in the running
+// binary, (devel) when built from a source tree.
+func BuildVersion() string {
+	return ReadBuild().Version
+}
+
+// IsLocaleVariable reports whether the environment variable name is one
+// of the locale, as LANG or LC_CTYPE.
+func IsLocaleVariable(name string) bool {
+	return name == "LANG" || name == "LANGUAGE" || strings.HasPrefix(name, "LC_")
+}
+
+// FormatBytes formats a byte count with a binary unit.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
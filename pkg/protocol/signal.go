@@ -0,0 +1,22 @@
+package protocol
+
+import "os"
+
+// SignalName returns the protocol name of a forwarded signal.
+func SignalName(sig os.Signal) (string, bool) {
+	for name, s := range ForwardedSignals {
+		if s == sig {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// SignalList returns the forwarded signals, for signal.Notify.
+func SignalList() []os.Signal {
+	signals := make([]os.Signal, 0, len(ForwardedSignals))
+	for _, sig := range ForwardedSignals {
+		signals = append(signals, sig)
+	}
+	return signals
+}
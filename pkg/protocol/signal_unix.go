@@ -0,0 +1,16 @@
+//go:build unix
+
+package protocol
+
+import "syscall"
+
+// ForwardedSignals are the signals the client relays to the host command.
+// They travel by name, as numbers differ between platforms.
+var ForwardedSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
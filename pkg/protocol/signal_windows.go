@@ -0,0 +1,13 @@
+package protocol
+
+import "syscall"
+
+// ForwardedSignals are the signals the client relays to the host command.
+// They travel by name, as numbers differ between platforms, and Windows
+// has no user-defined ones.
+var ForwardedSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
@@ -0,0 +1,13 @@
+package protocol
+
+// Termios is the mode of the terminal of a client, which the server gives
+// to the pty of its command, so that programs relying on it behave as they
+// would locally. Modes and characters travel by their stty names, as the
+// values differ between platforms, and the unknown ones are ignored.
+type Termios struct {
+	// Modes tells whether each mode is on, as in echo, isig or ixon
+	Modes map[string]bool `json:",omitempty"`
+	// Chars are the control characters, as in intr or eof, zero when
+	// disabled
+	Chars map[string]byte `json:",omitempty"`
+}
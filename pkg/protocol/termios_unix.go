@@ -0,0 +1,123 @@
+//go:build unix
+
+package protocol
+
+import "golang.org/x/sys/unix"
+
+// termiosFlag is a mode of a terminal, a bit of one of the flags of its
+// termios.
+type termiosFlag struct {
+	field int
+	bit   uint64
+}
+
+// The flags of a termios holding the modes.
+const (
+	inputFlags = iota
+	outputFlags
+	localFlags
+)
+
+// termiosModes are the modes of a terminal carried by a Termios.
+var termiosModes = map[string]termiosFlag{
+	"icrnl":   {inputFlags, unix.ICRNL},
+	"inlcr":   {inputFlags, unix.INLCR},
+	"igncr":   {inputFlags, unix.IGNCR},
+	"istrip":  {inputFlags, unix.ISTRIP},
+	"ixon":    {inputFlags, unix.IXON},
+	"ixoff":   {inputFlags, unix.IXOFF},
+	"ixany":   {inputFlags, unix.IXANY},
+	"imaxbel": {inputFlags, unix.IMAXBEL},
+	"opost":   {outputFlags, unix.OPOST},
+	"onlcr":   {outputFlags, unix.ONLCR},
+	"isig":    {localFlags, unix.ISIG},
+	"icanon":  {localFlags, unix.ICANON},
+	"iexten":  {localFlags, unix.IEXTEN},
+	"echo":    {localFlags, unix.ECHO},
+	"echoe":   {localFlags, unix.ECHOE},
+	"echok":   {localFlags, unix.ECHOK},
+	"echonl":  {localFlags, unix.ECHONL},
+	"echoctl": {localFlags, unix.ECHOCTL},
+	"echoke":  {localFlags, unix.ECHOKE},
+	"noflsh":  {localFlags, unix.NOFLSH},
+	"tostop":  {localFlags, unix.TOSTOP},
+}
+
+// termiosChars are the indexes of the control characters carried by a
+// Termios.
+var termiosChars = map[string]int{
+	"intr":    unix.VINTR,
+	"quit":    unix.VQUIT,
+	"erase":   unix.VERASE,
+	"kill":    unix.VKILL,
+	"eof":     unix.VEOF,
+	"eol":     unix.VEOL,
+	"eol2":    unix.VEOL2,
+	"start":   unix.VSTART,
+	"stop":    unix.VSTOP,
+	"susp":    unix.VSUSP,
+	"werase":  unix.VWERASE,
+	"lnext":   unix.VLNEXT,
+	"reprint": unix.VREPRINT,
+}
+
+// ReadTermios returns the mode of the terminal fd.
+func ReadTermios(fd int) (*Termios, error) {
+	t, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	flags := termiosFlags(t)
+	termios := &Termios{
+		Modes: make(map[string]bool, len(termiosModes)),
+		Chars: make(map[string]byte, len(termiosChars)),
+	}
+	for name, mode := range termiosModes {
+		termios.Modes[name] = flags[mode.field]&mode.bit != 0
+	}
+	for name, index := range termiosChars {
+		termios.Chars[name] = t.Cc[index]
+	}
+	return termios, nil
+}
+
+// Apply gives the terminal fd the modes and characters of t, leaving the
+// others as they are.
+func (t *Termios) Apply(fd int) error {
+	termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return err
+	}
+	flags := termiosFlags(termios)
+	for name, on := range t.Modes {
+		if mode, ok := termiosModes[name]; ok && on {
+			flags[mode.field] |= mode.bit
+		} else if ok {
+			flags[mode.field] &^= mode.bit
+		}
+	}
+	setTermiosFlags(termios, flags)
+	for name, char := range t.Chars {
+		if index, ok := termiosChars[name]; ok {
+			termios.Cc[index] = char
+		}
+	}
+	return unix.IoctlSetTermios(fd, ioctlSetTermios, termios)
+}
+
+// termiosFlags returns the input, output and local flags of t, whose
+// types differ between platforms.
+func termiosFlags(t *unix.Termios) [3]uint64 {
+	return [3]uint64{uint64(t.Iflag), uint64(t.Oflag), uint64(t.Lflag)}
+}
+
+// setTermiosFlags sets the input, output and local flags of t.
+func setTermiosFlags(t *unix.Termios, flags [3]uint64) {
+	setFlag(&t.Iflag, flags[inputFlags])
+	setFlag(&t.Oflag, flags[outputFlags])
+	setFlag(&t.Lflag, flags[localFlags])
+}
+
+func setFlag[T uint32 | uint64](flag *T, value uint64) {
+	*flag = T(value)
+}
@@ -0,0 +1,14 @@
+package protocol
+
+import "errors"
+
+// ReadTermios fails on Windows, whose consoles have no termios.
+func ReadTermios(fd int) (*Termios, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// Apply fails on Windows, where the commands run in a ConPTY without
+// termios.
+func (t *Termios) Apply(fd int) error {
+	return errors.ErrUnsupported
+}
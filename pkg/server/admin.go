@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// listenAdmin creates the admin socket, only reachable by the server user.
+// Root bypasses the permissions, and abstract sockets have none, the peer
+// credentials are checked anyway.
+func listenAdmin(path string) (net.Listener, error) {
+	if transport.IsNamedPipe(path) {
+		return transport.ListenPipe(path)
+	}
+	listener, err := transport.ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if transport.IsAbstractSocket(path) {
+		return listener, nil
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// handleAdminConnection serves a single admin request from root or the
+// server user.
+func (s *Server) handleAdminConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	frames := protocol.NewFrameWriter(conn)
+
+	// Unblock the connection when the server shuts down
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if _, err := negotiate(conn, frames, nil); err != nil {
+		slog.Error("Error negotiating with the admin client", "err", err)
+		return
+	}
+
+	peer, err := connectionPeer(conn)
+	if err != nil {
+		slog.Error("Error reading admin client credentials", "err", err)
+		frames.WriteError(protocol.ErrorDenied, "unable to identify the client")
+		return
+	}
+	if peer.UID != 0 && !peer.serverUser {
+		slog.Warn("Denying admin access", "peer_uid", peer.UID)
+		frames.WriteError(protocol.ErrorDenied, "the admin socket is reserved to root and the server user")
+		return
+	}
+
+	frameType, payload, err := protocol.ReadFrame(conn)
+	if err != nil {
+		slog.Error("Failed to read admin request", "err", err)
+		return
+	}
+	var req protocol.AdminRequest
+	if frameType != protocol.FrameAdmin || json.Unmarshal(payload, &req) != nil {
+		frames.WriteError(protocol.ErrorInvalid, "invalid admin request")
+		return
+	}
+
+	slog.Info("Admin request", "peer_uid", peer.UID, "op", req.Op)
+	s.answerAdmin(frames, &req)
+}
+
+// answerAdmin runs an admin operation and sends its response.
+func (s *Server) answerAdmin(frames *protocol.FrameWriter, req *protocol.AdminRequest) {
+	resp, err := s.admin(req)
+	if err != nil {
+		slog.Error("Admin request failed", "op", req.Op, "err", err)
+		var errMsg *protocol.ErrorMessage
+		if errors.As(err, &errMsg) {
+			frames.WriteError(errMsg.Code, errMsg.Message)
+		} else {
+			frames.WriteError(protocol.ErrorInvalid, err.Error())
+		}
+		return
+	}
+	if err := frames.WriteJSON(protocol.FrameAdmin, resp); err != nil {
+		slog.Error("Error sending the admin response", "err", err)
+	}
+
+	// A server drained with nothing running stops right away, once the
+	// response is sent
+	s.checkDrained()
+}
+
+// remoteAdminOps are the admin operations accepted on the addresses of the
+// server too, from root and the server user.
+var remoteAdminOps = []string{protocol.AdminStatus, protocol.AdminStop}
+
+// admin runs an admin operation.
+func (s *Server) admin(req *protocol.AdminRequest) (*protocol.AdminResponse, error) {
+	switch req.Op {
+	case protocol.AdminListSessions:
+		return &protocol.AdminResponse{Sessions: s.listSessions()}, nil
+	case protocol.AdminKillSession:
+		session := s.Session(req.Session)
+		if session == nil {
+			return nil, &protocol.ErrorMessage{Code: protocol.ErrorNotFound, Message: "no such session: " + req.Session}
+		}
+		session.log.Info("Killing session on admin request")
+		status := s.killSession(session)
+		return &protocol.AdminResponse{
+			Sessions: []protocol.SessionStatus{status},
+			Message:  fmt.Sprintf("Session %s terminated with code %d", session.ref(), status.ExitCode),
+		}, nil
+	case protocol.AdminReloadConfig:
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+		slog.Info("Configuration reloaded")
+		return &protocol.AdminResponse{Message: "Configuration reloaded"}, nil
+	case protocol.AdminSetLogLevel:
+		level, err := ParseLogLevel(req.Level)
+		if err != nil {
+			return nil, &protocol.ErrorMessage{Code: protocol.ErrorInvalid, Message: err.Error()}
+		}
+		LogLevel.Set(level)
+		slog.Info("Log level changed", "level", level)
+		return &protocol.AdminResponse{Message: "Log level set to " + level.String()}, nil
+	case protocol.AdminStats:
+		return &protocol.AdminResponse{Stats: s.stats.snapshot(s.runningSessions())}, nil
+	case protocol.AdminDrain:
+		running := s.drain()
+		return &protocol.AdminResponse{Message: fmt.Sprintf("Draining, waiting for %d running commands", running)}, nil
+	case protocol.AdminStatus:
+		return &protocol.AdminResponse{Status: s.status()}, nil
+	case protocol.AdminStop:
+		running := s.drain()
+		switch {
+		case running == 0:
+			return &protocol.AdminResponse{Message: "Stopping"}, nil
+		case req.Now:
+			s.terminateSessions("server stopping, terminated")
+			return &protocol.AdminResponse{Message: fmt.Sprintf("Stopping, terminating %d running commands", running)}, nil
+		}
+		return &protocol.AdminResponse{Message: fmt.Sprintf("Stopping, waiting for %d running commands", running)}, nil
+	}
+	return nil, &protocol.ErrorMessage{Code: protocol.ErrorInvalid, Message: fmt.Sprintf("unknown admin operation %q", req.Op)}
+}
+
+// status returns the state of the server.
+func (s *Server) status() *protocol.ServerStatus {
+	cfg := s.Config()
+	sessions := s.listSessions()
+	status := &protocol.ServerStatus{
+		PID:       os.Getpid(),
+		Version:   protocol.BuildVersion(),
+		StartedAt: s.stats.started,
+		Draining:  s.draining.Load(),
+		Addresses: cfg.ListenAddresses(),
+		Config:    s.ConfigPath,
+		Sessions:  len(sessions),
+	}
+	if status.Config == "" {
+		status.Config = FindConfig()
+	}
+	for _, session := range sessions {
+		if !session.Exited {
+			status.RunningSessions++
+		}
+	}
+	return status
+}
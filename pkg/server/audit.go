@@ -0,0 +1,138 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// Events of the audit log.
+const (
+	auditDenied  = "denied"
+	auditStarted = "started"
+	auditExited  = "exited"
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	PeerUID  int       `json:"peer_uid"`
+	PeerGID  int       `json:"peer_gid"`
+	PeerPID  int       `json:"peer_pid"`
+	Argv     []string  `json:"argv"`
+	Cwd      string    `json:"cwd,omitempty"`
+	PID      int       `json:"pid,omitempty"`
+	// The end of a session carries its times, exit code and traffic
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	BytesIn   int64      `json:"bytes_in,omitempty"`
+	BytesOut  int64      `json:"bytes_out,omitempty"`
+	// CPU time and peak memory of the command
+	UserSeconds   float64 `json:"cpu_user_seconds,omitempty"`
+	SystemSeconds float64 `json:"cpu_system_seconds,omitempty"`
+	MaxRSS        int64   `json:"max_rss_kib,omitempty"`
+}
+
+// auditLog appends a JSON line for every command request to a file: the
+// refused ones, and the start and end of the allowed ones. A nil auditLog
+// records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens the audit log at path for appending, only readable
+// by the server user.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// denied records a refused command.
+func (a *auditLog) denied(peer Peer, cmd *protocol.Command, reason string) {
+	a.write(&auditRecord{
+		Event:    auditDenied,
+		Decision: "deny",
+		Reason:   reason,
+		PeerUID:  peer.UID,
+		PeerGID:  peer.GID,
+		PeerPID:  peer.PID,
+		Argv:     cmd.Command,
+		Cwd:      cmd.Cwd,
+	})
+}
+
+// started records the start of a session.
+func (a *auditLog) started(session *Session) {
+	a.write(sessionRecord(session, auditStarted))
+}
+
+// exited records the end of a session, with its exit code and traffic.
+func (a *auditLog) exited(session *Session) {
+	record := sessionRecord(session, auditExited)
+	endedAt := time.Now()
+	record.StartedAt = &session.StartedAt
+	record.EndedAt = &endedAt
+	session.mu.Lock()
+	exitCode := session.exitCode
+	record.BytesOut = session.produced
+	if session.usage != nil {
+		record.UserSeconds = session.usage.UserSeconds
+		record.SystemSeconds = session.usage.SystemSeconds
+		record.MaxRSS = session.usage.MaxRSS
+	}
+	session.mu.Unlock()
+	record.ExitCode = &exitCode
+	record.BytesIn = session.inputBytes.Load()
+	a.write(record)
+}
+
+// sessionRecord returns the record of an allowed command.
+func sessionRecord(session *Session, event string) *auditRecord {
+	return &auditRecord{
+		Event:    event,
+		Decision: "allow",
+		Session:  session.ID,
+		Name:     session.Name,
+		PeerUID:  session.peer.UID,
+		PeerGID:  session.peer.GID,
+		PeerPID:  session.peer.PID,
+		Argv:     session.Command,
+		Cwd:      session.cmd.Dir,
+		PID:      session.PID(),
+	}
+}
+
+func (a *auditLog) write(record *auditRecord) {
+	if a == nil {
+		return
+	}
+	record.Time = time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := writeJSONLine(a.file, record); err != nil {
+		slog.Error("Error writing the audit log", "event", record.Event, "session", record.Session, "err", err)
+	}
+}
+
+// Close closes the audit log.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// challengeSize is the length of the nonces sent to the clients, fresh
+// for every connection so a captured answer can't be replayed.
+const challengeSize = 32
+
+var (
+	errMissingToken = errors.New("missing authentication token")
+	errInvalidToken = errors.New("invalid authentication token")
+)
+
+// clientToken is a token accepted by the server, with the name of the
+// client it was given to.
+type clientToken struct {
+	name  string
+	token string
+}
+
+// loadTokens reads a token file: one token per line, optionally preceded
+// by the name of its client, as in "toolbox 3f9c2a...". Empty lines and
+// lines starting with # are skipped.
+func loadTokens(path string) ([]clientToken, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tokens []clientToken
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+		case len(fields) == 1:
+			tokens = append(tokens, clientToken{token: fields[0]})
+		case len(fields) == 2:
+			tokens = append(tokens, clientToken{name: fields[0], token: fields[1]})
+		default:
+			return nil, errors.New("expected a token per line, optionally preceded by a name")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens in " + path)
+	}
+	return tokens, nil
+}
+
+// newChallenge returns a random nonce for a client to answer.
+func newChallenge() []byte {
+	challenge := make([]byte, challengeSize)
+	rand.Read(challenge)
+	return challenge
+}
+
+// Authenticate checks the answer of a client to the challenge against the
+// tokens of the token file, returning the name of the client. The file is
+// read on every connection, so tokens are added and revoked without a
+// reload.
+func (c *Config) Authenticate(challenge, proof []byte) (string, error) {
+	if len(proof) == 0 {
+		return "", errMissingToken
+	}
+	tokens, err := loadTokens(c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	// Check every token, in constant time, not to leak which one was
+	// close
+	name, found := "", false
+	for _, t := range tokens {
+		if hmac.Equal(protocol.AuthProof(t.token, challenge), proof) {
+			name, found = t.name, true
+		}
+	}
+	if !found {
+		return "", errInvalidToken
+	}
+	return name, nil
+}
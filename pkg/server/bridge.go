@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// errBridgeToken is returned by startBridge when the server requires a
+// token the client of the frontend didn't give.
+var errBridgeToken = errors.New("the server requires a token")
+
+// startBridge speaks the hrun protocol on conn, the client end of a pipe
+// whose server end was handed to the server, on behalf of the client of a
+// frontend: it negotiates features, answers the challenge with token and
+// sends the command.
+func startBridge(conn net.Conn, features []string, token string, cmd *protocol.Command) (*protocol.FrameWriter, error) {
+	frames := protocol.NewFrameWriter(conn)
+	if err := protocol.WritePreamble(conn); err != nil {
+		return nil, err
+	}
+	if err := frames.WriteHello(&protocol.Hello{Version: protocol.ProtocolVersion, Features: features}); err != nil {
+		return nil, err
+	}
+	hello, err := protocol.ReadHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Challenge != nil {
+		if token == "" {
+			return nil, errBridgeToken
+		}
+		if err := frames.WriteFrame(protocol.FrameAuth, protocol.AuthProof(token, hello.Challenge)); err != nil {
+			return nil, err
+		}
+	}
+	if err := frames.WriteRequest(cmd); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// batchFeatures are the features asked by the frontends running commands
+// without a terminal, their whole input given upfront.
+var batchFeatures = []string{
+	protocol.FeatureExitCode,
+	protocol.FeatureSplitStderr,
+	protocol.FeatureNoPTY,
+	protocol.FeatureEnv,
+	protocol.FeatureCwd,
+	protocol.FeatureAuth,
+	protocol.FeatureCloseReason,
+	protocol.FeatureTimeout,
+	protocol.FeatureOutputLimit,
+}
+
+// bridgeConn is the server end of a pipe bridging the client of a frontend
+// whose credentials are known to the hrun protocol.
+type bridgeConn struct {
+	net.Conn
+	remote net.Addr
+	peer   Peer
+}
+
+func (c *bridgeConn) RemoteAddr() net.Addr { return c.remote }
+
+// openBridge hands the server end of a pipe to the server through conns,
+// as a connection of peer from remote, and returns the other end. It fails
+// once done is closed.
+func openBridge(conns chan<- net.Conn, done <-chan struct{}, remote net.Addr, peer Peer) (net.Conn, error) {
+	serverEnd, conn := net.Pipe()
+	select {
+	case conns <- &bridgeConn{Conn: serverEnd, remote: remote, peer: peer}:
+		return conn, nil
+	case <-done:
+		serverEnd.Close()
+		conn.Close()
+		return nil, &protocol.ErrorMessage{Code: protocol.ErrorUnavailable, Message: "the server is shutting down"}
+	}
+}
+
+// runBatch runs cmd without a terminal over conn, as opened by openBridge,
+// with stdin as its whole input, and hands its output to output as it
+// comes. It returns the exit code of the command, or the error of the
+// server, a *protocol.ErrorMessage when it refused the command.
+func runBatch(conn net.Conn, token string, cmd *protocol.Command, stdin []byte, output func(stdout, stderr []byte) error) (int, error) {
+	cmd.NoPTY = true
+	cmd.SplitStderr = true
+	frames, err := startBridge(conn, batchFeatures, token, cmd)
+	if errors.Is(err, errBridgeToken) {
+		return 0, &protocol.ErrorMessage{Code: protocol.ErrorDenied, Message: err.Error()}
+	}
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		if len(stdin) > 0 {
+			frames.WriteFrame(protocol.FrameData, stdin)
+		}
+		frames.WriteFrame(protocol.FrameEOF, nil)
+	}()
+
+	for {
+		frameType, payload, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return 0, errors.New("connection to the server lost")
+		}
+		switch frameType {
+		case protocol.FrameData:
+			err = output(payload, nil)
+		case protocol.FrameStderr:
+			err = output(nil, payload)
+		case protocol.FrameError:
+			var errMsg protocol.ErrorMessage
+			if err := json.Unmarshal(payload, &errMsg); err != nil {
+				return 0, err
+			}
+			return 0, &errMsg
+		case protocol.FrameClose:
+			err = output(nil, []byte("hrun: "+string(payload)+"\n"))
+		case protocol.FrameTruncated:
+			var truncated protocol.Truncated
+			json.Unmarshal(payload, &truncated)
+			err = output(nil, []byte("hrun: output truncated after "+protocol.FormatBytes(truncated.Limit)+"\n"))
+		case protocol.FrameExit:
+			return protocol.DecodeExit(payload)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
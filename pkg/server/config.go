@@ -0,0 +1,934 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// Config holds the server settings. It is populated from the config file
+// first and then from the command-line flags, which take precedence.
+type Config struct {
+	Socket      string              `yaml:"socket" toml:"socket"`
+	AllowedCmds []string            `yaml:"allowed_cmds" toml:"allowed_cmds"`
+	DeniedCmds  []string            `yaml:"denied_cmds" toml:"denied_cmds"`
+	Aliases     map[string][]string `yaml:"aliases" toml:"aliases"`
+	AllowedEnv  []string            `yaml:"allowed_env" toml:"allowed_env"`
+	PathMap     map[string]string   `yaml:"path_map" toml:"path_map"`
+	// AllowedArgs restricts the arguments of the commands matching its
+	// keys, allowlist patterns, to the ones matching one of its regular
+	// expressions
+	AllowedArgs map[string][]string `yaml:"allowed_args" toml:"allowed_args"`
+	// Polkit asks polkit about the commands outside of the allowlist, in
+	// one of the Polkit modes, instead of denying them
+	Polkit string `yaml:"polkit" toml:"polkit"`
+	// AllowedUIDs and AllowedGIDs restrict the clients to these users and
+	// members of these groups, anyone who can open the socket is allowed
+	// when both are empty
+	AllowedUIDs []int `yaml:"allowed_uids" toml:"allowed_uids"`
+	AllowedGIDs []int `yaml:"allowed_gids" toml:"allowed_gids"`
+	// RateLimit is how many connections per second each user, or each
+	// address over the network, may open, with bursts of up to
+	// RateBurst, unlimited when zero
+	RateLimit float64 `yaml:"rate_limit" toml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst" toml:"rate_burst"`
+	// MaxSessions caps the sessions running at once, MaxUserSessions the
+	// ones of each user, unlimited when zero
+	MaxSessions     int `yaml:"max_sessions" toml:"max_sessions"`
+	MaxUserSessions int `yaml:"max_user_sessions" toml:"max_user_sessions"`
+	// IdleTimeout terminates the sessions without input nor output for
+	// that long, never when zero
+	IdleTimeout time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// MaxDuration terminates the sessions running for that long, never
+	// when zero
+	MaxDuration time.Duration `yaml:"max_duration" toml:"max_duration"`
+	// MaxOutput bounds the output sent for each session, unlimited when
+	// zero. OnOutputLimit is what happens past it, one of the OutputLimit
+	// actions, truncating when empty.
+	MaxOutput     ByteSize `yaml:"max_output" toml:"max_output"`
+	OnOutputLimit string   `yaml:"on_output_limit" toml:"on_output_limit"`
+	// UserPolicies replaces the allowlist for some users, by name or UID
+	UserPolicies map[string]Policy `yaml:"user_policies" toml:"user_policies"`
+	// GroupPolicies replaces the allowlist for the members of some groups,
+	// by name or GID, users with their own policy excepted. Members of
+	// several groups may run the commands of any of them.
+	GroupPolicies map[string]Policy `yaml:"group_policies" toml:"group_policies"`
+	// RegoPolicy is a Rego policy file deciding whether to run each
+	// command, disabled when empty
+	RegoPolicy string `yaml:"rego_policy" toml:"rego_policy"`
+	// OPA is the absolute path of the opa binary evaluating RegoPolicy,
+	// never looked up in the PATH as it takes part in the authorization
+	OPA string `yaml:"opa" toml:"opa"`
+	// AuthHook is an executable or an HTTP webhook deciding whether to run
+	// each command, disabled when empty
+	AuthHook string `yaml:"auth_hook" toml:"auth_hook"`
+	// TokenFile lists the tokens the clients must present, any client is
+	// served without one when empty
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+	// TLSCert and TLSKey are the certificate of the TCP or QUIC listener,
+	// which requires clients to present a certificate signed by TLSCA,
+	// always set over TCP. TLSAllowedNames restricts them to the ones
+	// with one of these subject alternative names.
+	TLSCert         string   `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey          string   `yaml:"tls_key" toml:"tls_key"`
+	TLSCA           string   `yaml:"tls_ca" toml:"tls_ca"`
+	TLSAllowedNames []string `yaml:"tls_allowed_names" toml:"tls_allowed_names"`
+	// SSHHostKey is the private key of the SSH listener, which accepts
+	// the clients with a key of SSHAuthorizedKeys
+	SSHHostKey        string `yaml:"ssh_host_key" toml:"ssh_host_key"`
+	SSHAuthorizedKeys string `yaml:"ssh_authorized_keys" toml:"ssh_authorized_keys"`
+	// OnDisconnect is the policy for commands whose client didn't pick
+	// one, AllowedOnDisconnect restricts the ones clients can pick
+	OnDisconnect        string   `yaml:"on_disconnect" toml:"on_disconnect"`
+	AllowedOnDisconnect []string `yaml:"allowed_on_disconnect" toml:"allowed_on_disconnect"`
+	// RecordDir is where the sessions are recorded as asciicast files,
+	// recording is disabled when empty
+	RecordDir string `yaml:"record_dir" toml:"record_dir"`
+	// Listen lists the addresses the server listens on instead of Socket,
+	// as in tcp://0.0.0.0:7070
+	Listen stringList `yaml:"listen" toml:"listen"`
+	// ListenPolicies replaces the allowlist for the clients connecting
+	// through some of the addresses, by the address as in Listen, or the
+	// socket path. Their users' policies don't apply.
+	ListenPolicies map[string]Policy `yaml:"listen_policies" toml:"listen_policies"`
+	// SocketMode is the permissions of the socket file, in octal as in
+	// 0660, and SocketOwner and SocketGroup its owner and group, by name or
+	// ID. The umask and the server user apply when empty.
+	SocketMode  string `yaml:"socket_mode" toml:"socket_mode"`
+	SocketOwner string `yaml:"socket_owner" toml:"socket_owner"`
+	SocketGroup string `yaml:"socket_group" toml:"socket_group"`
+	// AdminSocket is the path of the admin socket, next to the socket when
+	// empty
+	AdminSocket string `yaml:"admin_socket" toml:"admin_socket"`
+	// MetricsAddr is the TCP address serving the Prometheus metrics, they
+	// are disabled when empty
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr"`
+	// PprofAddr is the TCP address serving the runtime profiles, they are
+	// disabled when empty
+	PprofAddr string `yaml:"pprof_addr" toml:"pprof_addr"`
+	// OTLPEndpoint is the OpenTelemetry collector receiving the traces
+	// over HTTP, tracing is disabled when empty
+	OTLPEndpoint string `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+	// LogBackend is where the logs go, one of the LogBackend values
+	LogBackend string `yaml:"log_backend" toml:"log_backend"`
+	// AuditLog is the file every command request is appended to, as a
+	// JSON line, auditing is disabled when empty
+	AuditLog string `yaml:"audit_log" toml:"audit_log"`
+	// KeepaliveInterval is how often the clients of sessions are pinged,
+	// never when zero. Those silent for KeepaliveTimeout are disconnected,
+	// never when zero.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval" toml:"keepalive_interval"`
+	KeepaliveTimeout  time.Duration `yaml:"keepalive_timeout" toml:"keepalive_timeout"`
+	// ResumeTimeout is how long the session of a client that lost its
+	// connection waits for it to come back before the on-disconnect policy
+	// applies, never when zero
+	ResumeTimeout time.Duration `yaml:"resume_timeout" toml:"resume_timeout"`
+	// PIDFile is where the server writes its PID while running, none when
+	// empty
+	PIDFile string `yaml:"pid_file" toml:"pid_file"`
+	// ForwardLocale gives the commands the locale of their client, its
+	// LANG, LANGUAGE and LC_* variables, instead of the one of the server
+	ForwardLocale bool `yaml:"forward_locale" toml:"forward_locale"`
+}
+
+// Policy replaces the command allowlist for some clients, an empty one
+// allows any command, and possibly their session limit.
+type Policy struct {
+	AllowedCmds []string `yaml:"allowed_cmds" toml:"allowed_cmds"`
+	MaxSessions int      `yaml:"max_sessions" toml:"max_sessions"`
+}
+
+// DefaultConfig returns the settings used when neither a config file nor
+// flags say otherwise.
+func DefaultConfig() *Config {
+	return &Config{
+		Socket:       transport.DefaultSocket(),
+		OnDisconnect: protocol.OnDisconnectKill,
+		OTLPEndpoint: os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		LogBackend:   LogBackendStderr,
+
+		ForwardLocale:     true,
+		KeepaliveInterval: protocol.DefaultKeepaliveInterval,
+		KeepaliveTimeout:  protocol.DefaultKeepaliveTimeout,
+		ResumeTimeout:     protocol.DefaultResumeTimeout,
+	}
+}
+
+// LoadConfig reads a YAML, JSON or TOML config file on top of the default
+// settings, TOML being picked by the .toml extension. Unknown keys are
+// rejected so typos don't go unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(path) == ".toml" {
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown key %s", path, undecoded[0])
+		}
+		return cfg, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// DefaultConfigPaths lists the config files looked up when none is given,
+// in order of precedence: the user one first, then the system-wide one.
+func DefaultConfigPaths() []string {
+	var paths []string
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		paths = append(paths,
+			filepath.Join(configHome, "hrun", "server.yaml"),
+			filepath.Join(configHome, "hrun", "server.toml"),
+		)
+	}
+	return append(paths, "/etc/hrun/config.yaml", "/etc/hrun/config.toml")
+}
+
+// FindConfig returns the first of the default config files that exists,
+// or an empty string if there is none.
+func FindConfig() string {
+	for _, path := range DefaultConfigPaths() {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// PeerAllowed reports whether a client may use the server, by its user
+// and groups.
+func (c *Config) PeerAllowed(p Peer) bool {
+	if len(c.AllowedUIDs) == 0 && len(c.AllowedGIDs) == 0 {
+		return true
+	}
+	if p.UID < 0 {
+		return false
+	}
+	if slices.Contains(c.AllowedUIDs, p.UID) {
+		return true
+	}
+	for _, gid := range p.groups() {
+		if slices.Contains(c.AllowedGIDs, gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForPeer returns the configuration applying to a client, with the
+// allowlist of the policy of the address it connected through if it has
+// one, or else of its user policy, or else of the policies of its groups.
+func (c *Config) ForPeer(p Peer) *Config {
+	if policy, ok := c.ListenPolicies[p.listener]; ok {
+		return c.withPolicy(policy)
+	}
+	if p.UID < 0 {
+		return c
+	}
+	for name, policy := range c.UserPolicies {
+		if uid, err := LookupUID(name); err == nil && uid == p.UID {
+			return c.withPolicy(policy)
+		}
+	}
+	if len(c.GroupPolicies) == 0 {
+		return c
+	}
+
+	groups := p.groups()
+	var allowed []string
+	member, anyCmd := false, false
+	maxSessions := 0
+	for name, policy := range c.GroupPolicies {
+		gid, err := LookupGID(name)
+		if err != nil || !slices.Contains(groups, gid) {
+			continue
+		}
+		member = true
+		anyCmd = anyCmd || len(policy.AllowedCmds) == 0
+		allowed = append(allowed, policy.AllowedCmds...)
+		maxSessions = max(maxSessions, policy.MaxSessions)
+	}
+	if !member {
+		return c
+	}
+	cfg := *c
+	cfg.AllowedCmds = allowed
+	if anyCmd {
+		cfg.AllowedCmds = nil
+	}
+	if maxSessions > 0 {
+		cfg.MaxUserSessions = maxSessions
+	}
+	return &cfg
+}
+
+// withPolicy returns a copy of the configuration with the allowlist and
+// session limit of policy.
+func (c *Config) withPolicy(policy Policy) *Config {
+	cfg := *c
+	cfg.AllowedCmds = policy.AllowedCmds
+	if policy.MaxSessions > 0 {
+		cfg.MaxUserSessions = policy.MaxSessions
+	}
+	return &cfg
+}
+
+// RateBurstSize returns how many connections a user may open at once,
+// a second worth of them when RateBurst is not set.
+func (c *Config) RateBurstSize() int {
+	if c.RateBurst > 0 {
+		return c.RateBurst
+	}
+	return max(1, int(math.Ceil(c.RateLimit)))
+}
+
+// TLSEnabled reports whether the listener uses TLS.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" || c.TLSKey != "" || c.TLSCA != ""
+}
+
+// ListenAddresses returns the addresses the server listens on, the
+// socket unless Listen is set.
+func (c *Config) ListenAddresses() []string {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []string{c.Socket}
+}
+
+// AdminSocketPath returns the path of the admin socket.
+func (c *Config) AdminSocketPath() string {
+	if c.AdminSocket != "" {
+		return c.AdminSocket
+	}
+	return c.Socket + ".admin"
+}
+
+// Validate checks the settings for values the server can't work with,
+// naming the offending key in the returned error.
+func (c *Config) Validate() error {
+	if c.Socket == "" {
+		return errors.New("socket: path must not be empty")
+	}
+	if runtime.GOOS != "linux" && (transport.IsAbstractSocket(c.Socket) || transport.IsAbstractSocket(c.AdminSocket)) {
+		return errors.New("socket: abstract sockets are only available on Linux")
+	}
+	var networks []string
+	socketFiles := false
+	for i, addr := range c.ListenAddresses() {
+		key := "socket"
+		if len(c.Listen) > 0 {
+			key = fmt.Sprintf("listen[%d]", i)
+			if slices.Contains(c.Listen[:i], addr) {
+				return fmt.Errorf("%s: duplicate address %q", key, addr)
+			}
+		}
+		network, address, err := transport.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		// Nothing tells who is on the other end of a TCP, QUIC or vsock
+		// connection
+		switch {
+		case network == "tcp" && c.TokenFile == "" && !c.TLSEnabled():
+			return fmt.Errorf("%s: TCP clients can't be identified, a token_file or mutual TLS is required", key)
+		case network == "quic" && (c.TLSCert == "" || c.TLSKey == ""):
+			return fmt.Errorf("%s: QUIC requires tls_cert and tls_key", key)
+		case network == "quic" && c.TokenFile == "" && c.TLSCA == "":
+			return fmt.Errorf("%s: QUIC clients can't be identified, a token_file or tls_ca is required", key)
+		case network == "ws" && c.TokenFile == "":
+			return fmt.Errorf("%s: WebSocket clients can't be identified, a token_file is required", key)
+		case network == "grpc" && c.TokenFile == "":
+			return fmt.Errorf("%s: gRPC clients can't be identified, a token_file is required", key)
+		case network == "vsock" && c.TokenFile == "":
+			return fmt.Errorf("%s: vsock clients can't be identified, a token_file is required", key)
+		case network == "dbus" && slices.Contains(networks, "dbus"):
+			return fmt.Errorf("%s: the server can only be on one bus, it owns %s", key, dbusName)
+		case network == "dbus" && runtime.GOOS == "windows":
+			return fmt.Errorf("%s: D-Bus is not available on Windows", key)
+		case network == "launchd" && runtime.GOOS != "darwin":
+			return fmt.Errorf("%s: launchd sockets are only available on macOS", key)
+		case network == "ssh" && (c.SSHHostKey == "" || c.SSHAuthorizedKeys == ""):
+			return fmt.Errorf("%s: SSH requires ssh_host_key and ssh_authorized_keys", key)
+		}
+		networks = append(networks, network)
+		socketFiles = socketFiles || ((network == "unix" || network == "varlink") && !transport.IsAbstractSocket(address))
+	}
+	if c.SocketMode != "" || c.SocketOwner != "" || c.SocketGroup != "" {
+		if !socketFiles {
+			return errors.New("socket_mode: permissions only apply to the file of a unix socket")
+		}
+		if runtime.GOOS == "windows" {
+			return errors.New("socket_mode: socket permissions are not available on Windows")
+		}
+		if c.SocketMode != "" {
+			if _, err := parseSocketMode(c.SocketMode); err != nil {
+				return fmt.Errorf("socket_mode: %w", err)
+			}
+		}
+		if c.SocketOwner != "" {
+			if _, err := LookupUID(c.SocketOwner); err != nil {
+				return fmt.Errorf("socket_owner: %w", err)
+			}
+		}
+		if c.SocketGroup != "" {
+			if _, err := LookupGID(c.SocketGroup); err != nil {
+				return fmt.Errorf("socket_group: %w", err)
+			}
+		}
+	}
+	// Windows has no peer credentials for unix sockets
+	if runtime.GOOS == "windows" && (slices.Contains(networks, "unix") || slices.Contains(networks, "varlink")) && c.TokenFile == "" {
+		return errors.New("socket: unix socket clients can't be identified on Windows, use a named pipe or a token_file")
+	}
+	if c.SSHHostKey != "" || c.SSHAuthorizedKeys != "" {
+		if !slices.Contains(networks, "ssh") {
+			return errors.New("ssh_host_key: SSH keys are only used when listening on SSH")
+		}
+		if _, err := loadSSHHostKey(c.SSHHostKey); err != nil {
+			return fmt.Errorf("ssh_host_key: %w", err)
+		}
+		if _, err := os.Stat(c.SSHAuthorizedKeys); err != nil {
+			return fmt.Errorf("ssh_authorized_keys: %w", err)
+		}
+	}
+	if c.TLSEnabled() || len(c.TLSAllowedNames) > 0 {
+		if !slices.Contains(networks, "tcp") && !slices.Contains(networks, "quic") {
+			return errors.New("tls_cert: TLS is only available when listening on TCP or QUIC")
+		}
+		if slices.Contains(networks, "tcp") && (c.TLSCert == "" || c.TLSKey == "" || c.TLSCA == "") {
+			return errors.New("tls_cert: mutual TLS requires tls_cert, tls_key and tls_ca")
+		}
+		if c.TLSCert == "" || c.TLSKey == "" {
+			return errors.New("tls_cert: TLS requires tls_cert and tls_key")
+		}
+		if len(c.TLSAllowedNames) > 0 && c.TLSCA == "" {
+			return errors.New("tls_allowed_names: client certificates require tls_ca")
+		}
+		if _, err := c.serverTLSConfig(); err != nil {
+			return fmt.Errorf("tls_cert: %w", err)
+		}
+	}
+	for i, cmd := range c.AllowedCmds {
+		if strings.TrimSpace(cmd) == "" {
+			return fmt.Errorf("allowed_cmds[%d]: command must not be empty", i)
+		}
+		if !validCommandPattern(cmd) {
+			return fmt.Errorf("allowed_cmds[%d]: invalid pattern %q", i, cmd)
+		}
+	}
+	for i, cmd := range c.DeniedCmds {
+		if strings.TrimSpace(cmd) == "" {
+			return fmt.Errorf("denied_cmds[%d]: command must not be empty", i)
+		}
+		if !validCommandPattern(cmd) {
+			return fmt.Errorf("denied_cmds[%d]: invalid pattern %q", i, cmd)
+		}
+	}
+	if !protocol.ValidOnDisconnect(c.OnDisconnect) {
+		return fmt.Errorf("on_disconnect: unknown policy %q, expected keep, hup or kill", c.OnDisconnect)
+	}
+	for i, policy := range c.AllowedOnDisconnect {
+		if !protocol.ValidOnDisconnect(policy) {
+			return fmt.Errorf("allowed_on_disconnect[%d]: unknown policy %q", i, policy)
+		}
+	}
+	if !c.onDisconnectAllowed(c.OnDisconnect) {
+		return fmt.Errorf("on_disconnect: policy %s is not in allowed_on_disconnect", c.OnDisconnect)
+	}
+	if c.MaxSessions < 0 || c.MaxUserSessions < 0 {
+		return errors.New("max_sessions: limits must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("idle_timeout: must not be negative")
+	}
+	if c.MaxDuration < 0 {
+		return errors.New("max_duration: must not be negative")
+	}
+	if c.KeepaliveInterval < 0 || c.KeepaliveTimeout < 0 {
+		return errors.New("keepalive_interval: must not be negative")
+	}
+	if c.KeepaliveTimeout > 0 && c.KeepaliveTimeout < c.KeepaliveInterval {
+		return errors.New("keepalive_timeout: must not be shorter than keepalive_interval")
+	}
+	if c.ResumeTimeout < 0 {
+		return errors.New("resume_timeout: must not be negative")
+	}
+	if c.MaxOutput < 0 {
+		return errors.New("max_output: must not be negative")
+	}
+	switch c.OnOutputLimit {
+	case "", OutputLimitTruncate, OutputLimitKill:
+	default:
+		return fmt.Errorf("on_output_limit: unknown action %q, expected truncate or kill", c.OnOutputLimit)
+	}
+	if c.RateLimit < 0 {
+		return errors.New("rate_limit: must not be negative")
+	}
+	if c.RateBurst < 0 {
+		return errors.New("rate_burst: must not be negative")
+	}
+	switch c.Polkit {
+	case "", PolkitCheck, PolkitPrompt:
+	default:
+		return fmt.Errorf("polkit: unknown mode %q, expected check or prompt", c.Polkit)
+	}
+	if c.Polkit != "" && runtime.GOOS != "linux" {
+		return errors.New("polkit: only available on Linux")
+	}
+	switch c.LogBackend {
+	case LogBackendStderr, LogBackendJournald, LogBackendSyslog:
+	default:
+		return fmt.Errorf("log_backend: unknown backend %q, expected stderr, journald or syslog", c.LogBackend)
+	}
+	if c.TokenFile != "" {
+		if _, err := loadTokens(c.TokenFile); err != nil {
+			return fmt.Errorf("token_file: %w", err)
+		}
+	}
+	for i, pattern := range c.AllowedEnv {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("allowed_env[%d]: invalid pattern %q", i, pattern)
+		}
+	}
+	for command, patterns := range c.AllowedArgs {
+		if !validCommandPattern(command) {
+			return fmt.Errorf("allowed_args.%s: invalid command pattern", command)
+		}
+		for i, pattern := range patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("allowed_args.%s[%d]: %w", command, i, err)
+			}
+		}
+	}
+	users := make(map[int]string)
+	for name, policy := range c.UserPolicies {
+		uid, err := LookupUID(name)
+		if err != nil {
+			return fmt.Errorf("user_policies.%s: %w", name, err)
+		}
+		if other, ok := users[uid]; ok {
+			return fmt.Errorf("user_policies.%s: same user as %s", name, other)
+		}
+		users[uid] = name
+		for i, cmd := range policy.AllowedCmds {
+			if !validCommandPattern(cmd) {
+				return fmt.Errorf("user_policies.%s.allowed_cmds[%d]: invalid pattern %q", name, i, cmd)
+			}
+		}
+	}
+	for addr, policy := range c.ListenPolicies {
+		if !slices.Contains(c.ListenAddresses(), addr) {
+			return fmt.Errorf("listen_policies.%s: not an address the server listens on", addr)
+		}
+		for i, cmd := range policy.AllowedCmds {
+			if !validCommandPattern(cmd) {
+				return fmt.Errorf("listen_policies.%s.allowed_cmds[%d]: invalid pattern %q", addr, i, cmd)
+			}
+		}
+	}
+	for name, policy := range c.GroupPolicies {
+		if _, err := LookupGID(name); err != nil {
+			return fmt.Errorf("group_policies.%s: %w", name, err)
+		}
+		for i, cmd := range policy.AllowedCmds {
+			if !validCommandPattern(cmd) {
+				return fmt.Errorf("group_policies.%s.allowed_cmds[%d]: invalid pattern %q", name, i, cmd)
+			}
+		}
+	}
+	if c.RegoPolicy != "" {
+		if _, err := os.Stat(c.RegoPolicy); err != nil {
+			return fmt.Errorf("rego_policy: %w", err)
+		}
+		if !filepath.IsAbs(c.OPA) {
+			return fmt.Errorf("opa: rego_policy needs the absolute path of the opa binary evaluating it, got %q", c.OPA)
+		}
+		if _, err := os.Stat(c.OPA); err != nil {
+			return fmt.Errorf("opa: %w", err)
+		}
+	}
+	for clientPath, hostPath := range c.PathMap {
+		if !filepath.IsAbs(clientPath) {
+			return fmt.Errorf("path_map.%s: client path must be absolute", clientPath)
+		}
+		if !filepath.IsAbs(hostPath) {
+			return fmt.Errorf("path_map.%s: host path %q must be absolute", clientPath, hostPath)
+		}
+	}
+	for name, target := range c.Aliases {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("aliases: alias name must not be empty")
+		}
+		if len(target) == 0 || target[0] == "" {
+			return fmt.Errorf("aliases.%s: alias must expand to a command", name)
+		}
+	}
+	return nil
+}
+
+// errNotAllowed is returned for the commands missing from the allowlist,
+// along with the command that would be executed so it can still be
+// authorized another way.
+var errNotAllowed = errors.New("not allowed")
+
+// ResolveCommand expands aliases and checks the result against the deny
+// and allow lists, returning the command that should be executed.
+func (c *Config) ResolveCommand(command []string) ([]string, error) {
+	if target, ok := c.Aliases[command[0]]; ok {
+		expanded := make([]string, 0, len(target)+len(command)-1)
+		expanded = append(expanded, target...)
+		command = append(expanded, command[1:]...)
+	}
+
+	if c.Denylisted(command[0]) {
+		return nil, fmt.Errorf("command %s is denied", command[0])
+	}
+
+	if !c.argsAllowed(command) {
+		return nil, fmt.Errorf("these arguments of command %s are not allowed", command[0])
+	}
+
+	if len(c.AllowedCmds) > 0 && !c.Allowlisted(command[0]) {
+		return command, fmt.Errorf("command %s is %w", command[0], errNotAllowed)
+	}
+
+	return command, nil
+}
+
+// argsAllowed checks the arguments of a command against the allowed_args
+// policies of the patterns it matches. The arguments are joined with
+// spaces and must match one of the regular expressions as a whole, as in
+// "status .*" or "restart foo\.service".
+func (c *Config) argsAllowed(command []string) bool {
+	resolved := resolveBinary(command[0])
+	args := strings.Join(command[1:], " ")
+	restricted := false
+	for pattern, allowedArgs := range c.AllowedArgs {
+		if !matchCommand(pattern, command[0], resolved) {
+			continue
+		}
+		restricted = true
+		for _, allowed := range allowedArgs {
+			if re, err := regexp.Compile("^(?:" + allowed + ")$"); err == nil && re.MatchString(args) {
+				return true
+			}
+		}
+	}
+	return !restricted
+}
+
+// Allowlist returns the allow and deny lists, with the aliases, for the
+// clients asking what they may run.
+func (c *Config) Allowlist() *protocol.Allowlist {
+	return &protocol.Allowlist{
+		Allowed: c.AllowedCmds,
+		Denied:  c.DeniedCmds,
+		Aliases: c.Aliases,
+	}
+}
+
+// Enabled lists the optional checks and services configured, as in token
+// or polkit.
+func (c *Config) Enabled() []string {
+	var enabled []string
+	for _, option := range []struct {
+		name string
+		on   bool
+	}{
+		{"token", c.TokenFile != ""},
+		{"tls", c.TLSCert != ""},
+		{"ssh", c.SSHHostKey != ""},
+		{"polkit", c.Polkit != ""},
+		{"rego", c.RegoPolicy != ""},
+		{"auth-hook", c.AuthHook != ""},
+		{"allowed-args", len(c.AllowedArgs) > 0},
+		{"path-map", len(c.PathMap) > 0},
+		{"record", c.RecordDir != ""},
+		{"audit", c.AuditLog != ""},
+		{"metrics", c.MetricsAddr != ""},
+		{"tracing", c.OTLPEndpoint != ""},
+	} {
+		if option.on {
+			enabled = append(enabled, option.name)
+		}
+	}
+	return enabled
+}
+
+// Limits returns the limits of the configuration.
+func (c *Config) Limits() protocol.Limits {
+	return protocol.Limits{
+		RateLimit:                c.RateLimit,
+		RateBurst:                c.RateBurst,
+		MaxSessions:              c.MaxSessions,
+		MaxUserSessions:          c.MaxUserSessions,
+		IdleTimeoutSeconds:       c.IdleTimeout.Seconds(),
+		MaxDurationSeconds:       c.MaxDuration.Seconds(),
+		MaxOutput:                int64(c.MaxOutput),
+		OnOutputLimit:            c.OnOutputLimit,
+		KeepaliveIntervalSeconds: c.KeepaliveInterval.Seconds(),
+		KeepaliveTimeoutSeconds:  c.KeepaliveTimeout.Seconds(),
+		ResumeTimeoutSeconds:     c.ResumeTimeout.Seconds(),
+	}
+}
+
+// Allowlisted reports whether a command matches one of the allowlist
+// patterns.
+func (c *Config) Allowlisted(name string) bool {
+	resolved := resolveBinary(name)
+	for _, pattern := range c.AllowedCmds {
+		if matchCommand(pattern, name, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// Denylisted reports whether a command matches one of the deny patterns.
+// Unlike the allowlist ones, names also match the binary of commands sent
+// with a path, so denying rm also denies /bin/rm.
+func (c *Config) Denylisted(name string) bool {
+	resolved := resolveBinary(name)
+	for _, pattern := range c.DeniedCmds {
+		if matchCommand(pattern, name, resolved) || matchCommand(pattern, filepath.Base(name), resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCommand reports whether a command matches a pattern: a regular
+// expression on the absolute path of its binary when starting with ^, a
+// glob on that path when holding a slash, as in /usr/bin/*, and otherwise
+// a glob on the name sent by the client, as in podman*. Names only match
+// commands sent without a path, which the server finds in its own PATH.
+func matchCommand(pattern, name, resolved string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "^"):
+		re, err := regexp.Compile(pattern)
+		return err == nil && resolved != "" && re.MatchString(resolved)
+	case strings.Contains(pattern, "/"):
+		matched, _ := path.Match(pattern, resolved)
+		return resolved != "" && matched
+	default:
+		matched, _ := path.Match(pattern, name)
+		return !strings.Contains(name, "/") && matched
+	}
+}
+
+// resolveBinary returns the absolute path of the binary the command would
+// run, or an empty string if there is none.
+func resolveBinary(name string) string {
+	binary, err := exec.LookPath(name)
+	if err != nil {
+		return ""
+	}
+	binary, err = filepath.Abs(binary)
+	if err != nil {
+		return ""
+	}
+	return binary
+}
+
+// validCommandPattern reports whether an allowlist pattern can be used.
+func validCommandPattern(pattern string) bool {
+	if strings.HasPrefix(pattern, "^") {
+		_, err := regexp.Compile(pattern)
+		return err == nil
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// unsafeEnv lists the variables that would let a client run its own code
+// past allowed_cmds: the ones changing how the dynamic loader and the C
+// library of the host command load code, which glibc ignores for setuid
+// programs, and the startup files and options of shells and interpreters.
+var unsafeEnv = []string{
+	"LD_*", "DYLD_*", "GCONV_PATH", "GETCONF_DIR", "GLIBC_TUNABLES",
+	"HOSTALIASES", "LOCALDOMAIN", "LOCPATH", "MALLOC_*", "NIS_PATH",
+	"NLSPATH", "RESOLV_HOST_CONF", "RES_OPTIONS", "TZDIR",
+	"BASH_ENV", "ENV", "BASH_FUNC_*", "SHELLOPTS", "BASHOPTS", "PS4",
+	"PROMPT_COMMAND", "PYTHONSTARTUP", "PYTHONPATH", "PYTHONHOME",
+	"PERL5OPT", "PERL5LIB", "PERLLIB", "RUBYOPT", "RUBYLIB",
+	"NODE_OPTIONS", "JAVA_TOOL_OPTIONS", "_JAVA_OPTIONS",
+}
+
+// FilterEnv returns the NAME=value variables the client is allowed to set,
+// dropping the others. Any variable is allowed when the allowlist is empty,
+// but the ones of unsafeEnv, which are always dropped.
+func (c *Config) FilterEnv(env []string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, variable := range env {
+		name, _, ok := strings.Cut(variable, "=")
+		if !ok || name == "" {
+			slog.Warn("Ignoring malformed environment variable", "variable", variable)
+			continue
+		}
+		if !c.envAllowed(name) {
+			slog.Warn("Environment variable is not allowed", "name", name)
+			continue
+		}
+		filtered = append(filtered, variable)
+	}
+	return filtered
+}
+
+func (c *Config) envAllowed(name string) bool {
+	for _, pattern := range unsafeEnv {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(c.AllowedEnv) == 0 {
+		return true
+	}
+	for _, pattern := range c.AllowedEnv {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// onDisconnectAllowed reports whether clients may pick the policy. Any
+// policy is allowed when the allowlist is empty.
+func (c *Config) onDisconnectAllowed(policy string) bool {
+	if len(c.AllowedOnDisconnect) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedOnDisconnect {
+		if allowed == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList is a list of strings, which a single string stands for in
+// the config file.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	return value.Decode((*[]string)(l))
+}
+
+func (l *stringList) UnmarshalTOML(data any) error {
+	switch data := data.(type) {
+	case string:
+		*l = stringList{data}
+		return nil
+	case []any:
+		list := make(stringList, 0, len(data))
+		for _, item := range data {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %T", item)
+			}
+			list = append(list, s)
+		}
+		*l = list
+		return nil
+	}
+	return fmt.Errorf("expected a string or a list of strings, got %T", data)
+}
+
+// ByteSize is an amount of bytes, written as a number optionally followed
+// by a binary unit: K, M, G or T, as in 100M.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	shift := 0
+	if len(s) > 0 {
+		if unit := strings.IndexByte("KMGT", s[len(s)-1]); unit >= 0 {
+			shift = 10 * (unit + 1)
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n > math.MaxInt64>>shift {
+		return fmt.Errorf("invalid size %q, expected a number of bytes optionally followed by K, M, G or T", text)
+	}
+	*b = ByteSize(n << shift)
+	return nil
+}
+
+func (b *ByteSize) Set(s string) error {
+	return b.UnmarshalText([]byte(s))
+}
+
+func (b ByteSize) String() string {
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// LookupUID resolves a user given by name or UID.
+func LookupUID(name string) (int, error) {
+	return lookupID(name, user.Lookup, func(u *user.User) string { return u.Uid })
+}
+
+// LookupGID resolves a group given by name or GID.
+func LookupGID(name string) (int, error) {
+	return lookupID(name, user.LookupGroup, func(g *user.Group) string { return g.Gid })
+}
+
+// lookupID resolves a user or group given by name or numeric ID.
+func lookupID[T any](name string, lookup func(string) (T, error), id func(T) string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, nil
+	}
+	entry, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id(entry))
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file named name in a temporary directory
+// and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		check   func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "yaml",
+			file: "server.yaml",
+			content: `socket: /tmp/hrun-test.sock
+allowed_cmds: [podman, xdg-open]
+denied_cmds: [rm]
+aliases:
+  open: [xdg-open]
+max_sessions: 4
+idle_timeout: 10m
+max_output: 1MiB
+`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Socket != "/tmp/hrun-test.sock" {
+					t.Errorf("Socket = %q", cfg.Socket)
+				}
+				if !slices.Equal(cfg.AllowedCmds, []string{"podman", "xdg-open"}) {
+					t.Errorf("AllowedCmds = %v", cfg.AllowedCmds)
+				}
+				if !slices.Equal(cfg.DeniedCmds, []string{"rm"}) {
+					t.Errorf("DeniedCmds = %v", cfg.DeniedCmds)
+				}
+				if !slices.Equal(cfg.Aliases["open"], []string{"xdg-open"}) {
+					t.Errorf("Aliases = %v", cfg.Aliases)
+				}
+				if cfg.MaxSessions != 4 {
+					t.Errorf("MaxSessions = %d", cfg.MaxSessions)
+				}
+				if cfg.IdleTimeout != 10*time.Minute {
+					t.Errorf("IdleTimeout = %s", cfg.IdleTimeout)
+				}
+				if cfg.MaxOutput != 1<<20 {
+					t.Errorf("MaxOutput = %d", cfg.MaxOutput)
+				}
+			},
+		},
+		{
+			name:    "json",
+			file:    "server.json",
+			content: `{"allowed_cmds": ["ls"], "rate_limit": 2.5, "rate_burst": 5}`,
+			check: func(t *testing.T, cfg *Config) {
+				if !slices.Equal(cfg.AllowedCmds, []string{"ls"}) {
+					t.Errorf("AllowedCmds = %v", cfg.AllowedCmds)
+				}
+				if cfg.RateLimit != 2.5 || cfg.RateBurst != 5 {
+					t.Errorf("RateLimit, RateBurst = %v, %d", cfg.RateLimit, cfg.RateBurst)
+				}
+			},
+		},
+		{
+			name: "toml",
+			file: "server.toml",
+			content: `allowed_cmds = ["podman"]
+max_user_sessions = 2
+
+[path_map]
+"/home/user/project" = "/srv/project"
+`,
+			check: func(t *testing.T, cfg *Config) {
+				if !slices.Equal(cfg.AllowedCmds, []string{"podman"}) {
+					t.Errorf("AllowedCmds = %v", cfg.AllowedCmds)
+				}
+				if cfg.MaxUserSessions != 2 {
+					t.Errorf("MaxUserSessions = %d", cfg.MaxUserSessions)
+				}
+				if cfg.PathMap["/home/user/project"] != "/srv/project" {
+					t.Errorf("PathMap = %v", cfg.PathMap)
+				}
+			},
+		},
+		{
+			name:    "defaults",
+			file:    "server.yaml",
+			content: "allowed_cmds: [ls]\n",
+			check: func(t *testing.T, cfg *Config) {
+				defaults := DefaultConfig()
+				if cfg.Socket != defaults.Socket {
+					t.Errorf("Socket = %q, want the default %q", cfg.Socket, defaults.Socket)
+				}
+				if cfg.OnDisconnect != defaults.OnDisconnect {
+					t.Errorf("OnDisconnect = %q, want the default %q", cfg.OnDisconnect, defaults.OnDisconnect)
+				}
+				if !cfg.ForwardLocale {
+					t.Error("ForwardLocale is off by default")
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, test.file, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		// want is a part of the error, naming the offending key
+		want string
+	}{
+		{"unknown yaml key", "server.yaml", "allowed_cmd: [ls]\n", "allowed_cmd"},
+		{"unknown toml key", "server.toml", "allowed_cmd = [\"ls\"]\n", "allowed_cmd"},
+		{"bad duration", "server.yaml", "idle_timeout: soon\n", "soon"},
+		{"bad policy", "server.yaml", "on_disconnect: explode\n", "on_disconnect"},
+		{"bad pattern", "server.yaml", "allowed_cmds: [\"^(\"]\n", "allowed_cmds[0]"},
+		{"rego without opa", "server.yaml", "rego_policy: " + os.DevNull + "\n", "opa: rego_policy needs"},
+		{"relative opa", "server.yaml", "rego_policy: " + os.DevNull + "\nopa: opa\n", "opa: rego_policy needs"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, test.file, test.content))
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %q doesn't mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadOverrides(t *testing.T) {
+	path := writeConfig(t, "server.yaml", `allowed_cmds: [podman]
+max_sessions: 4
+idle_timeout: 10m
+`)
+	tests := []struct {
+		name      string
+		overrides func(cfg *Config)
+		check     func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "file only",
+			check: func(t *testing.T, cfg *Config) {
+				if !slices.Equal(cfg.AllowedCmds, []string{"podman"}) {
+					t.Errorf("AllowedCmds = %v", cfg.AllowedCmds)
+				}
+				if cfg.MaxSessions != 4 {
+					t.Errorf("MaxSessions = %d", cfg.MaxSessions)
+				}
+			},
+		},
+		{
+			name: "flags over file",
+			overrides: func(cfg *Config) {
+				cfg.AllowedCmds = []string{"ls"}
+				cfg.MaxSessions = 8
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if !slices.Equal(cfg.AllowedCmds, []string{"ls"}) {
+					t.Errorf("AllowedCmds = %v, want the flag", cfg.AllowedCmds)
+				}
+				if cfg.MaxSessions != 8 {
+					t.Errorf("MaxSessions = %d, want the flag", cfg.MaxSessions)
+				}
+				// Settings without a flag keep the value of the file
+				if cfg.IdleTimeout != 10*time.Minute {
+					t.Errorf("IdleTimeout = %s, want the file value", cfg.IdleTimeout)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{ConfigPath: path, Overrides: test.overrides}
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, s.Config())
+		})
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowedEnv []string
+		env        []string
+		want       []string
+	}{
+		{"no allowlist", nil, []string{"EDITOR=vim", "FOO=bar"}, []string{"EDITOR=vim", "FOO=bar"}},
+		{"allowlist", []string{"EDITOR", "LC_*"}, []string{"EDITOR=vim", "LC_ALL=C", "FOO=bar"}, []string{"EDITOR=vim", "LC_ALL=C"}},
+		{"malformed", nil, []string{"EDITOR", "=vim"}, []string{}},
+		{"loader", nil, []string{"LD_PRELOAD=/tmp/x.so", "LD_LIBRARY_PATH=/tmp", "DYLD_INSERT_LIBRARIES=/tmp/x", "GCONV_PATH=/tmp", "EDITOR=vim"}, []string{"EDITOR=vim"}},
+		{"loader allowed", []string{"*"}, []string{"LD_PRELOAD=/tmp/x.so", "EDITOR=vim"}, []string{"EDITOR=vim"}},
+		{"shell startup", nil, []string{"BASH_ENV=/tmp/x.sh", "ENV=/tmp/x.sh", "BASH_FUNC_ls%%=() { id; }", "EDITOR=vim"}, []string{"EDITOR=vim"}},
+		{"shell startup allowed", []string{"*"}, []string{"BASH_ENV=/tmp/x.sh", "PYTHONPATH=/tmp", "ENVIRONMENT=dev"}, []string{"ENVIRONMENT=dev"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AllowedEnv = test.allowedEnv
+			if got := cfg.FilterEnv(test.env); !slices.Equal(got, test.want) {
+				t.Errorf("FilterEnv(%q) = %q, want %q", test.env, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// confirmTimeout is how long a prompt waits for an answer before the
+// command is denied.
+const confirmTimeout = time.Minute
+
+// Approver asks a user to approve the commands outside of the allowlist,
+// returning an error when it is denied.
+type Approver interface {
+	Approve(p Peer, command []string) error
+}
+
+// ApprovedCmds are the commands always allowed by the user, remembered in
+// a file so they keep running without asking after a restart.
+type ApprovedCmds struct {
+	path string
+
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// LoadApprovedCmds reads the commands always allowed from path, one per
+// line.
+func LoadApprovedCmds(path string) (*ApprovedCmds, error) {
+	a := &ApprovedCmds{path: path, names: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			a.names[line] = true
+		}
+	}
+	return a, nil
+}
+
+// ApprovedCmdsPath is where the commands always allowed are remembered.
+func ApprovedCmdsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "hrun", "approved_cmds"), nil
+}
+
+func (a *ApprovedCmds) contains(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.names[name]
+}
+
+// add always allows a command from now on, appending it to the file.
+func (a *ApprovedCmds) add(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.names[name] {
+		return nil
+	}
+	a.names[name] = true
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, name); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Confirmer asks the user running the server in a terminal.
+type Confirmer struct {
+	out      io.Writer
+	lines    chan string
+	approved *ApprovedCmds
+
+	// mu serializes the prompts
+	mu sync.Mutex
+}
+
+// NewConfirmer reads the answers from in and writes the prompts to out.
+func NewConfirmer(in io.Reader, out io.Writer, approved *ApprovedCmds) *Confirmer {
+	c := &Confirmer{out: out, lines: make(chan string), approved: approved}
+	go func() {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+	return c
+}
+
+func (c *Confirmer) Approve(p Peer, command []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.approved.contains(command[0]) {
+		return nil
+	}
+
+	// Drop what was typed while nothing was asked
+	for drained := false; !drained; {
+		select {
+		case <-c.lines:
+		default:
+			drained = true
+		}
+	}
+
+	// The command is quoted so escape sequences sent by the client can't
+	// mess with the terminal
+	fmt.Fprintf(c.out, "\nhrun: user %d (pid %d) wants to run %s\nAllow? [y]es, [n]o, [a]lways: ",
+		p.UID, p.PID, strconv.Quote(strings.Join(command, " ")))
+	denied := fmt.Errorf("command %s was not approved", command[0])
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			return denied
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return nil
+		case "a", "always":
+			if err := c.approved.add(command[0]); err != nil {
+				fmt.Fprintf(c.out, "hrun: error remembering %s: %v\n", command[0], err)
+			}
+			return nil
+		}
+		return denied
+	case <-timer.C:
+		fmt.Fprintln(c.out, "\nhrun: no answer, denied")
+		return denied
+	}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+const (
+	dbusName      = "org.hrun.Server"
+	dbusPath      = dbus.ObjectPath("/org/hrun/Server")
+	dbusInterface = "org.hrun.Server"
+)
+
+// dbusIntrospection describes the object of the server, for busctl and
+// the other tools introspecting it.
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.hrun.Server">
+    <!-- The sessions of the server, oldest first: id, name, command, pid,
+         uid of the client, start time in Unix seconds, state, whether it
+         exited and its exit code. -->
+    <method name="ListSessions">
+      <arg name="sessions" type="a(ssasiixsbi)" direction="out"/>
+    </method>
+    <!-- Run a command on the host, without a terminal, with stdin as its
+         whole input. Env adds variables as KEY=VALUE, a positive timeout
+         terminates it after that many seconds, token answers the challenge
+         of servers with a token file. Refusals are org.hrun.Error errors
+         named after the ones of the hrun protocol, as in
+         org.hrun.Error.RateLimited. -->
+    <method name="Exec">
+      <arg name="command" type="as" direction="in"/>
+      <arg name="env" type="as" direction="in"/>
+      <arg name="cwd" type="s" direction="in"/>
+      <arg name="stdin" type="ay" direction="in"/>
+      <arg name="timeout" type="d" direction="in"/>
+      <arg name="token" type="s" direction="in"/>
+      <arg name="exit_code" type="i" direction="out"/>
+      <arg name="stdout" type="ay" direction="out"/>
+      <arg name="stderr" type="ay" direction="out"/>
+    </method>
+    <signal name="SessionStarted">
+      <arg name="id" type="s"/>
+      <arg name="name" type="s"/>
+      <arg name="uid" type="i"/>
+      <arg name="command" type="as"/>
+    </signal>
+    <signal name="SessionEnded">
+      <arg name="id" type="s"/>
+      <arg name="exit_code" type="i"/>
+    </signal>
+  </interface>` + introspect.IntrospectDataString + `</node>`
+
+// dbusSession is a session as listed by ListSessions.
+type dbusSession struct {
+	ID        string
+	Name      string
+	Command   []string
+	PID       int32
+	UID       int32
+	StartedAt int64
+	State     string
+	Exited    bool
+	ExitCode  int32
+}
+
+// dbusAddr is the bus of a dbusListener, or the unique name of a client.
+type dbusAddr string
+
+func (dbusAddr) Network() string  { return "dbus" }
+func (a dbusAddr) String() string { return string(a) }
+
+// dbusListener owns org.hrun.Server on the session or system bus, and
+// accepts each call of Exec as an hrun connection, served as any other.
+type dbusListener struct {
+	server *Server
+	conn   *dbus.Conn
+	bus    string
+	conns  chan net.Conn
+	done   chan struct{}
+	close  func() error
+}
+
+// listenDBus serves org.hrun.Server on bus, session or system. The
+// signals of the sessions of s are emitted there until it's closed.
+func (s *Server) listenDBus(bus string) (net.Listener, error) {
+	connect := dbus.ConnectSessionBus
+	if bus == "system" {
+		connect = dbus.ConnectSystemBus
+	}
+	conn, err := connect()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the %s bus: %w", bus, err)
+	}
+	l := &dbusListener{
+		server: s,
+		conn:   conn,
+		bus:    bus,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	l.close = sync.OnceValue(func() error {
+		close(l.done)
+		s.mu.Lock()
+		if s.bus == l {
+			s.bus = nil
+		}
+		s.mu.Unlock()
+		return l.conn.Close()
+	})
+
+	if err := conn.Export(&dbusService{l}, dbusPath, dbusInterface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Export(introspect.Introspectable(dbusIntrospection), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("requesting %s on the %s bus: %w", dbusName, bus, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("%s is already owned on the %s bus", dbusName, bus)
+	}
+
+	s.mu.Lock()
+	s.bus = l
+	s.mu.Unlock()
+	go func() {
+		select {
+		case <-conn.Context().Done():
+			slog.Error("Connection to the bus lost", "bus", bus)
+			l.close()
+		case <-l.done:
+		}
+	}()
+	return l, nil
+}
+
+func (l *dbusListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *dbusListener) Close() error   { return l.close() }
+func (l *dbusListener) Addr() net.Addr { return dbusAddr(l.bus) }
+
+// emit emits a signal of org.hrun.Server, on nil listeners too.
+func (l *dbusListener) emit(name string, values ...any) {
+	if l == nil {
+		return
+	}
+	if err := l.conn.Emit(dbusPath, dbusInterface+"."+name, values...); err != nil {
+		slog.Warn("Error emitting D-Bus signal", "signal", name, "err", err)
+	}
+}
+
+// peer identifies the client named sender with the bus, which knows its
+// credentials.
+func (l *dbusListener) peer(sender dbus.Sender) (Peer, error) {
+	bus := l.conn.BusObject()
+	var uid uint32
+	if err := bus.Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender)).Store(&uid); err != nil {
+		return unknownPeer, err
+	}
+	peer := Peer{UID: int(uid), GID: -1, PID: -1, serverUser: int(uid) == os.Getuid()}
+	var pid uint32
+	if err := bus.Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, string(sender)).Store(&pid); err == nil {
+		peer.PID = int(pid)
+	}
+	if u, err := user.LookupId(strconv.Itoa(peer.UID)); err == nil {
+		if gid, err := strconv.Atoi(u.Gid); err == nil {
+			peer.GID = gid
+		}
+	}
+	return peer, nil
+}
+
+// busStarted and busEnded emit the signals of the start and the end of a
+// session, when the server is on a bus.
+func (s *Server) busStarted(session *Session) {
+	status := session.status()
+	s.busListener().emit("SessionStarted", status.ID, status.Name, int32(status.UID), status.Command)
+}
+
+func (s *Server) busEnded(session *Session) {
+	status := session.status()
+	s.busListener().emit("SessionEnded", status.ID, int32(status.ExitCode))
+}
+
+func (s *Server) busListener() *dbusListener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bus
+}
+
+// dbusService is the object exported at /org/hrun/Server, whose methods
+// are the ones of org.hrun.Server.
+type dbusService struct {
+	l *dbusListener
+}
+
+func (d *dbusService) ListSessions() ([]dbusSession, *dbus.Error) {
+	list := d.l.server.listSessions()
+	sessions := make([]dbusSession, 0, len(list))
+	for _, status := range list {
+		sessions = append(sessions, dbusSession{
+			ID:        status.ID,
+			Name:      status.Name,
+			Command:   status.Command,
+			PID:       int32(status.PID),
+			UID:       int32(status.UID),
+			StartedAt: status.StartedAt.Unix(),
+			State:     status.State,
+			Exited:    status.Exited,
+			ExitCode:  int32(status.ExitCode),
+		})
+	}
+	return sessions, nil
+}
+
+// Exec bridges a call of Exec to an hrun connection, acting as the client
+// of the server, as the user calling it.
+func (d *dbusService) Exec(sender dbus.Sender, command, env []string, cwd string, stdin []byte, timeout float64, token string) (int32, []byte, []byte, *dbus.Error) {
+	if len(command) == 0 {
+		return 0, nil, nil, dbusError(protocol.ErrorInvalid, "no command given")
+	}
+	peer, err := d.l.peer(sender)
+	if err != nil {
+		slog.Warn("Error reading D-Bus client credentials", "sender", sender, "err", err)
+		return 0, nil, nil, dbusError(protocol.ErrorDenied, "the caller can't be identified")
+	}
+
+	conn, err := openBridge(d.l.conns, d.l.done, dbusAddr(sender), peer)
+	if err != nil {
+		return 0, nil, nil, dbusError(protocol.ErrorUnavailable, err.Error())
+	}
+	defer conn.Close()
+	cmd := protocol.Command{
+		Command: command,
+		Env:     env,
+		Cwd:     cwd,
+		Timeout: timeout,
+	}
+	var stdout, stderr []byte
+	code, err := runBatch(conn, token, &cmd, stdin, func(out, errOut []byte) error {
+		stdout = append(stdout, out...)
+		stderr = append(stderr, errOut...)
+		return nil
+	})
+	var errMsg *protocol.ErrorMessage
+	switch {
+	case errors.As(err, &errMsg):
+		return 0, nil, nil, dbusError(errMsg.Code, errMsg.Message)
+	case err != nil:
+		return 0, nil, nil, dbusError(protocol.ErrorUnavailable, err.Error())
+	}
+	return int32(code), stdout, stderr, nil
+}
+
+// dbusError returns the D-Bus error for an error of the hrun protocol, as
+// in org.hrun.Error.RateLimited for rate-limited.
+func dbusError(code, message string) *dbus.Error {
+	var name strings.Builder
+	for _, part := range strings.Split(code, "-") {
+		if part != "" {
+			name.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return dbus.NewError("org.hrun.Error."+name.String(), []any{message})
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirkobrombin/hrun/pkg/hrunpb"
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// grpcFeatures are the features the gRPC frontend asks the server for.
+var grpcFeatures = []string{
+	protocol.FeatureResize,
+	protocol.FeatureExitCode,
+	protocol.FeatureSplitStderr,
+	protocol.FeatureNoPTY,
+	protocol.FeatureEnv,
+	protocol.FeatureCwd,
+	protocol.FeatureSignals,
+	protocol.FeatureAuth,
+	protocol.FeatureCloseReason,
+	protocol.FeatureTimeout,
+	protocol.FeatureOutputLimit,
+}
+
+// grpcConn is the server end of an Exec call, bridged to the hrun
+// protocol.
+type grpcConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *grpcConn) RemoteAddr() net.Addr { return c.remote }
+
+// Read reports the pipe closed here as net.ErrClosed, as other
+// connections do.
+func (c *grpcConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+// grpcListener serves the Hrun service of hrun.proto over a TCP address,
+// and accepts each Exec call as an hrun connection, served as any other.
+type grpcListener struct {
+	hrunpb.UnimplementedHrunServer
+
+	listener net.Listener
+	server   *grpc.Server
+	conns    chan net.Conn
+	done     chan struct{}
+	close    func() error
+}
+
+// listenGRPC listens for gRPC calls on a TCP address.
+func listenGRPC(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &grpcListener{
+		listener: listener,
+		server:   grpc.NewServer(),
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	l.close = sync.OnceValue(func() error {
+		close(l.done)
+		l.server.Stop()
+		return nil
+	})
+	hrunpb.RegisterHrunServer(l.server, l)
+	// Let tools like grpcurl discover the service
+	reflection.Register(l.server)
+	go func() {
+		if err := l.server.Serve(listener); err != nil {
+			slog.Error("Error serving gRPC", "err", err)
+			l.close()
+		}
+	}()
+	return l, nil
+}
+
+func (l *grpcListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *grpcListener) Close() error   { return l.close() }
+func (l *grpcListener) Addr() net.Addr { return l.listener.Addr() }
+
+// Exec bridges an Exec call to an hrun connection, acting as the client of
+// the server.
+func (l *grpcListener) Exec(stream hrunpb.Hrun_ExecServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := req.GetStart()
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be a start")
+	}
+	if len(start.Command) == 0 {
+		return status.Error(codes.InvalidArgument, "no command given")
+	}
+	cmd := protocol.Command{
+		Command:     start.Command,
+		Env:         start.Env,
+		Cwd:         start.Cwd,
+		NoPTY:       !start.Tty,
+		SplitStderr: !start.Tty,
+		Width:       uint16(start.Size.GetWidth()),
+		Height:      uint16(start.Size.GetHeight()),
+		Timeout:     start.Timeout,
+	}
+
+	// Hand the server end of a pipe to the server, and speak the hrun
+	// protocol on the other one
+	var remote net.Addr = &net.TCPAddr{}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remote = p.Addr
+	}
+	serverEnd, conn := net.Pipe()
+	defer conn.Close()
+	select {
+	case l.conns <- &grpcConn{Conn: serverEnd, remote: remote}:
+	case <-l.done:
+		serverEnd.Close()
+		return status.Error(codes.Unavailable, "the server is shutting down")
+	case <-stream.Context().Done():
+		serverEnd.Close()
+		return stream.Context().Err()
+	}
+	// The pipe is closed along with the call
+	go func() {
+		<-stream.Context().Done()
+		conn.Close()
+	}()
+
+	frames, err := startBridge(conn, grpcFeatures, start.Token, &cmd)
+	if errors.Is(err, errBridgeToken) {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	go forwardGRPCInput(stream, frames)
+	return forwardGRPCOutput(stream, conn)
+}
+
+// forwardGRPCInput forwards the input, resizes and signals of the client.
+func forwardGRPCInput(stream hrunpb.Hrun_ExecServer, frames *protocol.FrameWriter) {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				frames.WriteFrame(protocol.FrameEOF, nil)
+			}
+			return
+		}
+		switch msg := req.Msg.(type) {
+		case *hrunpb.ExecRequest_Stdin:
+			frames.WriteFrame(protocol.FrameData, msg.Stdin)
+		case *hrunpb.ExecRequest_CloseStdin:
+			frames.WriteFrame(protocol.FrameEOF, nil)
+		case *hrunpb.ExecRequest_Resize:
+			frames.WriteResize(uint16(msg.Resize.GetWidth()), uint16(msg.Resize.GetHeight()))
+		case *hrunpb.ExecRequest_Signal:
+			frames.WriteFrame(protocol.FrameSignal, []byte(msg.Signal))
+		}
+	}
+}
+
+// forwardGRPCOutput streams the output of the command to the client,
+// ending with its exit code.
+func forwardGRPCOutput(stream hrunpb.Hrun_ExecServer, conn net.Conn) error {
+	for {
+		frameType, payload, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return status.Error(codes.Unavailable, "connection to the server lost")
+		}
+		switch frameType {
+		case protocol.FrameData:
+			err = stream.Send(&hrunpb.ExecResponse{Msg: &hrunpb.ExecResponse_Stdout{Stdout: payload}})
+		case protocol.FrameStderr:
+			err = stream.Send(&hrunpb.ExecResponse{Msg: &hrunpb.ExecResponse_Stderr{Stderr: payload}})
+		case protocol.FrameError:
+			var errMsg protocol.ErrorMessage
+			json.Unmarshal(payload, &errMsg)
+			return status.Error(grpcCode(errMsg.Code), errMsg.Message)
+		case protocol.FrameClose:
+			err = stream.Send(&hrunpb.ExecResponse{Msg: &hrunpb.ExecResponse_Stderr{Stderr: []byte("hrun: " + string(payload) + "\r\n")}})
+		case protocol.FrameTruncated:
+			var truncated protocol.Truncated
+			json.Unmarshal(payload, &truncated)
+			message := "hrun: output truncated after " + protocol.FormatBytes(truncated.Limit) + "\r\n"
+			err = stream.Send(&hrunpb.ExecResponse{Msg: &hrunpb.ExecResponse_Stderr{Stderr: []byte(message)}})
+		case protocol.FrameExit:
+			code, err := protocol.DecodeExit(payload)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			return stream.Send(&hrunpb.ExecResponse{Msg: &hrunpb.ExecResponse_ExitCode{ExitCode: int32(code)}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// grpcCode returns the gRPC status code for an error code of the hrun
+// protocol.
+func grpcCode(code string) codes.Code {
+	switch code {
+	case protocol.ErrorDenied:
+		return codes.PermissionDenied
+	case protocol.ErrorNotFound:
+		return codes.NotFound
+	case protocol.ErrorInvalid:
+		return codes.InvalidArgument
+	case protocol.ErrorConflict:
+		return codes.AlreadyExists
+	case protocol.ErrorUnavailable:
+		return codes.Unavailable
+	case protocol.ErrorRateLimited, protocol.ErrorBusy:
+		return codes.ResourceExhausted
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// hookTimeout bounds how long the authorization hook may take to decide.
+const hookTimeout = 10 * time.Second
+
+// maxHookResponse bounds the response of a webhook, as large as a frame
+// of the protocol.
+const maxHookResponse = 1 << 20
+
+// HookRequest describes a command to the authorization hook.
+type HookRequest struct {
+	UID    int      `json:"uid"`
+	GID    int      `json:"gid"`
+	Groups []int    `json:"groups"`
+	PID    int      `json:"pid"`
+	Argv   []string `json:"argv"`
+	Cwd    string   `json:"cwd"`
+	Env    []string `json:"env"`
+}
+
+// HookResponse is the decision of the authorization hook. Argv, Cwd and
+// Env, when set, replace the ones of the request.
+type HookResponse struct {
+	Allow  bool     `json:"allow"`
+	Reason string   `json:"reason,omitempty"`
+	Argv   []string `json:"argv,omitempty"`
+	Cwd    string   `json:"cwd,omitempty"`
+	Env    []string `json:"env,omitempty"`
+}
+
+// consult describes the command to an external policy and applies its
+// decision, for which it is given a child span of trace.
+func consult(policy string, decide func(*HookRequest) (*HookResponse, error), cmdStruct *protocol.Command, p Peer, trace *span) error {
+	sp := trace.child(policy)
+	decision, err := decide(&HookRequest{
+		UID:    p.UID,
+		GID:    p.GID,
+		Groups: p.groups(),
+		PID:    p.PID,
+		Argv:   cmdStruct.Command,
+		Cwd:    cmdStruct.Cwd,
+		Env:    cmdStruct.Env,
+	})
+	sp.fail(err)
+	sp.finish()
+	switch {
+	case err != nil:
+		slog.Error("Error consulting the "+policy, "err", err)
+		return fmt.Errorf("command %s is not allowed, the %s failed", cmdStruct.Command[0], policy)
+	case !decision.Allow && decision.Reason != "":
+		return errors.New(decision.Reason)
+	case !decision.Allow:
+		return fmt.Errorf("command %s is denied by the %s", cmdStruct.Command[0], policy)
+	}
+
+	// An empty command would be run as the empty path, or crash the
+	// server on the way
+	if decision.Argv != nil && (len(decision.Argv) == 0 || decision.Argv[0] == "") {
+		slog.Error("The "+policy+" answered an empty command", "argv", decision.Argv)
+		return fmt.Errorf("command %s is not allowed, the %s answered an empty command", cmdStruct.Command[0], policy)
+	}
+	if decision.Argv != nil {
+		cmdStruct.Command = decision.Argv
+	}
+	if decision.Cwd != "" {
+		cmdStruct.Cwd = decision.Cwd
+	}
+	if decision.Env != nil {
+		cmdStruct.Env = decision.Env
+	}
+	return nil
+}
+
+// runAuthHook asks the hook whether to run a command. The hook is either
+// an HTTP webhook, receiving the request as a POST, or an executable
+// reading it on stdin and writing its response on stdout.
+func runAuthHook(hook string, req *HookRequest) (*HookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var output []byte
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		output, err = postHook(ctx, hook, body)
+	} else {
+		cmd := exec.CommandContext(ctx, hook)
+		cmd.Stdin = bytes.NewReader(body)
+		output, err = cmd.Output()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp HookResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, fmt.Errorf("decoding the hook response: %w", err)
+	}
+	return &resp, nil
+}
+
+func postHook(ctx context.Context, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var output bytes.Buffer
+	if _, err := output.ReadFrom(io.LimitReader(resp.Body, maxHookResponse+1)); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hook answered %s", resp.Status)
+	}
+	if output.Len() > maxHookResponse {
+		return nil, fmt.Errorf("hook response larger than %d bytes", maxHookResponse)
+	}
+	return output.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+func TestConsultArgv(t *testing.T) {
+	tests := []struct {
+		name    string
+		argv    []string
+		want    []string
+		wantErr bool
+	}{
+		{"kept", nil, []string{"ls", "-l"}, false},
+		{"replaced", []string{"ls", "-a"}, []string{"ls", "-a"}, false},
+		{"empty", []string{}, nil, true},
+		{"empty command", []string{"", "-l"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decide := func(*HookRequest) (*HookResponse, error) {
+				return &HookResponse{Allow: true, Argv: test.argv}, nil
+			}
+			cmdStruct := &protocol.Command{Command: []string{"ls", "-l"}}
+			err := consult("hook", decide, cmdStruct, Peer{}, nil)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("consult() ran %q", cmdStruct.Command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cmdStruct.Command, test.want) {
+				t.Errorf("command = %q, want %q", cmdStruct.Command, test.want)
+			}
+		})
+	}
+}
+
+func TestPostHookLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"small", 64, false},
+		{"largest", maxHookResponse, false},
+		{"too large", maxHookResponse + 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(strings.Repeat(" ", test.size)))
+			}))
+			defer hook.Close()
+			output, err := postHook(context.Background(), hook.URL, []byte("{}"))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("postHook() read %d bytes", len(output))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(output) != test.size {
+				t.Errorf("postHook() read %d bytes, want %d", len(output), test.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+//go:build darwin && cgo
+
+package server
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// listenLaunchd takes over the socket launchd created for the job under
+// name, in the Sockets of its property list. It must be a unix socket, so
+// the clients are identified as on any other.
+func listenLaunchd(name string) (net.Listener, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	var fds *C.int
+	var count C.size_t
+	if errno := C.launch_activate_socket(cName, &fds, &count); errno != 0 {
+		return nil, fmt.Errorf("launchd socket %q: %w", name, syscall.Errno(errno))
+	}
+	defer C.free(unsafe.Pointer(fds))
+
+	var listener net.Listener
+	for _, fd := range unsafe.Slice(fds, count) {
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if listener != nil || l.Addr().Network() != "unix" {
+			l.Close()
+			continue
+		}
+		listener = l
+	}
+	if listener == nil {
+		return nil, fmt.Errorf("launchd socket %q is not a unix socket", name)
+	}
+	return listener, nil
+}
@@ -0,0 +1,12 @@
+//go:build !darwin || !cgo
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func listenLaunchd(name string) (net.Listener, error) {
+	return nil, errors.New("launchd sockets are only available on macOS, in builds with cgo")
+}
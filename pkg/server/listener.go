@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// listenAddress listens on an address accepted by transport.ParseAddress,
+// with the TLS and SSH settings of cfg.
+func (s *Server) listenAddress(addr string, cfg *Config) (net.Listener, error) {
+	network, address, err := transport.ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "launchd":
+		return listenLaunchd(address)
+	case "ws":
+		return listenWebSocket(address)
+	case "ssh":
+		return listenSSH(address, cfg)
+	case "grpc":
+		return listenGRPC(address)
+	case "varlink":
+		return listenVarlink(address)
+	case "dbus":
+		return s.listenDBus(address)
+	}
+	var config *tls.Config
+	if cfg.TLSEnabled() {
+		if config, err = cfg.serverTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return transport.Listen(addr, config)
+}
+
+// setSocketPermissions gives the socket file at path the mode, owner and
+// group of cfg, the ones it was created with are kept when unset.
+func setSocketPermissions(path string, cfg *Config) error {
+	if cfg.SocketOwner != "" || cfg.SocketGroup != "" {
+		uid, gid := -1, -1
+		var err error
+		if cfg.SocketOwner != "" {
+			if uid, err = LookupUID(cfg.SocketOwner); err != nil {
+				return err
+			}
+		}
+		if cfg.SocketGroup != "" {
+			if gid, err = LookupGID(cfg.SocketGroup); err != nil {
+				return err
+			}
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if cfg.SocketMode != "" {
+		mode, err := parseSocketMode(cfg.SocketMode)
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// parseSocketMode parses octal permissions, as in 0660.
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions as in 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
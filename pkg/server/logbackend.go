@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// journalSocket is where systemd-journald receives native log entries.
+const journalSocket = "/run/systemd/journal/socket"
+
+// fieldsHandler is a slog handler flattening the attributes of a record
+// into fields, named after their groups, for the backends with their own
+// line format.
+type fieldsHandler struct {
+	level  slog.Leveler
+	prefix string
+	fields []slog.Attr
+	emit   func(level slog.Level, msg string, fields []slog.Attr) error
+}
+
+func (h *fieldsHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *fieldsHandler) Handle(_ context.Context, record slog.Record) error {
+	fields := append([]slog.Attr(nil), h.fields...)
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = appendFields(fields, h.prefix, attr)
+		return true
+	})
+	return h.emit(record.Level, record.Message, fields)
+}
+
+func (h *fieldsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.fields = append([]slog.Attr(nil), h.fields...)
+	for _, attr := range attrs {
+		clone.fields = appendFields(clone.fields, h.prefix, attr)
+	}
+	return &clone
+}
+
+func (h *fieldsHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.prefix = h.prefix + name + "_"
+	return &clone
+}
+
+// appendFields appends an attribute, or the attributes of a group, to
+// fields with their names prefixed.
+func appendFields(fields []slog.Attr, prefix string, attr slog.Attr) []slog.Attr {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "_"
+		}
+		for _, member := range value.Group() {
+			fields = appendFields(fields, prefix, member)
+		}
+		return fields
+	}
+	if attr.Key == "" {
+		return fields
+	}
+	return append(fields, slog.Attr{Key: prefix + attr.Key, Value: value})
+}
+
+// newJournalHandler logs to systemd-journald with its native protocol,
+// keeping every attribute as a journal field, as in SESSION or PEER_UID.
+func newJournalHandler(level slog.Leveler) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &fieldsHandler{
+		level: level,
+		emit: func(level slog.Level, msg string, fields []slog.Attr) error {
+			var entry bytes.Buffer
+			writeJournalField(&entry, "MESSAGE", msg)
+			writeJournalField(&entry, "PRIORITY", strconv.Itoa(syslogPriority(level)))
+			writeJournalField(&entry, "SYSLOG_IDENTIFIER", "hrun")
+			for _, field := range fields {
+				writeJournalField(&entry, journalFieldName(field.Key), field.Value.String())
+			}
+			_, err := conn.Write(entry.Bytes())
+			return err
+		},
+	}, nil
+}
+
+// writeJournalField encodes a field of a journal entry, values spanning
+// several lines are prefixed with their length.
+func writeJournalField(entry *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		entry.WriteString(name + "=" + value + "\n")
+		return
+	}
+	entry.WriteString(name + "\n")
+	binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value + "\n")
+}
+
+// journalFieldName converts an attribute name to a journal field name,
+// made of uppercase letters, digits and underscores, not starting with an
+// underscore as those are reserved to journald.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "HRUN_" + name
+	}
+	return name
+}
+
+// syslogPriority maps a log level to a syslog priority.
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
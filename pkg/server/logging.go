@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogLevel is the server log verbosity, it can be changed at runtime from
+// the admin socket.
+var LogLevel = new(slog.LevelVar)
+
+// Log backends, where the server logs go.
+const (
+	LogBackendStderr   = "stderr"
+	LogBackendJournald = "journald"
+	LogBackendSyslog   = "syslog"
+)
+
+// SetupLogging sends the server logs to the backend, for stderr written to
+// w as text or JSON lines. The log package is redirected too, at the info
+// level.
+func SetupLogging(backend, format string, w io.Writer) error {
+	options := &slog.HandlerOptions{Level: LogLevel}
+	var handler slog.Handler
+	var err error
+	switch {
+	case backend == LogBackendJournald:
+		handler, err = newJournalHandler(LogLevel)
+	case backend == LogBackendSyslog:
+		handler, err = newSyslogHandler(LogLevel)
+	case format == "text":
+		handler = slog.NewTextHandler(w, options)
+	case format == "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		err = fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// ParseLogLevel parses the name of a log level.
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
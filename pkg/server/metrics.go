@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+)
+
+// listenMetrics serves the server counters in the Prometheus text format
+// on addr, under /metrics.
+func listenMetrics(addr string, server *Server) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(server.metrics())
+	})
+	httpServer, err := listenHTTP(addr, mux)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+	return httpServer, nil
+}
+
+// listenPprof serves the runtime profiles of net/http/pprof on addr, under
+// /debug/pprof/.
+func listenPprof(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	httpServer, err := listenHTTP(addr, mux)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Serving profiles", "url", "http://"+addr+"/debug/pprof/")
+	return httpServer, nil
+}
+
+// listenHTTP serves handler on the TCP address addr in the background.
+func listenHTTP(addr string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+			slog.Error("Error serving HTTP", "err", err)
+		}
+	}()
+	return httpServer, nil
+}
+
+// metrics renders the counters in the Prometheus text exposition format.
+func (s *Server) metrics() []byte {
+	st := s.stats
+	var buf bytes.Buffer
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatFloat(value))
+	}
+	metric("hrun_sessions_total", "counter", "Commands started.", float64(st.sessions.Load()))
+	metric("hrun_sessions_active", "gauge", "Commands still running.", float64(s.runningSessions()))
+	metric("hrun_denied_commands_total", "counter", "Commands refused by the policy.", float64(st.denied.Load()))
+	metric("hrun_input_bytes_total", "counter", "Input sent to the commands.", float64(st.bytesIn.Load()))
+	metric("hrun_output_bytes_total", "counter", "Output produced by the commands.", float64(st.bytesOut.Load()))
+	st.startLatency.write(&buf, "hrun_command_start_seconds", "Time to start a command, from its request to the running process.")
+	st.durations.write(&buf, "hrun_session_duration_seconds", "Run time of the finished commands.")
+	metric("hrun_start_time_seconds", "gauge", "Start time of the server since the epoch.", float64(st.started.Unix()))
+	return buf.Bytes()
+}
+
+// write renders the histogram in the Prometheus text exposition format.
+func (h *histogram) write(buf *bytes.Buffer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(buf, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	notificationsName      = "org.freedesktop.Notifications"
+	notificationsPath      = dbus.ObjectPath("/org/freedesktop/Notifications")
+	notificationsInterface = "org.freedesktop.Notifications"
+)
+
+// Notifier asks the user of the desktop session with a notification,
+// whose actions approve or deny the command.
+type Notifier struct {
+	approved *ApprovedCmds
+}
+
+// NewNotifier remembers the commands always allowed in approved.
+func NewNotifier(approved *ApprovedCmds) *Notifier {
+	return &Notifier{approved: approved}
+}
+
+func (n *Notifier) Approve(p Peer, command []string) error {
+	if n.approved.contains(command[0]) {
+		return nil
+	}
+	denied := fmt.Errorf("command %s was not approved", command[0])
+
+	// A connection per notification, so the server keeps working across
+	// restarts of the session bus
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		slog.Error("Error connecting to the session bus", "err", err)
+		return fmt.Errorf("command %s is not allowed, no desktop session to approve it", command[0])
+	}
+	defer conn.Close()
+
+	// Listen before notifying, not to miss a quick answer
+	if err := conn.AddMatchSignal(dbus.WithMatchObjectPath(notificationsPath), dbus.WithMatchInterface(notificationsInterface)); err != nil {
+		slog.Error("Error subscribing to the notification signals", "err", err)
+		return denied
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	notifications := conn.Object(notificationsName, notificationsPath)
+	body := fmt.Sprintf("User %d (pid %d) wants to run:\n%s", p.UID, p.PID, html.EscapeString(strings.Join(command, " ")))
+	actions := []string{"approve", "Approve", "always", "Always allow", "deny", "Deny"}
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(byte(2))}
+	var id uint32
+	err = notifications.Call(notificationsInterface+".Notify", 0,
+		"hrun", uint32(0), "utilities-terminal", "Run a command on the host?", body, actions, hints, int32(0)).Store(&id)
+	if err != nil {
+		slog.Error("Error sending the notification", "err", err)
+		return denied
+	}
+
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case signal := <-signals:
+			if len(signal.Body) < 2 || signal.Body[0] != id {
+				continue
+			}
+			switch signal.Name {
+			case notificationsInterface + ".ActionInvoked":
+				switch signal.Body[1] {
+				case "approve":
+					return nil
+				case "always":
+					if err := n.approved.add(command[0]); err != nil {
+						slog.Error("Error remembering the approved command", "command", command[0], "err", err)
+					}
+					return nil
+				}
+				return denied
+			case notificationsInterface + ".NotificationClosed":
+				return denied
+			}
+		case <-timer.C:
+			notifications.Call(notificationsInterface+".CloseNotification", 0, id)
+			return denied
+		}
+	}
+}
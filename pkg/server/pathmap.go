@@ -0,0 +1,50 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// TranslatePath maps a client path to the matching host path using the
+// longest client prefix configured in the path map. Paths outside every
+// mapped prefix are returned unchanged.
+func (c *Config) TranslatePath(p string) string {
+	if !filepath.IsAbs(p) {
+		return p
+	}
+
+	best := ""
+	for clientPrefix := range c.PathMap {
+		if len(clientPrefix) > len(best) && hasPathPrefix(p, clientPrefix) {
+			best = clientPrefix
+		}
+	}
+	if best == "" {
+		return p
+	}
+	return filepath.Join(c.PathMap[best], strings.TrimPrefix(p, best))
+}
+
+// TranslateArgs maps the paths found in the command arguments, either as
+// whole arguments or as the value of --option=path style arguments.
+func (c *Config) TranslateArgs(args []string) []string {
+	if len(c.PathMap) == 0 {
+		return args
+	}
+
+	translated := make([]string, len(args))
+	for i, arg := range args {
+		if name, value, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(name, "-") {
+			translated[i] = name + "=" + c.TranslatePath(value)
+			continue
+		}
+		translated[i] = c.TranslatePath(arg)
+	}
+	return translated
+}
+
+// hasPathPrefix reports whether p is prefix itself or lies below it.
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/") || prefix == ""
+}
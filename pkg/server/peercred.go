@@ -0,0 +1,19 @@
+package server
+
+// Peer identifies the process on the other end of a connection, its IDs
+// are -1 when unknown.
+type Peer struct {
+	UID int
+	GID int
+	PID int
+	// serverUser is true when the peer runs as the same user as the
+	// server, trusted like it
+	serverUser bool
+	// gids are the groups reported along with the credentials, on the
+	// systems reporting them
+	gids []int
+	// listener is the address the client connected through
+	listener string
+}
+
+var unknownPeer = Peer{UID: -1, GID: -1, PID: -1}
@@ -0,0 +1,9 @@
+package server
+
+import "golang.org/x/sys/unix"
+
+// peerPID returns the PID of the process on the other end of a unix
+// socket.
+func peerPID(fd int) (int, error) {
+	return unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+}
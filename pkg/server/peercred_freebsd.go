@@ -0,0 +1,8 @@
+package server
+
+// peerPID returns the PID of the process on the other end of a unix
+// socket, unknown here: LOCAL_PEERCRED only reports it from FreeBSD 13,
+// in a field golang.org/x/sys doesn't expose.
+func peerPID(fd int) (int, error) {
+	return -1, nil
+}
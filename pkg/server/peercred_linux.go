@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// peerCredentials returns the credentials of the process on the other end
+// of a unix socket connection, as reported by the kernel.
+func peerCredentials(conn net.Conn) (*syscall.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// connectionPeer returns the peer of a unix socket connection.
+func connectionPeer(conn net.Conn) (Peer, error) {
+	// Peers on other transports are never known
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return unknownPeer, nil
+	}
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return unknownPeer, err
+	}
+	return Peer{
+		UID:        int(cred.Uid),
+		GID:        int(cred.Gid),
+		PID:        int(cred.Pid),
+		serverUser: int(cred.Uid) == os.Getuid(),
+	}, nil
+}
+
+// groups returns the primary and supplementary groups of the peer, read
+// from /proc as SO_PEERCRED only reports the primary one.
+func (p Peer) groups() []int {
+	groups := []int{p.GID}
+	if p.PID <= 0 {
+		return groups
+	}
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(p.PID) + "/status")
+	if err != nil {
+		return groups
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if list, ok := strings.CutPrefix(line, "Groups:"); ok {
+			for _, field := range strings.Fields(list) {
+				if gid, err := strconv.Atoi(field); err == nil {
+					groups = append(groups, gid)
+				}
+			}
+			break
+		}
+	}
+	return groups
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// connectionPeer returns the peer of a named pipe connection. Windows has
+// no UIDs, but only the server user can open the pipe, so its clients are
+// trusted like the server.
+func connectionPeer(conn net.Conn) (Peer, error) {
+	pipe, ok := conn.(*transport.PipeConn)
+	if !ok {
+		return unknownPeer, nil
+	}
+	pid, err := pipe.ClientPID()
+	if err != nil {
+		return unknownPeer, err
+	}
+	return Peer{UID: -1, GID: -1, PID: pid, serverUser: true}, nil
+}
+
+// groups returns the groups of the peer, unknown on Windows.
+func (p Peer) groups() []int {
+	return []int{p.GID}
+}
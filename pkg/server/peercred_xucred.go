@@ -0,0 +1,58 @@
+//go:build darwin || freebsd
+
+package server
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// connectionPeer returns the peer of a unix socket connection, as
+// reported by LOCAL_PEERCRED.
+func connectionPeer(conn net.Conn) (Peer, error) {
+	// Peers on other transports are never known
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return unknownPeer, nil
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return unknownPeer, err
+	}
+
+	var cred *unix.Xucred
+	var pid int
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED); credErr == nil {
+			pid, credErr = peerPID(int(fd))
+		}
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return unknownPeer, err
+	}
+
+	// The first group is the primary one
+	p := Peer{UID: int(cred.Uid), GID: -1, PID: pid, serverUser: int(cred.Uid) == os.Getuid()}
+	for _, gid := range cred.Groups[:cred.Ngroups] {
+		p.gids = append(p.gids, int(gid))
+	}
+	if len(p.gids) > 0 {
+		p.GID = p.gids[0]
+	}
+	return p, nil
+}
+
+// groups returns the primary and supplementary groups of the peer, the
+// first 16 of them as reported by LOCAL_PEERCRED.
+func (p Peer) groups() []int {
+	if len(p.gids) == 0 {
+		return []int{p.GID}
+	}
+	return p.gids
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CheckPIDFile fails when the PID file names a running server, a file
+// left behind by a server that died is ignored.
+func CheckPIDFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid == os.Getpid() || !processAlive(pid) {
+		return nil
+	}
+	return fmt.Errorf("the server is already running with PID %d, according to %s", pid, path)
+}
+
+// writePIDFile writes the PID of the server to path, replacing the file
+// so it's never seen half written.
+func writePIDFile(path string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
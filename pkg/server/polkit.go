@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// polkitAction is the action checked for the commands outside of the
+// allowlist, defined in data/io.github.mirkobrombin.hrun.policy.
+const polkitAction = "io.github.mirkobrombin.hrun.run-command"
+
+// polkitTimeout bounds how long a client waits for the user to answer
+// the authentication prompt.
+const polkitTimeout = 2 * time.Minute
+
+// Polkit modes, what happens to the commands outside of the allowlist.
+const (
+	// PolkitCheck runs them if polkit authorizes the client without
+	// asking anything, as with an allow rule
+	PolkitCheck = "check"
+	// PolkitPrompt also lets the polkit agent of the user session ask for
+	// a password
+	PolkitPrompt = "prompt"
+)
+
+// polkitAuthorize asks polkit, through pkcheck, whether the client process
+// may run the command. The command is shown in the authentication prompt.
+func polkitAuthorize(p Peer, command []string, prompt bool) (bool, error) {
+	if p.PID <= 0 {
+		return false, errors.New("unknown client process")
+	}
+	startTime, ok := processStartTime(p.PID)
+	if !ok {
+		return false, fmt.Errorf("client process %d is gone", p.PID)
+	}
+
+	args := []string{
+		"--action-id", polkitAction,
+		"--process", fmt.Sprintf("%d,%d,%d", p.PID, startTime, p.UID),
+		"--detail", "command", strings.Join(command, " "),
+	}
+	if prompt {
+		args = append(args, "--allow-user-interaction")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), polkitTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "pkcheck", args...).CombinedOutput()
+
+	// pkcheck exits with 1 when not authorized, 2 when it would need to
+	// ask and 3 when the prompt was dismissed
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 1 && exitErr.ExitCode() <= 3:
+		return false, nil
+	default:
+		return false, fmt.Errorf("pkcheck: %w: %s", err, bytes.TrimSpace(output))
+	}
+}
+
+// polkitCheck authorizes a command outside of the allowlist with polkit.
+func polkitCheck(cfg *Config, p Peer, command []string, trace *span) error {
+	check := trace.child("polkit")
+	defer check.finish()
+	allowed, err := polkitAuthorize(p, command, cfg.Polkit == PolkitPrompt)
+	if err != nil {
+		slog.Error("Error checking the polkit authorization", "peer_uid", p.UID, "err", err)
+		check.fail(err)
+		return fmt.Errorf("command %s is not allowed, polkit is unavailable", command[0])
+	}
+	check.set("authorized", allowed)
+	if !allowed {
+		return fmt.Errorf("command %s is not authorized by polkit", command[0])
+	}
+	slog.Info("Command authorized by polkit", "peer_uid", p.UID, "command", strings.Join(command, " "))
+	return nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// reaperCommand is the hidden argument running hrun as the reaper of a
+// server, terminating its commands once it exits. macOS has no Pdeathsig,
+// and a server that crashed would leave them running.
+const reaperCommand = "__reaper"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == reaperCommand {
+		os.Exit(runReaper())
+	}
+}
+
+// setProcessAttributes runs the command in a new session, terminated
+// along with the server by the reaper.
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+}
+
+// reaper starts the reaper of the server, and returns the pipe it reads
+// the PIDs of the commands from. The reaper is in a session of its own, so
+// the signals meant for the server don't reach it.
+var reaper = sync.OnceValues(func() (*os.File, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	pidsReader, pidsWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pidsReader.Close()
+	cmd := exec.Command(self, reaperCommand)
+	cmd.Stdin = pidsReader
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		pidsWriter.Close()
+		return nil, err
+	}
+	go cmd.Wait()
+	return pidsWriter, nil
+})
+
+// adoptProcess ties the lifetime of a started command to the server, by
+// handing it to the reaper.
+func adoptProcess(process *os.Process) error {
+	pids, err := reaper()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(pids, process.Pid)
+	return err
+}
+
+// runReaper reads the PIDs of the commands started by the server, one per
+// line, until the server exits and the input ends. It then terminates the
+// process groups of the commands still running, telling them apart from
+// later processes reusing their PIDs by their start time.
+func runReaper() int {
+	started := make(map[int]uint64)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		pid, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			continue
+		}
+		if start, ok := processStartTime(pid); ok {
+			started[pid] = start
+		}
+		// Forget the commands that exited in the meantime
+		for pid, start := range started {
+			if current, ok := processStartTime(pid); !ok || current != start {
+				delete(started, pid)
+			}
+		}
+	}
+
+	for pid, start := range started {
+		if current, ok := processStartTime(pid); ok && current == start {
+			signalProcessGroup(pid, syscall.SIGTERM)
+		}
+	}
+	return 0
+}
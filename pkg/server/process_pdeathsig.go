@@ -0,0 +1,24 @@
+//go:build linux || freebsd
+
+package server
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessAttributes runs the command in a new session, terminated
+// along with the server through prctl on Linux and procctl on FreeBSD.
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:    true,
+		Pdeathsig: syscall.SIGTERM,
+	}
+}
+
+// adoptProcess ties the lifetime of a started command to the server,
+// already done by Pdeathsig here.
+func adoptProcess(process *os.Process) error {
+	return nil
+}
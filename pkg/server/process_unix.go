@@ -0,0 +1,44 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// signalProcessGroup delivers a signal to the process group led by pid.
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
+
+// signalProcess delivers a signal to a single process.
+func signalProcess(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
+
+// processAlive reports whether the process exists.
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// signalString returns the name of a signal, as in SIGTERM.
+func signalString(sig syscall.Signal) string {
+	return unix.SignalName(sig)
+}
+
+// maxRSS returns the peak resident set size of an exited command, in KiB.
+func maxRSS(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// macOS reports it in bytes
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss) / 1024
+	}
+	return int64(rusage.Maxrss)
+}
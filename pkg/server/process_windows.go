@@ -0,0 +1,92 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// setProcessAttributes runs the command in a new process group, away from
+// the console signals of the server.
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP,
+	}
+}
+
+// signalProcessGroup terminates the process, Windows has no process
+// groups to signal. The children are found with descendants.
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	return signalProcess(pid, sig)
+}
+
+// signalProcess terminates a process, with the exit code a unix shell
+// reports for the signal. Windows can't deliver signals, so even the
+// gentle ones terminate immediately.
+func signalProcess(pid int, sig syscall.Signal) error {
+	handle, err := windows.OpenProcess(windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(handle)
+	return windows.TerminateProcess(handle, 128+uint32(sig))
+}
+
+// processAlive reports whether the process exists and has not exited.
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+	event, err := windows.WaitForSingleObject(handle, 0)
+	return err == nil && event == uint32(windows.WAIT_TIMEOUT)
+}
+
+// signalString returns the name of a signal.
+func signalString(sig syscall.Signal) string {
+	return sig.String()
+}
+
+// maxRSS returns the peak resident set size of an exited command, unknown
+// on Windows.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
+
+// serverJob is a job object killing its processes once the server exits
+// and the last handle to it is closed.
+var serverJob = sync.OnceValues(func() (windows.Handle, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		windows.CloseHandle(job)
+		return 0, err
+	}
+	return job, nil
+})
+
+// adoptProcess ties the lifetime of a started command to the server, by
+// adding it to the job of the server. Its children join the job as well.
+func adoptProcess(process *os.Process) error {
+	job, err := serverJob()
+	if err != nil {
+		return err
+	}
+	handle, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(process.Pid))
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(handle)
+	return windows.AssignProcessToJobObject(job, handle)
+}
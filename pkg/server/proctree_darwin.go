@@ -0,0 +1,42 @@
+package server
+
+import "golang.org/x/sys/unix"
+
+// descendants returns the PIDs of every process below pid, found through
+// the parent PIDs of the process table. Processes that left the process
+// group of the command, like daemons calling setsid, are only reachable
+// this way.
+func descendants(pid int) []int {
+	procs, err := unix.SysctlKinfoProcSlice("kern.proc.all")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, proc := range procs {
+		parent := int(proc.Eproc.Ppid)
+		children[parent] = append(children[parent], int(proc.Proc.P_pid))
+	}
+
+	var result []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		result = append(result, next)
+		queue = append(queue, children[next]...)
+	}
+	return result
+}
+
+// processStartTime returns when a process started, in microseconds since
+// the epoch. Along with the PID, it tells a process apart from a later one
+// reusing its PID.
+func processStartTime(pid int) (uint64, bool) {
+	proc, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil || int(proc.Proc.P_pid) != pid {
+		return 0, false
+	}
+	start := proc.Proc.P_starttime
+	return uint64(start.Sec)*1e6 + uint64(start.Usec), true
+}
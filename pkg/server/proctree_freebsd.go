@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// kinfoProcPID is the offset of ki_pid in struct kinfo_proc, after two
+// ints and eight pointers. ki_ppid follows it.
+const kinfoProcPID = 8 + 8*unsafe.Sizeof(uintptr(0))
+
+// descendants returns the PIDs of every process below pid, found through
+// the parent PIDs of the process table. Processes that left the process
+// group of the command, like daemons calling setsid, are only reachable
+// this way.
+func descendants(pid int) []int {
+	table, err := unix.SysctlRaw("kern.proc.proc")
+	if err != nil {
+		return nil
+	}
+
+	// Each entry starts with its size, ki_structsize
+	children := make(map[int][]int)
+	for len(table) >= int(kinfoProcPID)+8 {
+		size := int(binary.NativeEndian.Uint32(table))
+		if size < int(kinfoProcPID)+8 || size > len(table) {
+			break
+		}
+		child := int(int32(binary.NativeEndian.Uint32(table[kinfoProcPID:])))
+		parent := int(int32(binary.NativeEndian.Uint32(table[kinfoProcPID+4:])))
+		children[parent] = append(children[parent], child)
+		table = table[size:]
+	}
+
+	var result []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		result = append(result, next)
+		queue = append(queue, children[next]...)
+	}
+	return result
+}
+
+// processStartTime is only needed by polkit, which is Linux only.
+func processStartTime(pid int) (uint64, bool) {
+	return 0, false
+}
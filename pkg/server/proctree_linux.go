@@ -0,0 +1,76 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// descendants returns the PIDs of every process below pid, found through
+// the parent PIDs in /proc. Processes that left the process group of the
+// command, like daemons calling setsid, are only reachable this way.
+func descendants(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if parent, ok := parentPID(child); ok {
+			children[parent] = append(children[parent], child)
+		}
+	}
+
+	var result []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		result = append(result, next)
+		queue = append(queue, children[next]...)
+	}
+	return result
+}
+
+// parentPID reads the parent PID of a process from /proc/<pid>/stat.
+func parentPID(pid int) (int, bool) {
+	fields := procStat(pid)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	return ppid, err == nil
+}
+
+// processStartTime reads when a process started, in clock ticks since
+// boot, from /proc/<pid>/stat. Along with the PID, it tells a process
+// apart from a later one reusing its PID.
+func processStartTime(pid int) (uint64, bool) {
+	fields := procStat(pid)
+	if len(fields) < 20 {
+		return 0, false
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	return start, err == nil
+}
+
+// procStat returns the fields of /proc/<pid>/stat after the command name,
+// starting with the state.
+func procStat(pid int) []string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil
+	}
+	// The command name is in parentheses and may contain spaces
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return nil
+	}
+	return strings.Fields(stat[end+1:])
+}
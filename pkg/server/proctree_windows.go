@@ -0,0 +1,57 @@
+package server
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// descendants returns the PIDs of every process below pid, found through
+// the parent PIDs of a process snapshot.
+func descendants(pid int) []int {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil
+	}
+	defer windows.CloseHandle(snapshot)
+
+	children := make(map[int][]int)
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		parent := int(entry.ParentProcessID)
+		children[parent] = append(children[parent], int(entry.ProcessID))
+	}
+
+	// Windows reuses PIDs, so a stale parent PID may point back into the
+	// tree
+	var result []int
+	seen := map[int]bool{pid: true}
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if seen[next] {
+			continue
+		}
+		seen[next] = true
+		result = append(result, next)
+		queue = append(queue, children[next]...)
+	}
+	return result
+}
+
+// processStartTime returns when a process was created, in 100ns intervals
+// since 1601. Along with the PID, it tells a process apart from a later
+// one reusing its PID.
+func processStartTime(pid int) (uint64, bool) {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return 0, false
+	}
+	defer windows.CloseHandle(handle)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return 0, false
+	}
+	return uint64(creation.HighDateTime)<<32 | uint64(creation.LowDateTime), true
+}
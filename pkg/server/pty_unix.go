@@ -0,0 +1,77 @@
+//go:build unix
+
+package server
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// ptyIO connects the command to a new pty sized as requested by the
+// client. When requested, stderr is kept out of the pty and sent as
+// separate frames.
+func ptyIO(cmd *exec.Cmd, frames protocol.FrameSender, cmdStruct *protocol.Command, logger *slog.Logger) (*commandIO, error) {
+	stdio := &commandIO{log: logger}
+
+	// Prepare a pty
+	ptyMaster, ptySlave, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	stdio.log.Debug("PTY created")
+
+	// Give it the mode of the terminal of the client
+	if cmdStruct.Termios != nil {
+		if err := cmdStruct.Termios.Apply(int(ptySlave.Fd())); err != nil {
+			stdio.log.Warn("Error setting the terminal mode", "err", err)
+		}
+	}
+
+	// Set initial terminal size, unless the client has no terminal
+	if cmdStruct.Width > 0 && cmdStruct.Height > 0 {
+		ws := &pty.Winsize{
+			Cols: cmdStruct.Width,
+			Rows: cmdStruct.Height,
+		}
+		if err := pty.Setsize(ptyMaster, ws); err != nil {
+			stdio.log.Error("Error setting initial terminal size", "err", err)
+		} else {
+			stdio.log.Debug("Terminal initialized", "width", cmdStruct.Width, "height", cmdStruct.Height)
+		}
+	}
+
+	cmd.Stdin = ptySlave
+	cmd.Stdout = ptySlave
+	cmd.Stderr = ptySlave
+	cmd.SysProcAttr.Setctty = true
+	stdio.childFiles = []*os.File{ptySlave}
+
+	// Route stderr through a pipe when the client wants it separately
+	if cmdStruct.SplitStderr {
+		stderrReader, stderrWriter, err := os.Pipe()
+		if err != nil {
+			ptyMaster.Close()
+			ptySlave.Close()
+			return nil, err
+		}
+		cmd.Stderr = stderrWriter
+		stdio.childFiles = append(stdio.childFiles, stderrWriter)
+		stdio.forward(frames, protocol.FrameStderr, stderrReader)
+	}
+
+	// Set up the channels to communicate with the host, the master is
+	// closed along with the output
+	stdio.forward(frames, protocol.FrameData, ptyMaster)
+	stdio.stdin = ptyMaster
+	stdio.startInput()
+	stdio.resize = func(width, height uint16) error {
+		return pty.Setsize(ptyMaster, &pty.Winsize{Cols: width, Rows: height})
+	}
+
+	return stdio, nil
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// conptyHostCommand is the hidden argument running hrun as the host of a
+// pseudo console. exec.Cmd can't attach one to a command, so the command
+// runs under hrun itself, relaying its console over plain pipes.
+const conptyHostCommand = "__conpty-host"
+
+// conptyResizeEnv carries the handle the host reads the resizes from, each
+// of them a width and a height of 2 bytes.
+const conptyResizeEnv = "HRUN_CONPTY_RESIZE"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == conptyHostCommand {
+		os.Exit(runConptyHost(os.Args[2:]))
+	}
+}
+
+// ptyIO connects the command to a pseudo console sized as requested by
+// the client, through a host process. When requested, stderr is kept out
+// of the console and sent as separate frames.
+func ptyIO(cmd *exec.Cmd, frames protocol.FrameSender, cmdStruct *protocol.Command, logger *slog.Logger) (*commandIO, error) {
+	stdio := &commandIO{log: logger}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	width, height := cmdStruct.Width, cmdStruct.Height
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+
+	// Run the command under the host, keeping the lookup error of the
+	// command for Start to report
+	cmd.Args = append([]string{self, conptyHostCommand, strconv.Itoa(int(width)), strconv.Itoa(int(height)), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	pipe := func() (r, w *os.File, err error) {
+		if r, w, err = os.Pipe(); err == nil {
+			files = append(files, r, w)
+		}
+		return r, w, err
+	}
+	stdinReader, stdinWriter, err := pipe()
+	if err != nil {
+		return nil, err
+	}
+	outputReader, outputWriter, err := pipe()
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	resizeReader, resizeWriter, err := pipe()
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	// Hand the resize pipe to the host
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, conptyResizeEnv+"="+strconv.FormatUint(uint64(resizeReader.Fd()), 10))
+	cmd.SysProcAttr.AdditionalInheritedHandles = append(cmd.SysProcAttr.AdditionalInheritedHandles, syscall.Handle(resizeReader.Fd()))
+
+	cmd.Stdin = stdinReader
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+	stdio.childFiles = []*os.File{stdinReader, outputWriter, resizeReader}
+
+	// Route the errors of the host through a pipe when the client wants
+	// stderr separately, the console merges the ones of the command
+	if cmdStruct.SplitStderr {
+		stderrReader, stderrWriter, err := pipe()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		cmd.Stderr = stderrWriter
+		stdio.childFiles = append(stdio.childFiles, stderrWriter)
+		stdio.forward(frames, protocol.FrameStderr, stderrReader)
+	}
+
+	stdio.forward(frames, protocol.FrameData, outputReader)
+	stdio.files = append(stdio.files, stdinWriter, resizeWriter)
+	stdio.stdin = stdinWriter
+	stdio.startInput()
+	stdio.resize = func(width, height uint16) error {
+		var size [4]byte
+		binary.BigEndian.PutUint16(size[0:], width)
+		binary.BigEndian.PutUint16(size[2:], height)
+		_, err := resizeWriter.Write(size[:])
+		return err
+	}
+
+	return stdio, nil
+}
+
+// runConptyHost runs a command in a new pseudo console, relaying the
+// console to the standard streams, and returns the exit code of the
+// command. The arguments are the width and the height of the console, the
+// path of the command and its arguments.
+func runConptyHost(args []string) int {
+	code, err := hostConpty(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hrun:", err)
+		return protocol.ExitCommandNotFound
+	}
+	return code
+}
+
+func hostConpty(args []string) (int, error) {
+	if len(args) < 3 {
+		return 0, errors.New("usage: " + conptyHostCommand + " width height command [args...]")
+	}
+	width, err := strconv.ParseInt(args[0], 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseInt(args[1], 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	// The resize pipe is for the host only
+	var resize *os.File
+	if value, ok := os.LookupEnv(conptyResizeEnv); ok {
+		os.Unsetenv(conptyResizeEnv)
+		if handle, err := strconv.ParseUint(value, 10, 64); err == nil {
+			resize = os.NewFile(uintptr(handle), "resize")
+		}
+	}
+
+	// Create the console, with a pipe in each direction
+	var inputRead, inputWrite, outputRead, outputWrite windows.Handle
+	if err := windows.CreatePipe(&inputRead, &inputWrite, nil, 0); err != nil {
+		return 0, err
+	}
+	if err := windows.CreatePipe(&outputRead, &outputWrite, nil, 0); err != nil {
+		return 0, err
+	}
+	var console windows.Handle
+	err = windows.CreatePseudoConsole(windows.Coord{X: int16(width), Y: int16(height)}, inputRead, outputWrite, 0, &console)
+	windows.CloseHandle(inputRead)
+	windows.CloseHandle(outputWrite)
+	if err != nil {
+		return 0, fmt.Errorf("creating the pseudo console: %w", err)
+	}
+	input := os.NewFile(uintptr(inputWrite), "console input")
+	output := os.NewFile(uintptr(outputRead), "console output")
+
+	// Start the command attached to the console
+	attributes, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return 0, err
+	}
+	defer attributes.Delete()
+	// The attribute is the console handle itself, not a pointer to it
+	if err := attributes.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, *(*unsafe.Pointer)(unsafe.Pointer(&console)), unsafe.Sizeof(console)); err != nil {
+		return 0, err
+	}
+	startup := windows.StartupInfoEx{ProcThreadAttributeList: attributes.List()}
+	startup.Cb = uint32(unsafe.Sizeof(startup))
+	// Without handles, the command only has the console
+	startup.Flags = windows.STARTF_USESTDHANDLES
+	path, err := windows.UTF16PtrFromString(args[2])
+	if err != nil {
+		return 0, err
+	}
+	commandLine, err := windows.UTF16PtrFromString(windows.ComposeCommandLine(args[2:]))
+	if err != nil {
+		return 0, err
+	}
+	var process windows.ProcessInformation
+	err = windows.CreateProcess(path, commandLine, nil, nil, false, windows.EXTENDED_STARTUPINFO_PRESENT, nil, nil, &startup.StartupInfo, &process)
+	if err != nil {
+		windows.ClosePseudoConsole(console)
+		return 0, &os.PathError{Op: "exec", Path: args[2], Err: err}
+	}
+	windows.CloseHandle(process.Thread)
+	defer windows.CloseHandle(process.Process)
+
+	// Relay the console until the command exits
+	go io.Copy(input, os.Stdin)
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, output)
+		close(outputDone)
+	}()
+	if resize != nil {
+		go func() {
+			var size [4]byte
+			for {
+				if _, err := io.ReadFull(resize, size[:]); err != nil {
+					return
+				}
+				windows.ResizePseudoConsole(console, windows.Coord{
+					X: int16(binary.BigEndian.Uint16(size[0:])),
+					Y: int16(binary.BigEndian.Uint16(size[2:])),
+				})
+			}
+		}()
+	}
+	if _, err := windows.WaitForSingleObject(process.Process, windows.INFINITE); err != nil {
+		return 0, err
+	}
+	var code uint32
+	if err := windows.GetExitCodeProcess(process.Process, &code); err != nil {
+		return 0, err
+	}
+
+	// Closing the console flushes the rest of its output
+	windows.ClosePseudoConsole(console)
+	select {
+	case <-outputDone:
+	case <-time.After(time.Second):
+	}
+	return int(code), nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Default terminal size written to recordings of sessions without a pty,
+// players need one to size their screen.
+const (
+	defaultRecordWidth  = 80
+	defaultRecordHeight = 24
+)
+
+// CastHeader is the first line of an asciicast v2 file.
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes the output of a session as an asciicast v2 file, the
+// format played by asciinema. Every event is written as soon as it happens,
+// so recordings survive a server crash.
+type recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+	// partial holds the bytes of a UTF-8 sequence split across two writes
+	partial []byte
+}
+
+// newRecorder creates the recording of a session in dir, named after the
+// session start time and ID.
+func newRecorder(dir string, session *Session, width, height uint16, env []string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.cast", session.StartedAt.Format("20060102-150405"), session.ID)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if width == 0 || height == 0 {
+		width, height = defaultRecordWidth, defaultRecordHeight
+	}
+	header := CastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: session.StartedAt.Unix(),
+		Command:   strings.Join(session.Command, " "),
+		Title:     session.Name,
+	}
+	for _, variable := range env {
+		if name, value, ok := strings.Cut(variable, "="); ok && (name == "TERM" || name == "SHELL") {
+			if header.Env == nil {
+				header.Env = make(map[string]string)
+			}
+			header.Env[name] = value
+		}
+	}
+
+	if err := writeJSONLine(file, &header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &recorder{file: file, start: session.StartedAt}, nil
+}
+
+// Output records a chunk of terminal output.
+func (r *recorder) Output(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data = append(r.partial, data...)
+	r.partial = nil
+
+	// Keep an incomplete UTF-8 sequence at the end for the next chunk, as
+	// JSON strings can't hold it
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				r.partial = append([]byte(nil), data[len(data)-i:]...)
+				data = data[:len(data)-i]
+			}
+			break
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return r.event("o", string(data))
+}
+
+// Resize records a terminal size change.
+func (r *recorder) Resize(width, height uint16) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes what is left of the output and closes the recording.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.partial) > 0 {
+		r.event("o", string(r.partial))
+		r.partial = nil
+	}
+	return r.file.Close()
+}
+
+func (r *recorder) event(eventType, data string) error {
+	elapsed := math.Round(time.Since(r.start).Seconds()*1e6) / 1e6
+	return writeJSONLine(r.file, []any{elapsed, eventType, data})
+}
+
+// writeJSONLine writes v as a single line of JSON, keeping characters like
+// < and & readable as they are common in terminal output.
+func writeJSONLine(w io.Writer, v any) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// regoQuery is the document the Rego policies define, shaped like the
+// HookResponse: an allow rule with an optional reason and replacements.
+const regoQuery = "data.hrun"
+
+// evalRego evaluates a Rego policy with the request as its input. The
+// evaluation runs in the opa binary at the absolute path opa, as its Go
+// library is far bigger than hrun itself.
+func evalRego(opa, policy string, req *HookRequest) (*HookResponse, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, opa, "eval", "--format", "json", "--data", policy, "--stdin-input", regoQuery)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return nil, fmt.Errorf("opa: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opa: %w", err)
+	}
+
+	// An undefined document has no result, which denies the command
+	var result struct {
+		Result []struct {
+			Expressions []struct {
+				Value HookResponse `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("decoding the opa result: %w", err)
+	}
+	if len(result.Result) == 0 || len(result.Result[0].Expressions) == 0 {
+		return &HookResponse{}, nil
+	}
+	return &result.Result[0].Expressions[0].Value, nil
+}
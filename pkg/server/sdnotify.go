@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotifier tells systemd about the state of a Type=notify service, and
+// pings its watchdog. A nil notifier does nothing, when systemd doesn't
+// supervise the server.
+type sdNotifier struct {
+	addr *net.UnixAddr
+	// watchdog is how often systemd expects a ping, never when zero
+	watchdog time.Duration
+}
+
+// newSdNotifier returns the notifier of the service, nil when the server
+// isn't one. The variables of systemd are removed from the environment,
+// so the commands don't notify in the name of the server.
+func newSdNotifier() *sdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	watchdogUsec := os.Getenv("WATCHDOG_USEC")
+	watchdogPID := os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if socket == "" {
+		return nil
+	}
+
+	n := &sdNotifier{addr: &net.UnixAddr{Name: socket, Net: "unixgram"}}
+	if usec, err := strconv.ParseInt(watchdogUsec, 10, 64); err == nil && usec > 0 {
+		if watchdogPID == "" || watchdogPID == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// notify sends a state change, as in READY=1.
+func (n *sdNotifier) notify(state string) {
+	if n == nil {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		slog.Warn("Error notifying systemd", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Error notifying systemd", "state", state, "err", err)
+	}
+}
+
+// runWatchdog pings the watchdog twice per interval while the server is
+// responsive, until ctx is done. Once it isn't, systemd restarts it.
+func (n *sdNotifier) runWatchdog(ctx context.Context, responsive func(timeout time.Duration) bool) {
+	if n == nil || n.watchdog == 0 {
+		return
+	}
+	ticker := time.NewTicker(n.watchdog / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !responsive(n.watchdog / 4) {
+				slog.Error("Server unresponsive, skipping the watchdog ping")
+				continue
+			}
+			n.notify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,1417 @@
+// Package server runs the commands of the hrun clients on the host, in
+// sessions that can outlive their connection.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// Server holds the live server configuration, which can be swapped at
+// runtime with Reload without affecting sessions already running.
+type Server struct {
+	// ConfigPath is the config file to load, when empty the default
+	// locations are searched on every reload
+	ConfigPath string
+	// Overrides changes the configuration loaded, as the command-line
+	// flags do
+	Overrides func(*Config)
+	// Approver asks for the approval of the commands outside of the
+	// allowlist, as with --confirm or --confirm-desktop
+	Approver Approver
+	// Ready is called once the server accepts connections
+	Ready func()
+	// Listeners, when not empty, are served instead of the addresses of
+	// the configuration, like a transport.MemListener in tests
+	Listeners []net.Listener
+	// AdminListener serves the admin commands along with Listeners, the
+	// admin socket is only created for the addresses of the configuration
+	AdminListener net.Listener
+
+	mu  sync.RWMutex
+	cfg *Config
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*Session
+
+	// draining servers refuse new commands and shut down once the last
+	// one exited
+	draining atomic.Bool
+	shutdown context.CancelFunc
+
+	stats    *serverStats
+	tracer   *tracer
+	audit    *auditLog
+	limiter  *rateLimiter
+	notifier *sdNotifier
+	// bus is the listener on D-Bus, where the sessions are announced
+	bus *dbusListener
+}
+
+// Config returns the configuration currently in effect.
+func (s *Server) Config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// Reload loads the config file again, applies the command-line overrides
+// and, if the result is valid, makes it the configuration in effect.
+func (s *Server) Reload() error {
+	s.mu.RLock()
+	notifier := s.notifier
+	s.mu.RUnlock()
+	notifier.notify("RELOADING=1")
+	defer notifier.notify("READY=1")
+
+	path := s.ConfigPath
+	if path == "" {
+		path = FindConfig()
+	}
+	if path != "" {
+		slog.Info("Loading configuration", "path", path)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if s.Overrides != nil {
+		s.Overrides(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg != nil && s.cfg.Socket != cfg.Socket {
+		slog.Warn("Socket path changes require a restart", "socket", s.cfg.Socket)
+		cfg.Socket = s.cfg.Socket
+	}
+	if s.cfg != nil && !slices.Equal(s.cfg.Listen, cfg.Listen) {
+		slog.Warn("Listen address changes require a restart", "listen", s.cfg.Listen)
+		cfg.Listen = s.cfg.Listen
+	}
+	if s.cfg != nil && s.cfg.AdminSocketPath() != cfg.AdminSocketPath() {
+		slog.Warn("Admin socket path changes require a restart", "admin_socket", s.cfg.AdminSocketPath())
+		cfg.AdminSocket = s.cfg.AdminSocketPath()
+	}
+	if s.cfg != nil && s.cfg.MetricsAddr != cfg.MetricsAddr {
+		slog.Warn("Metrics address changes require a restart", "metrics_addr", s.cfg.MetricsAddr)
+		cfg.MetricsAddr = s.cfg.MetricsAddr
+	}
+	if s.cfg != nil && s.cfg.PprofAddr != cfg.PprofAddr {
+		slog.Warn("Profiling address changes require a restart", "pprof_addr", s.cfg.PprofAddr)
+		cfg.PprofAddr = s.cfg.PprofAddr
+	}
+	if s.cfg != nil && s.cfg.OTLPEndpoint != cfg.OTLPEndpoint {
+		slog.Warn("OTLP endpoint changes require a restart", "otlp_endpoint", s.cfg.OTLPEndpoint)
+		cfg.OTLPEndpoint = s.cfg.OTLPEndpoint
+	}
+	if s.cfg != nil && s.cfg.LogBackend != cfg.LogBackend {
+		slog.Warn("Log backend changes require a restart", "log_backend", s.cfg.LogBackend)
+		cfg.LogBackend = s.cfg.LogBackend
+	}
+	if s.cfg != nil && s.cfg.AuditLog != cfg.AuditLog {
+		slog.Warn("Audit log changes require a restart", "audit_log", s.cfg.AuditLog)
+		cfg.AuditLog = s.cfg.AuditLog
+	}
+	if s.cfg != nil && (s.cfg.SocketMode != cfg.SocketMode || s.cfg.SocketOwner != cfg.SocketOwner || s.cfg.SocketGroup != cfg.SocketGroup) {
+		slog.Warn("Socket permission changes require a restart", "socket_mode", s.cfg.SocketMode, "socket_owner", s.cfg.SocketOwner, "socket_group", s.cfg.SocketGroup)
+		cfg.SocketMode, cfg.SocketOwner, cfg.SocketGroup = s.cfg.SocketMode, s.cfg.SocketOwner, s.cfg.SocketGroup
+	}
+	if s.cfg != nil && s.cfg.PIDFile != cfg.PIDFile {
+		slog.Warn("PID file changes require a restart", "pid_file", s.cfg.PIDFile)
+		cfg.PIDFile = s.cfg.PIDFile
+	}
+	if s.cfg != nil {
+		logConfigChanges(s.cfg, cfg)
+	}
+	s.cfg = cfg
+	return nil
+}
+
+// logConfigChanges logs the settings a reload changed, so the effect of a
+// SIGHUP can be checked in the server log.
+func logConfigChanges(old, cfg *Config) {
+	oldValues := reflect.ValueOf(old).Elem()
+	newValues := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < oldValues.NumField(); i++ {
+		if reflect.DeepEqual(oldValues.Field(i).Interface(), newValues.Field(i).Interface()) {
+			continue
+		}
+		key := strings.Split(oldValues.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		slog.Info("Setting changed", "setting", key, "value", newValues.Field(i).Interface())
+	}
+}
+
+// serverListener is a listener of the server, along with its address as
+// in listen_policies.
+type serverListener struct {
+	net.Listener
+	address string
+}
+
+// Serve listens on the addresses of the configuration, or on Listeners,
+// and serves the clients until ctx is done, the server is drained or one
+// of its listeners fails. The sessions still running are then killed. An
+// error is only returned when the server can't start.
+func (s *Server) Serve(ctx context.Context) error {
+	// Load the configuration unless the caller already did
+	if s.Config() == nil {
+		if err := s.Reload(); err != nil {
+			return err
+		}
+	}
+	cfg := s.Config()
+	s.stats = newServerStats()
+	s.limiter = newRateLimiter()
+
+	// Notify systemd when running as a Type=notify service
+	notifier := newSdNotifier()
+	s.mu.Lock()
+	s.notifier = notifier
+	s.mu.Unlock()
+
+	// Serve the listeners given by the caller or, when socket activated,
+	// the sockets of systemd, they replace the configured ones
+	var listeners []serverListener
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, l := range s.Listeners {
+		listeners = append(listeners, serverListener{l, l.Addr().String()})
+	}
+	adminListener := s.AdminListener
+	if len(s.Listeners) == 0 {
+		activated, activatedAdmin, err := systemdListeners()
+		if err != nil {
+			return err
+		}
+		for _, l := range activated {
+			listeners = append(listeners, serverListener{l, l.Addr().String()})
+		}
+		if len(listeners) > 0 {
+			slog.Info("Using the sockets passed by systemd")
+		}
+		adminListener = activatedAdmin
+	}
+
+	// Create the listeners of the server, on the socket unless other
+	// addresses are given
+	if len(listeners) == 0 {
+		for _, address := range cfg.ListenAddresses() {
+			listener, err := s.listenAddress(address, cfg)
+			if err != nil {
+				closeListeners()
+				return err
+			}
+			listeners = append(listeners, serverListener{listener, address})
+			// Only the sockets created by the server get its
+			// permissions, systemd sets the ones of its sockets
+			if network, path, _ := transport.ParseAddress(address); (network == "unix" || network == "varlink") && !transport.IsAbstractSocket(path) {
+				if err := setSocketPermissions(path, cfg); err != nil {
+					closeListeners()
+					return err
+				}
+			}
+		}
+	}
+	defer closeListeners()
+	for _, l := range listeners {
+		slog.Info("Server is running", "network", l.Addr().Network(), "socket", l.Addr().String())
+	}
+
+	// Create the admin socket, only usable by root and the server user
+	if adminListener == nil && len(s.Listeners) == 0 {
+		var err error
+		if adminListener, err = listenAdmin(cfg.AdminSocketPath()); err != nil {
+			return err
+		}
+	}
+	if adminListener != nil {
+		defer adminListener.Close()
+		slog.Info("Admin socket is ready", "admin_socket", adminListener.Addr().String())
+	}
+
+	// Serve the metrics, if enabled
+	if cfg.MetricsAddr != "" {
+		metricsServer, err := listenMetrics(cfg.MetricsAddr, s)
+		if err != nil {
+			return err
+		}
+		defer metricsServer.Close()
+	}
+
+	// Serve the runtime profiles, if enabled
+	if cfg.PprofAddr != "" {
+		pprofServer, err := listenPprof(cfg.PprofAddr)
+		if err != nil {
+			return err
+		}
+		defer pprofServer.Close()
+	}
+
+	// Audit the commands, if enabled
+	if cfg.AuditLog != "" {
+		audit, err := openAuditLog(cfg.AuditLog)
+		if err != nil {
+			return err
+		}
+		defer audit.Close()
+		s.audit = audit
+	}
+
+	// Export traces, if enabled
+	if cfg.OTLPEndpoint != "" {
+		s.tracer = newTracer(cfg.OTLPEndpoint)
+		defer s.tracer.Close()
+	}
+
+	if cfg.PIDFile != "" {
+		if err := writePIDFile(cfg.PIDFile); err != nil {
+			return err
+		}
+		defer os.Remove(cfg.PIDFile)
+	}
+
+	// Shut down the server once ctx is done or the server drained,
+	// closing the listeners stops the accept loops
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.shutdown = cancel
+	go func() {
+		<-serveCtx.Done()
+		if ctx.Err() != nil {
+			slog.Info("Shutdown requested, closing server")
+		}
+		closeListeners()
+		if adminListener != nil {
+			adminListener.Close()
+		}
+	}()
+
+	// Accept connections and handle each of them in its own goroutine
+	var wg sync.WaitGroup
+	if adminListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(serveCtx, adminListener, s.handleAdminConnection, &wg)
+		}()
+	}
+	notifier.notify("READY=1")
+	if s.Ready != nil {
+		s.Ready()
+	}
+	go notifier.runWatchdog(serveCtx, s.responsive)
+	var serving sync.WaitGroup
+	for _, l := range listeners {
+		l := l
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			serve(serveCtx, l, func(ctx context.Context, conn net.Conn) {
+				s.handleConnection(ctx, conn, l.address)
+			}, &wg)
+			// The server stops along with any of its listeners
+			cancel()
+		}()
+	}
+	serving.Wait()
+
+	slog.Info("Shutting down server")
+	notifier.notify("STOPPING=1")
+	s.killSessions()
+	wg.Wait()
+	return nil
+}
+
+// responsive reports whether the server can still take the locks every
+// connection needs within timeout, which it can't once deadlocked.
+func (s *Server) responsive(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.mu.RLock()
+		s.mu.RUnlock()
+		s.sessionsMu.Lock()
+		s.sessionsMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serve accepts connections until the listener is closed, handling each
+// of them in a goroutine tracked by wg.
+func serve(ctx context.Context, listener net.Listener, handle func(context.Context, net.Conn), wg *sync.WaitGroup) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Running out of file descriptors is transient, wait for some
+			// connections to close instead of giving up
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				slog.Warn("Error accepting connection, retrying", "delay", backoff, "err", err)
+				time.Sleep(backoff)
+				continue
+			}
+			slog.Error("Error accepting connection, shutting down server", "err", err)
+			return
+		}
+		backoff = 0
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(ctx, conn)
+		}()
+	}
+}
+
+// handshakeTimeout bounds the TLS handshake, the negotiation and the
+// authentication of a client, up to its request.
+const handshakeTimeout = 30 * time.Second
+
+// remoteHost returns the address of the clients connecting over the
+// network, or an empty string for the local ones.
+func remoteHost(conn net.Conn) string {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// negotiate reads the client preamble and hello, and answers with the
+// negotiated protocol version and features. The challenge, if any, is
+// sent to the clients able to answer it.
+func negotiate(conn net.Conn, frames *protocol.FrameWriter, challenge []byte) (*protocol.Hello, error) {
+	version, err := protocol.ReadPreamble(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading protocol preamble: %w", err)
+	}
+	hello := &protocol.Hello{Version: version, Features: protocol.LegacyFeatures}
+	if version >= 2 {
+		clientHello, err := protocol.ReadHello(conn)
+		if err != nil {
+			return nil, fmt.Errorf("reading client hello: %w", err)
+		}
+		hello = clientHello.Negotiate()
+		if hello.Has(protocol.FeatureAuth) {
+			hello.Challenge = challenge
+		}
+		if err := frames.WriteHello(hello); err != nil {
+			return nil, fmt.Errorf("sending server hello: %w", err)
+		}
+	}
+	slog.Debug("Negotiated protocol", "version", hello.Version, "features", hello.Features)
+	return hello, nil
+}
+
+// rejectClient denies a client before its request is served, for reason
+// in the audit log and message for the client.
+func (s *Server) rejectClient(frames *protocol.FrameWriter, peer Peer, reason, message string) {
+	s.stats.denied.Add(1)
+	s.audit.denied(peer, &protocol.Command{}, reason)
+	frames.WriteError(protocol.ErrorDenied, message)
+}
+
+// errSessionDone and errClientGone tell how serving a client ended.
+var (
+	errSessionDone = errors.New("session done")
+	errClientGone  = errors.New("client gone")
+)
+
+// handleConnection serves a client connection, accepted on the listener of
+// that address. The connection is owned by the sessionClient wrapping it,
+// which closes it once.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, listener string) {
+	client := newSessionClient(conn)
+	defer client.close()
+	frames := client.frames
+
+	// Unblock the connection when the server shuts down
+	stop := context.AfterFunc(ctx, func() {
+		client.close()
+	})
+	defer stop()
+	cfg := s.Config()
+
+	trace := s.tracer.start("connection")
+	defer trace.finish()
+
+	// Identify the client process, for the session list and the audit log.
+	// The channels of a multiplexed connection belong to its client.
+	peer, err := connectionPeer(conn)
+	if err != nil {
+		slog.Warn("Error reading client credentials", "err", err)
+	}
+	switch c := conn.(type) {
+	case *muxConn:
+		peer = c.peer
+	case *bridgeConn:
+		peer = c.peer
+	}
+	peer.listener = listener
+	uid := peer.UID
+	trace.set("client.uid", uid)
+	logger := slog.With("peer_uid", uid)
+	if addr := conn.RemoteAddr(); addr.Network() != "unix" {
+		logger = logger.With("remote_addr", addr.String())
+	}
+	logger.Info("Client connected", "peer_gid", peer.GID, "peer_pid", peer.PID)
+
+	// Network clients share the UID of nobody, turn away the addresses
+	// connecting too often before even the TLS handshake
+	rateKey := fmt.Sprintf("uid %d", uid)
+	_, multiplexed := conn.(*muxConn)
+	rateChecked := false
+	if host := remoteHost(conn); host != "" {
+		rateKey = "addr " + host
+		if cfg.RateLimit > 0 && !multiplexed {
+			rateChecked = true
+			if !s.limiter.allow(rateKey, cfg.RateLimit, cfg.RateBurstSize()) {
+				logger.Warn("Rejecting client, its address connects too often")
+				return
+			}
+		}
+	}
+
+	// Bound the handshake, so clients that never finish it don't hold
+	// the connection, until the request arrives
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// Verify the certificate of TLS clients before anything else, its
+	// name is checked once they can be told the outcome
+	var certificate *x509.Certificate
+	overTLS := false
+	authenticated := false
+	clientName := ""
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.HandshakeContext(ctx); err != nil {
+			logger.Warn("Rejecting client, TLS handshake failed", "err", err)
+			return
+		}
+		// The clients only present a certificate with tls_ca, or with
+		// the listener of the caller
+		overTLS = true
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			certificate = certs[0]
+		}
+	case *transport.QUICStreamConn:
+		// The handshake is done with the connection
+		overTLS = true
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			certificate = certs[0]
+		}
+	case *sshConn:
+		// The SSH frontend already authenticated the client by its key
+		authenticated = true
+		clientName = c.name
+	case *muxConn:
+		// The multiplexed connection was already authenticated
+		authenticated = true
+		clientName = c.client
+	}
+	if clientName != "" {
+		logger = logger.With("client", clientName)
+		trace.set("client.name", clientName)
+	}
+
+	// Negotiate the protocol version and features with the client, along
+	// with a challenge when it has to prove it knows a token
+	var challenge []byte
+	if cfg.TokenFile != "" && !authenticated {
+		challenge = newChallenge()
+	}
+	hello, err := negotiate(conn, frames, challenge)
+	if err != nil {
+		logger.Error("Error negotiating with the client", "err", err)
+		trace.fail(err)
+		return
+	}
+	client.closeReason = hello.Has(protocol.FeatureCloseReason)
+	client.outputLimit = hello.Has(protocol.FeatureOutputLimit)
+
+	// Turn away the users connecting too often, before doing anything
+	// costly for them
+	if cfg.RateLimit > 0 && !rateChecked && !s.limiter.allow(rateKey, cfg.RateLimit, cfg.RateBurstSize()) {
+		logger.Warn("Rejecting client, it connects too often", "peer_pid", peer.PID)
+		protocol.ReadFrame(conn)
+		frames.WriteError(protocol.ErrorRateLimited, "too many connections, try again later")
+		return
+	}
+
+	// Only serve the allowed users, before reading anything else
+	if !cfg.PeerAllowed(peer) {
+		logger.Warn("Rejecting client, its user and groups are not allowed", "peer_gid", peer.GID, "peer_pid", peer.PID)
+		// Let the request arrive unread, so the client gets the error
+		// instead of a reset connection
+		protocol.ReadFrame(conn)
+		s.rejectClient(frames, peer, "user not allowed", "user not allowed to use this server")
+		return
+	}
+	if overTLS && certificate == nil && cfg.TLSCA != "" {
+		logger.Warn("Rejecting client, it presented no certificate")
+		protocol.ReadFrame(conn)
+		s.rejectClient(frames, peer, "no client certificate", "a client certificate is required")
+		return
+	}
+	if certificate != nil {
+		name, err := cfg.AuthorizeCertificate(certificate)
+		if err != nil {
+			logger.Warn("Rejecting client, its certificate is not allowed", "names", certificateNames(certificate))
+			protocol.ReadFrame(conn)
+			s.rejectClient(frames, peer, err.Error(), err.Error())
+			return
+		}
+		clientName = name
+		logger = logger.With("client", name)
+		trace.set("client.name", name)
+	}
+	if challenge != nil {
+		// Clients unable to answer the challenge go straight to their
+		// request
+		var proof []byte
+		if hello.Challenge != nil {
+			frameType, payload, err := protocol.ReadFrame(conn)
+			if err != nil {
+				logger.Warn("Client left without answering the challenge", "err", err)
+				return
+			}
+			if frameType != protocol.FrameAuth {
+				logger.Warn("Rejecting client, expected its authentication", "frame_type", frameType)
+				frames.WriteError(protocol.ErrorInvalid, "expected the answer to the challenge")
+				return
+			}
+			proof = payload
+		}
+		name, err := cfg.Authenticate(challenge, proof)
+		if err != nil {
+			// The request follows, let it arrive unread as well
+			protocol.ReadFrame(conn)
+		}
+		switch {
+		case errors.Is(err, errMissingToken) || errors.Is(err, errInvalidToken):
+			logger.Warn("Rejecting client, authentication failed", "peer_gid", peer.GID, "peer_pid", peer.PID, "err", err)
+			s.rejectClient(frames, peer, err.Error(), err.Error())
+			return
+		case err != nil:
+			logger.Error("Error reading the token file", "err", err)
+			s.rejectClient(frames, peer, "token file unreadable", "unable to authenticate the client")
+			return
+		}
+		if name != "" {
+			clientName = name
+			logger = logger.With("client", name)
+			trace.set("client.name", name)
+		}
+		logger.Debug("Client authenticated")
+	}
+
+	// Read the request from the client, either a new command or a session
+	// to reattach to
+	frameType, payload, err := protocol.ReadFrame(conn)
+	if err != nil {
+		logger.Error("Failed to read command", "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var session *Session
+	offset := int64(-1)
+	watch := false
+	switch frameType {
+	case protocol.FrameRequest:
+		logger.Debug("Received command", "request", string(payload))
+		cmdStruct, err := protocol.DecodeRequest(payload)
+		if err != nil {
+			logger.Error("Error decoding command", "err", err)
+			frames.WriteError(protocol.ErrorInvalid, "invalid command request")
+			return
+		}
+		session, err = s.startSession(cfg, cmdStruct, peer, trace)
+		if err != nil {
+			trace.fail(err)
+			var errMsg *protocol.ErrorMessage
+			if errors.As(err, &errMsg) {
+				if errMsg.Code == protocol.ErrorDenied {
+					s.stats.denied.Add(1)
+					s.audit.denied(peer, cmdStruct, errMsg.Message)
+				}
+				logger.Warn("Rejecting command", "err", err)
+				frames.WriteError(errMsg.Code, errMsg.Message)
+				return
+			}
+			logger.Error("Error starting shell", "err", err)
+			frames.WriteExit(protocol.ExitCommandNotFound)
+			return
+		}
+	case protocol.FrameAttach:
+		var attach protocol.Attach
+		if err := json.Unmarshal(payload, &attach); err != nil {
+			logger.Error("Error decoding attach request", "err", err)
+			frames.WriteError(protocol.ErrorInvalid, "invalid attach request")
+			return
+		}
+		session = s.Session(attach.ID)
+		if session == nil {
+			logger.Warn("Attach request for unknown session", "session", attach.ID)
+			frames.WriteError(protocol.ErrorNotFound, "no such session: "+attach.ID)
+			return
+		}
+		if attach.Token != "" && !session.validToken(attach.Token) {
+			session.log.Warn("Denying resume request with an invalid token", "peer_uid", uid)
+			frames.WriteError(protocol.ErrorDenied, "invalid token for session "+attach.ID)
+			return
+		}
+		// The token of the session proves the client started it, else only
+		// the users allowed to manage it may attach or watch
+		if attach.Token == "" && !canManage(peer, session) {
+			session.log.Warn("Denying attach request", "peer_uid", uid, "watch", attach.Watch)
+			verb := "attach to"
+			if attach.Watch {
+				verb = "watch"
+			}
+			frames.WriteError(protocol.ErrorDenied, "not allowed to "+verb+" session "+attach.ID)
+			return
+		}
+		offset = attach.Offset
+		watch = attach.Watch
+		switch {
+		case watch:
+			session.log.Info("Client watching session", "peer_uid", uid)
+		case attach.Token != "":
+			session.log.Info("Client resuming session", "peer_uid", uid, "offset", offset)
+		default:
+			session.log.Info("Client reattaching to session", "peer_uid", uid)
+		}
+	case protocol.FrameList:
+		if err := frames.WriteJSON(protocol.FrameList, s.peerSessions(peer)); err != nil {
+			logger.Error("Error sending the session list", "err", err)
+		}
+		return
+	case protocol.FrameAllowlist:
+		if err := frames.WriteJSON(protocol.FrameAllowlist, cfg.ForPeer(peer).Allowlist()); err != nil {
+			logger.Error("Error sending the allowlist", "err", err)
+		}
+		return
+	case protocol.FramePing:
+		if err := frames.WriteFrame(protocol.FramePong, payload); err != nil {
+			logger.Error("Error answering the ping", "err", err)
+		}
+		return
+	case protocol.FrameAdmin:
+		var req protocol.AdminRequest
+		if err := json.Unmarshal(payload, &req); err != nil || !slices.Contains(remoteAdminOps, req.Op) {
+			frames.WriteError(protocol.ErrorInvalid, "only the status and stop admin operations are accepted here, the others on the admin socket")
+			return
+		}
+		if uid != 0 && !peer.serverUser {
+			logger.Warn("Denying admin request", "op", req.Op)
+			frames.WriteError(protocol.ErrorDenied, "only root and the server user may manage the server")
+			return
+		}
+		logger.Info("Admin request", "op", req.Op)
+		s.answerAdmin(frames, &req)
+		return
+	case protocol.FrameInfo:
+		if err := frames.WriteJSON(protocol.FrameInfo, s.info(cfg.ForPeer(peer))); err != nil {
+			logger.Error("Error sending the server info", "err", err)
+		}
+		return
+	case protocol.FrameKill:
+		var kill protocol.Kill
+		if err := json.Unmarshal(payload, &kill); err != nil {
+			logger.Error("Error decoding kill request", "err", err)
+			frames.WriteError(protocol.ErrorInvalid, "invalid kill request")
+			return
+		}
+		session = s.Session(kill.ID)
+		if session == nil {
+			frames.WriteError(protocol.ErrorNotFound, "no such session: "+kill.ID)
+			return
+		}
+		if !canManage(peer, session) {
+			session.log.Warn("Denying kill request", "peer_uid", uid)
+			frames.WriteError(protocol.ErrorDenied, "not allowed to kill session "+kill.ID)
+			return
+		}
+		session.log.Info("Killing session on client request", "peer_uid", uid)
+		if err := frames.WriteJSON(protocol.FrameKill, s.killSession(session)); err != nil {
+			logger.Error("Error acknowledging the kill request", "err", err)
+		}
+		return
+	case protocol.FrameMux:
+		if _, ok := conn.(*protocol.MuxChannel); ok {
+			logger.Error("Rejecting a nested multiplexed connection")
+			frames.WriteError(protocol.ErrorInvalid, "multiplexed connections can't be nested")
+			return
+		}
+		s.serveMux(ctx, client, hello, cfg, peer, clientName, logger)
+		return
+	default:
+		logger.Error("Expected a command request", "frame_type", frameType)
+		return
+	}
+
+	var info *protocol.SessionInfo
+	if hello.Has(protocol.FeatureSessions) {
+		info = &protocol.SessionInfo{
+			ID:         session.ID,
+			Name:       session.Name,
+			NoPTY:      session.NoPTY,
+			Persistent: session.OnDisconnect == protocol.OnDisconnectKeep,
+		}
+	}
+	if hello.Has(protocol.FeatureKeepalive) {
+		client.keepalive = protocol.NewKeepalive(cfg.KeepaliveInterval, cfg.KeepaliveTimeout)
+	}
+	if info != nil && hello.Has(protocol.FeatureResume) && !watch && cfg.ResumeTimeout > 0 {
+		client.resumable = true
+		info.Token = session.token
+	}
+	if watch {
+		if info != nil {
+			frames.WriteJSON(protocol.FrameSession, info)
+		}
+		err = session.watch(client)
+	} else {
+		err = session.attach(client, offset, info)
+	}
+	if err != nil {
+		session.log.Error("Error attaching to session", "peer_uid", uid, "err", err)
+		return
+	}
+
+	if watch {
+		defer session.detach(client)
+	}
+
+	// Serve the client until the command exits or the client goes away,
+	// whichever happens first stops the other
+	var detached bool
+	group, groupCtx := errgroup.WithContext(ctx)
+	stopGroup := context.AfterFunc(groupCtx, func() {
+		client.close()
+	})
+	defer stopGroup()
+	group.Go(func() error {
+		detached = session.handleInput(client)
+		return errClientGone
+	})
+	group.Go(func() error {
+		if err := client.keepalive.Run(groupCtx, client.frames); err != nil {
+			session.log.Warn("Client unresponsive, closing the connection", "timeout", cfg.KeepaliveTimeout)
+			client.lost.Store(true)
+			return errClientGone
+		}
+		return nil
+	})
+	group.Go(func() error {
+		select {
+		case <-session.done:
+			return errSessionDone
+		case <-groupCtx.Done():
+			return nil
+		}
+	})
+
+	if err := group.Wait(); errors.Is(err, errSessionDone) {
+		if !watch && session.isCollected() {
+			s.removeSession(session)
+		}
+	} else {
+		if detached || watch {
+			return
+		}
+		if wasAttached := session.detach(client); !wasAttached {
+			return
+		}
+		if client.resumable && client.lost.Load() && session.OnDisconnect != protocol.OnDisconnectKeep {
+			session.awaitResume(cfg.ResumeTimeout, killGracePeriod)
+			return
+		}
+		session.disconnected(killGracePeriod)
+		if session.OnDisconnect == protocol.OnDisconnectKeep {
+			return
+		}
+	}
+	logger.Info("Connection closed")
+}
+
+// defaultMaxMuxChannels bounds the channels of a multiplexed connection
+// without max_sessions.
+const defaultMaxMuxChannels = 256
+
+// muxConn is a channel of a multiplexed connection, belonging to its
+// client.
+type muxConn struct {
+	*protocol.MuxChannel
+	peer   Peer
+	client string
+}
+
+// serveMux serves the channels of a multiplexed connection as connections
+// of their own, until it's closed.
+func (s *Server) serveMux(ctx context.Context, client *sessionClient, hello *protocol.Hello, cfg *Config, peer Peer, clientName string, logger *slog.Logger) {
+	if err := client.frames.WriteFrame(protocol.FrameMux, nil); err != nil {
+		logger.Error("Error acknowledging the multiplexed connection", "err", err)
+		return
+	}
+	logger.Info("Client multiplexing its connections")
+	m := protocol.NewMux(client.conn, client.frames, func(ch *protocol.MuxChannel) {
+		go s.handleConnection(ctx, &muxConn{ch, peer, clientName}, peer.listener)
+	})
+	if hello.Has(protocol.FeatureKeepalive) {
+		m.Alive = protocol.NewKeepalive(cfg.KeepaliveInterval, cfg.KeepaliveTimeout)
+	}
+	// Each channel may run a session, and buffers what the client sends
+	m.MaxChannels = cfg.MaxSessions
+	if m.MaxChannels == 0 {
+		m.MaxChannels = defaultMaxMuxChannels
+	}
+	aliveCtx, stopAlive := context.WithCancel(ctx)
+	defer stopAlive()
+	go func() {
+		if err := m.Alive.Run(aliveCtx, client.frames); err != nil {
+			logger.Warn("Client unresponsive, closing the multiplexed connection", "timeout", cfg.KeepaliveTimeout)
+			client.close()
+		}
+	}()
+	m.Run()
+	logger.Info("Multiplexed connection closed")
+}
+
+// startSession validates the command and runs it in a new session. The
+// errors due to the request are returned as *ErrorMessage.
+func (s *Server) startSession(cfg *Config, cmdStruct *protocol.Command, peer Peer, trace *span) (*Session, error) {
+	received := time.Now()
+	if s.draining.Load() {
+		return nil, &protocol.ErrorMessage{Code: protocol.ErrorUnavailable, Message: "the server is draining, not accepting new commands"}
+	}
+	if len(cmdStruct.Command) == 0 {
+		return nil, &protocol.ErrorMessage{Code: protocol.ErrorInvalid, Message: "no command provided"}
+	}
+	if cmdStruct.Timeout < 0 {
+		return nil, &protocol.ErrorMessage{Code: protocol.ErrorInvalid, Message: "negative timeout"}
+	}
+	timeout := time.Duration(cmdStruct.Timeout * float64(time.Second))
+	authorize := trace.child("authorize")
+	defer authorize.finish()
+	cfg = cfg.ForPeer(peer)
+
+	dir, err := s.checkCommand(cfg, cmdStruct, peer, authorize)
+	if err != nil {
+		authorize.fail(err)
+		return nil, err
+	}
+	authorize.set("command", strings.Join(cmdStruct.Command, " "))
+
+	// Pick what happens when the client goes away
+	onDisconnect := cmdStruct.OnDisconnect
+	if onDisconnect == "" && cmdStruct.Persistent {
+		onDisconnect = protocol.OnDisconnectKeep
+	}
+	if onDisconnect == "" {
+		onDisconnect = cfg.OnDisconnect
+	}
+	if !protocol.ValidOnDisconnect(onDisconnect) {
+		return nil, &protocol.ErrorMessage{Code: protocol.ErrorInvalid, Message: "unknown on-disconnect policy: " + onDisconnect}
+	}
+	if !cfg.onDisconnectAllowed(onDisconnect) {
+		err := &protocol.ErrorMessage{Code: protocol.ErrorDenied, Message: "on-disconnect policy " + onDisconnect + " is not allowed"}
+		authorize.fail(err)
+		return nil, err
+	}
+	authorize.finish()
+
+	// Execute the command
+	cmd := exec.Command(cmdStruct.Command[0], cmdStruct.Command[1:]...)
+	if cmdStruct.Login && runtime.GOOS != "windows" {
+		cmd.Args[0] = "-" + filepath.Base(cmd.Args[0])
+	}
+
+	env := terminalEnv(os.Environ(), cmdStruct)
+	if cfg.ForwardLocale {
+		env = localeEnv(env, cmdStruct)
+	}
+	cmd.Env = append(env, cmdStruct.Env...)
+
+	cmd.Dir = dir
+
+	// Set the process attributes
+	setProcessAttributes(cmd)
+
+	session := &Session{
+		ID:           newSessionID(),
+		token:        newSessionToken(),
+		Name:         cmdStruct.Name,
+		Command:      cmdStruct.Command,
+		StartedAt:    time.Now(),
+		NoPTY:        cmdStruct.NoPTY,
+		OnDisconnect: onDisconnect,
+		UID:          peer.UID,
+		peer:         peer,
+		reportUsage:  cmdStruct.Usage,
+		cmd:          cmd,
+		stats:        s.stats,
+		trace:        trace,
+		done:         make(chan struct{}),
+	}
+	session.lastActive.Store(session.StartedAt.UnixNano())
+	session.maxOutput, session.onOutputLimit = int64(cfg.MaxOutput), cfg.OnOutputLimit
+	session.log = slog.With("session", session.ID, "uid", peer.UID, "command", strings.Join(session.Command, " "))
+	if session.Name != "" {
+		session.log = session.log.With("name", session.Name)
+	}
+	if !cmdStruct.NoPTY {
+		session.width, session.height = cmdStruct.Width, cmdStruct.Height
+	}
+
+	// Reserve the session name and a slot before starting anything
+	if err := s.addSession(session, cfg.MaxSessions, cfg.MaxUserSessions); err != nil {
+		return nil, err
+	}
+
+	// Record the session output for auditing
+	if cfg.RecordDir != "" {
+		session.recorder, err = newRecorder(cfg.RecordDir, session, session.width, session.height, cmd.Env)
+		if err != nil {
+			session.log.Error("Error recording session, running it unrecorded", "err", err)
+		}
+	}
+
+	// Connect the command to a pty or, if requested, to plain pipes
+	setup := trace.child("stdio setup")
+	setup.set("pty", !cmdStruct.NoPTY)
+	if cmdStruct.NoPTY {
+		session.stdio, err = pipeIO(cmd, session, session.log)
+	} else {
+		session.stdio, err = ptyIO(cmd, session, cmdStruct, session.log)
+	}
+	setup.fail(err)
+	setup.finish()
+	if err != nil {
+		s.removeSession(session)
+		if session.recorder != nil {
+			session.recorder.Close()
+		}
+		close(session.done)
+		return nil, err
+	}
+
+	// Start the shell process
+	session.execSpan = trace.child("exec")
+	err = cmd.Start()
+	session.stdio.closeChildFiles()
+	if err != nil {
+		session.execSpan.fail(err)
+		session.execSpan.finish()
+		session.stdio.release()
+		s.removeSession(session)
+		if session.recorder != nil {
+			session.recorder.Close()
+		}
+		// Release whoever is killing or waiting for the session meanwhile
+		close(session.done)
+		return nil, err
+	}
+	if err := adoptProcess(cmd.Process); err != nil {
+		session.log.Warn("Error tying the command to the server", "err", err)
+	}
+	session.setState(protocol.SessionRunning)
+	s.stats.sessionStarted(time.Since(received))
+	session.log.Info("Session started", "pid", session.PID())
+	session.execSpan.set("session.id", session.ID)
+	session.execSpan.set("pid", session.PID())
+	s.audit.started(session)
+	s.busStarted(session)
+	if cfg.IdleTimeout > 0 {
+		go session.watchIdle(cfg.IdleTimeout)
+	}
+	if cfg.MaxDuration > 0 {
+		go session.limitDuration(cfg.MaxDuration, "max_duration")
+	}
+	if timeout > 0 {
+		go session.limitDuration(timeout, "timeout")
+	}
+	go func() {
+		session.wait()
+		s.stats.sessionFinished(time.Since(session.StartedAt))
+		s.audit.exited(session)
+		s.busEnded(session)
+		s.checkDrained()
+
+		// Keep the session around for a while if nobody got its exit code
+		if !session.isCollected() {
+			time.AfterFunc(exitedSessionTTL, func() {
+				s.removeSession(session)
+			})
+		}
+	}()
+
+	return session, nil
+}
+
+// terminalEnv replaces TERM and COLORTERM in env, the environment of the
+// server, with the ones of the client of cmdStruct. Clients not sending
+// them keep the ones of the server.
+func terminalEnv(env []string, cmdStruct *protocol.Command) []string {
+	if cmdStruct.Term == "" {
+		return env
+	}
+	env = slices.DeleteFunc(slices.Clone(env), func(variable string) bool {
+		return strings.HasPrefix(variable, "TERM=") || strings.HasPrefix(variable, "COLORTERM=")
+	})
+	env = append(env, "TERM="+cmdStruct.Term)
+	if cmdStruct.ColorTerm != "" {
+		env = append(env, "COLORTERM="+cmdStruct.ColorTerm)
+	}
+	return env
+}
+
+// localeEnv replaces the locale variables in env, the environment of the
+// server, with the ones of the client of cmdStruct. Clients not sending
+// any keep the ones of the server.
+func localeEnv(env []string, cmdStruct *protocol.Command) []string {
+	if len(cmdStruct.Locale) == 0 {
+		return env
+	}
+	env = slices.DeleteFunc(slices.Clone(env), func(variable string) bool {
+		name, _, _ := strings.Cut(variable, "=")
+		return protocol.IsLocaleVariable(name)
+	})
+	for _, variable := range cmdStruct.Locale {
+		// Values with a slash are paths to locale files, which the client
+		// has no business picking
+		name, value, ok := strings.Cut(variable, "=")
+		if !ok || !protocol.IsLocaleVariable(name) || strings.ContainsAny(value, "/\x00") {
+			slog.Warn("Ignoring invalid locale variable", "variable", variable)
+			continue
+		}
+		env = append(env, variable)
+	}
+	return env
+}
+
+// Session returns the live session with the given ID or name, or nil.
+func (s *Server) Session(ref string) *Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if session, ok := s.sessions[ref]; ok {
+		return session
+	}
+	for _, session := range s.sessions {
+		if session.Name != "" && session.Name == ref {
+			return session
+		}
+	}
+	return nil
+}
+
+// checkCommand translates the paths of a command, resolves its aliases and
+// checks it against the configuration and the policies, which may change
+// it. It returns the directory to run it in, empty for the one of the
+// server. The errors are returned as *ErrorMessage.
+func (s *Server) checkCommand(cfg *Config, cmdStruct *protocol.Command, peer Peer, authorize *span) (string, error) {
+	// Translate the client paths to the host ones
+	cmdStruct.Command = cfg.TranslateArgs(cmdStruct.Command)
+	cmdStruct.Cwd = cfg.TranslatePath(cmdStruct.Cwd)
+
+	// Commands sent with a relative path, as ./build.sh, run from the
+	// working directory: make them absolute so that the checks look at the
+	// binary that actually runs
+	cwd := cmdStruct.Cwd
+	dir := workDir(cwd)
+	cmdStruct.Command[0] = absCommand(cmdStruct.Command[0], dir)
+
+	// Resolve aliases and check if the command is allowed, or let polkit
+	// decide for the ones outside of the allowlist
+	command, err := cfg.ResolveCommand(cmdStruct.Command)
+	switch {
+	case errors.Is(err, errNotAllowed) && cfg.Polkit != "":
+		err = polkitCheck(cfg, peer, command, authorize)
+	case (err == nil || errors.Is(err, errNotAllowed)) && s.Approver != nil && !cfg.Allowlisted(command[0]):
+		// When asking, only the commands explicitly allowed run without
+		// asking
+		err = s.Approver.Approve(peer, command)
+	}
+	if err != nil {
+		return "", &protocol.ErrorMessage{Code: protocol.ErrorDenied, Message: err.Error()}
+	}
+	cmdStruct.Command = command
+	cmdStruct.Env = cfg.FilterEnv(cmdStruct.Env)
+
+	// Let the Rego policy and then the authorization hook have the last
+	// word, and possibly change the command
+	if cfg.RegoPolicy != "" {
+		err = consult("Rego policy", func(req *HookRequest) (*HookResponse, error) {
+			return evalRego(cfg.OPA, cfg.RegoPolicy, req)
+		}, cmdStruct, peer, authorize)
+	}
+	if err == nil && cfg.AuthHook != "" {
+		err = consult("authorization hook", func(req *HookRequest) (*HookResponse, error) {
+			return runAuthHook(cfg.AuthHook, req)
+		}, cmdStruct, peer, authorize)
+	}
+	if err != nil {
+		return "", &protocol.ErrorMessage{Code: protocol.ErrorDenied, Message: err.Error()}
+	}
+
+	// The policies may have moved the command elsewhere, and given it a
+	// relative path from there
+	if cmdStruct.Cwd != cwd {
+		dir = workDir(cmdStruct.Cwd)
+	}
+	cmdStruct.Command[0] = absCommand(cmdStruct.Command[0], dir)
+	return dir, nil
+}
+
+// workDir returns the directory to run a command sent from cwd in: cwd if
+// the host has it, else an empty string for the one of the server.
+func workDir(cwd string) string {
+	if cwd == "" {
+		return ""
+	}
+	if info, err := os.Stat(cwd); err != nil || !info.IsDir() {
+		slog.Warn("Working directory not found on the host, using the server one", "cwd", cwd)
+		return ""
+	}
+	return cwd
+}
+
+// absCommand returns the absolute path of a command given with a relative
+// one, as ./build.sh, from dir or, if empty, from the one of the server.
+// Names without a path are left to the PATH lookup.
+func absCommand(name, dir string) string {
+	if filepath.Base(name) == name || filepath.IsAbs(name) {
+		return name
+	}
+	if dir != "" {
+		return filepath.Join(dir, name)
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// addSession registers a session, failing if its name is taken by a live
+// one or if it would run more than maxSessions sessions, or more than
+// maxUserSessions for its user. Exited sessions give their name up to the
+// new one. Zero limits are ignored.
+func (s *Server) addSession(session *Session, maxSessions, maxUserSessions int) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	running, userRunning := 0, 0
+	for _, other := range s.sessions {
+		if other.hasExited() {
+			continue
+		}
+		running++
+		if other.UID == session.UID {
+			userRunning++
+		}
+	}
+	if maxSessions > 0 && running >= maxSessions {
+		return &protocol.ErrorMessage{Code: protocol.ErrorBusy, Message: fmt.Sprintf("the server is busy, %d sessions are running", running)}
+	}
+	if maxUserSessions > 0 && userRunning >= maxUserSessions {
+		return &protocol.ErrorMessage{Code: protocol.ErrorBusy, Message: fmt.Sprintf("too many sessions, %d of yours are running", userRunning)}
+	}
+	if session.Name != "" {
+		for id, other := range s.sessions {
+			if other.Name != session.Name && other.ID != session.Name {
+				continue
+			}
+			if !other.hasExited() {
+				return &protocol.ErrorMessage{Code: protocol.ErrorConflict, Message: "session name already in use: " + session.Name}
+			}
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+// killSession terminates a session and forgets it, returning its final
+// status.
+func (s *Server) killSession(session *Session) protocol.SessionStatus {
+	session.kill(killGracePeriod)
+	s.removeSession(session)
+	return session.status()
+}
+
+// drain stops accepting new commands, the server shuts down once the
+// running ones exited. It returns how many are still running.
+func (s *Server) drain() int {
+	s.draining.Store(true)
+	slog.Info("Draining, new commands are refused")
+	return s.runningSessions()
+}
+
+// terminateSessions terminates the running commands, telling their
+// clients the reason.
+func (s *Server) terminateSessions(reason string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, session := range s.sessions {
+		go session.terminate(reason, syscall.SIGTERM, syscall.SIGKILL)
+	}
+}
+
+// checkDrained shuts a draining server down if no command is running
+// anymore.
+func (s *Server) checkDrained() {
+	if s.draining.Load() && s.runningSessions() == 0 && s.shutdown != nil {
+		slog.Info("Server drained, shutting down")
+		s.shutdown()
+	}
+}
+
+// runningSessions counts the sessions whose command didn't exit yet.
+func (s *Server) runningSessions() int {
+	running := 0
+	for _, status := range s.listSessions() {
+		if !status.Exited {
+			running++
+		}
+	}
+	return running
+}
+
+// listSessions returns the status of every session, oldest first.
+func (s *Server) listSessions() []protocol.SessionStatus {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	list := make([]protocol.SessionStatus, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, session.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+// peerSessions returns the status of the sessions the client user may
+// manage, oldest first.
+func (s *Server) peerSessions(p Peer) []protocol.SessionStatus {
+	return slices.DeleteFunc(s.listSessions(), func(status protocol.SessionStatus) bool {
+		return !canManageUID(p, status.UID)
+	})
+}
+
+// info describes the server to a client whose configuration is cfg.
+func (s *Server) info(cfg *Config) *protocol.ServerInfo {
+	build := protocol.ReadBuild()
+	info := &protocol.ServerInfo{
+		Version:     build.Version,
+		Commit:      build.Commit,
+		BuildDate:   build.Date,
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Protocol:    protocol.ProtocolVersion,
+		MinProtocol: protocol.MinProtocolVersion,
+		Features:    protocol.SupportedFeatures,
+		Enabled:     cfg.Enabled(),
+		Limits:      cfg.Limits(),
+	}
+	if s.Approver != nil {
+		info.Enabled = append(info.Enabled, "confirm")
+	}
+	return info
+}
+
+func (s *Server) removeSession(session *Session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.sessions, session.ID)
+}
+
+// killSessions kills every running command, used on shutdown.
+func (s *Server) killSessions() {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, session := range s.sessions {
+		for _, pid := range session.processTree() {
+			signalProcess(pid, syscall.SIGKILL)
+		}
+		session.signal(syscall.SIGKILL)
+	}
+}
+
+// canManage reports whether the client user may act on a session it may
+// not have started: root, the server user and the session owner can.
+func canManage(p Peer, session *Session) bool {
+	return canManageUID(p, session.UID)
+}
+
+// canManageUID reports whether the client user may act on the sessions of
+// the user uid.
+func canManageUID(p Peer, uid int) bool {
+	if p.serverUser {
+		return true
+	}
+	if p.UID < 0 {
+		return false
+	}
+	return p.UID == 0 || p.UID == uid
+}
+
+// exitCode converts the result of cmd.Wait into a shell-style exit code.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
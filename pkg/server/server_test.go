@@ -0,0 +1,83 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// writeHook writes an authorization hook answering decision to every
+// request, and returns its path.
+func writeHook(t *testing.T, decision string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a shell script")
+	}
+	hook := filepath.Join(t.TempDir(), "hook")
+	script := "#!/bin/sh\ncat >/dev/null\necho '" + decision + "'\n"
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestCheckCommandDirectory(t *testing.T) {
+	clientDir := t.TempDir()
+	hookDir := t.TempDir()
+	tests := []struct {
+		name     string
+		command  []string
+		decision string
+		wantDir  string
+		wantArg0 string
+	}{
+		{
+			name:     "client directory",
+			command:  []string{"./build.sh"},
+			decision: `{"allow": true}`,
+			wantDir:  clientDir,
+			wantArg0: filepath.Join(clientDir, "build.sh"),
+		},
+		{
+			name:     "hook directory",
+			command:  []string{"ls"},
+			decision: `{"allow": true, "cwd": "` + hookDir + `"}`,
+			wantDir:  hookDir,
+			wantArg0: "ls",
+		},
+		{
+			name:     "hook command in the hook directory",
+			command:  []string{"ls"},
+			decision: `{"allow": true, "argv": ["bin/tool"], "cwd": "` + hookDir + `"}`,
+			wantDir:  hookDir,
+			wantArg0: filepath.Join(hookDir, "bin", "tool"),
+		},
+		{
+			name:     "checked command in the hook directory",
+			command:  []string{"./build.sh"},
+			decision: `{"allow": true, "cwd": "` + hookDir + `"}`,
+			wantDir:  hookDir,
+			wantArg0: filepath.Join(clientDir, "build.sh"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AuthHook = writeHook(t, test.decision)
+			cmdStruct := &protocol.Command{Command: test.command, Cwd: clientDir}
+			dir, err := (&Server{}).checkCommand(cfg, cmdStruct, Peer{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dir != test.wantDir {
+				t.Errorf("directory = %q, want %q", dir, test.wantDir)
+			}
+			if cmdStruct.Command[0] != test.wantArg0 {
+				t.Errorf("command = %q, want %q", cmdStruct.Command[0], test.wantArg0)
+			}
+		})
+	}
+}
@@ -0,0 +1,734 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+const (
+	// outputBufferSize bounds the output kept for clients reattaching to
+	// a session, older output is dropped first
+	outputBufferSize = 1 << 20
+
+	// killGracePeriod is how long a session being killed has to exit
+	// after SIGTERM before it gets SIGKILL
+	killGracePeriod = 5 * time.Second
+
+	// exitedSessionTTL is how long a session that exited while no client
+	// was attached is kept around, so its output and exit code can still
+	// be collected
+	exitedSessionTTL = 10 * time.Minute
+
+	// outputDrainTimeout bounds how long the server waits for the
+	// remaining output after the command exited
+	outputDrainTimeout = 2 * time.Second
+)
+
+// What happens to a command once its output reached the server limit.
+const (
+	// OutputLimitTruncate drops the rest of the output, leaving the command
+	// running
+	OutputLimitTruncate = "truncate"
+	// OutputLimitKill terminates the command as well
+	OutputLimitKill = "kill"
+)
+
+// Session is a command running on the host. Its output is buffered, so it
+// can outlive the client that started it and be reattached later.
+type Session struct {
+	ID        string
+	Name      string
+	Command   []string
+	StartedAt time.Time
+	NoPTY     bool
+	// OnDisconnect is what happens to the command when its client goes
+	// away, one of the OnDisconnect policies
+	OnDisconnect string
+	// UID is the user ID of the client that started the session, -1 when
+	// unknown
+	UID int
+	// peer is the client process that started the session
+	peer Peer
+	// token lets clients that lost their connection resume the session
+	token string
+	// reportUsage sends the resource usage to the client at the end
+	reportUsage bool
+	// maxOutput bounds the output sent for the command, unlimited when
+	// zero, onOutputLimit is one of the OutputLimit actions applied past it
+	maxOutput     int64
+	onOutputLimit string
+
+	cmd   *exec.Cmd
+	stdio *commandIO
+	// recorder keeps the output in an asciicast file, if enabled
+	recorder *recorder
+	// stats are the server counters, updated with the traffic
+	stats *serverStats
+	// inputBytes is the amount of input sent to the command
+	inputBytes atomic.Int64
+	// lastActive is when the session last had input or output, in Unix
+	// nanoseconds
+	lastActive atomic.Int64
+	// log adds the session, its owner and its command to the log lines
+	log *slog.Logger
+	// trace is the span of the connection that started the session,
+	// execSpan the one of the running command
+	trace    *span
+	execSpan *span
+	// done is closed once the command exited and its output was drained
+	done chan struct{}
+
+	mu       sync.Mutex
+	client   *sessionClient
+	watchers map[*sessionClient]struct{}
+	output   []outputChunk
+	buffered int
+	// produced is the amount of output since the start, sent is how much
+	// of it reached the last attached client
+	produced int64
+	sent     int64
+	state    protocol.SessionState
+	exitCode int
+	usage    *protocol.Usage
+	width    uint16
+	height   uint16
+	// reason is why the server terminated the command, if it did
+	reason string
+	// truncated is set once the output reached maxOutput
+	truncated bool
+	// attaches counts the clients that attached, telling whether one came
+	// back while waiting for a resume
+	attaches int
+}
+
+// sessionClient is a client connection attached to a session.
+type sessionClient struct {
+	conn   net.Conn
+	frames *protocol.FrameWriter
+	// readOnly clients only watch the output
+	readOnly bool
+	// closeReason clients are told why the server terminated the command
+	closeReason bool
+	// outputLimit clients are told when the output is truncated
+	outputLimit bool
+	// keepalive pings the client, nil when it doesn't support it
+	keepalive *protocol.Keepalive
+	// resumable clients can come back once their connection is lost
+	resumable bool
+	// lost is set once the connection failed, rather than being closed
+	lost atomic.Bool
+	// close closes the connection, it is safe to call more than once
+	close func() error
+}
+
+func newSessionClient(conn net.Conn) *sessionClient {
+	return &sessionClient{
+		conn:   conn,
+		frames: protocol.NewFrameWriter(conn),
+		close:  sync.OnceValue(conn.Close),
+	}
+}
+
+// outputChunk is a frame of output kept for reattaching clients.
+type outputChunk struct {
+	offset    int64
+	frameType byte
+	data      []byte
+}
+
+// newSessionID returns a random session identifier.
+func newSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// newSessionToken returns a random secret resuming a session.
+func newSessionToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// validToken reports whether token is the one of the session.
+func (s *Session) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// WriteFrame buffers a frame of output and sends it to the attached
+// client, if any. It never fails, so the output keeps being drained when
+// the client goes away.
+func (s *Session) WriteFrame(frameType byte, payload []byte) error {
+	s.lastActive.Store(time.Now().UnixNano())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Past the limit the output is dropped, the command still has to be
+	// drained
+	if s.truncated {
+		return nil
+	}
+	if s.maxOutput > 0 && s.produced+int64(len(payload)) > s.maxOutput {
+		payload = payload[:s.maxOutput-s.produced]
+		defer s.truncate()
+	}
+	data := append([]byte(nil), payload...)
+
+	s.stats.bytesOut.Add(int64(len(data)))
+	s.output = append(s.output, outputChunk{offset: s.produced, frameType: frameType, data: data})
+	s.produced += int64(len(data))
+	s.buffered += len(data)
+	for s.buffered > outputBufferSize && len(s.output) > 1 {
+		s.buffered -= len(s.output[0].data)
+		s.output = s.output[1:]
+	}
+
+	if s.recorder != nil && (frameType == protocol.FrameData || frameType == protocol.FrameStderr) {
+		if err := s.recorder.Output(data); err != nil {
+			s.log.Error("Error recording session, stopping the recording", "err", err)
+			s.recorder.Close()
+			s.recorder = nil
+		}
+	}
+
+	if s.client != nil {
+		if err := s.client.frames.WriteFrame(frameType, data); err != nil {
+			s.log.Warn("Session lost its client", "err", err)
+			s.client = nil
+			return nil
+		}
+		s.sent = s.produced
+	}
+	for watcher := range s.watchers {
+		if err := watcher.frames.WriteFrame(frameType, data); err != nil {
+			s.log.Warn("Session lost a watcher", "err", err)
+			delete(s.watchers, watcher)
+		}
+	}
+	return nil
+}
+
+// truncate tells the clients the output reached the limit, terminating
+// the command if the limit action says so. The caller holds s.mu.
+func (s *Session) truncate() {
+	s.truncated = true
+	killed := s.onOutputLimit == OutputLimitKill
+	s.log.Warn("Session output reached the limit, truncating it", "max_output", s.maxOutput, "killed", killed)
+	truncated := &protocol.Truncated{Limit: s.maxOutput, Killed: killed}
+	if s.client != nil && s.client.outputLimit {
+		s.client.frames.WriteJSON(protocol.FrameTruncated, truncated)
+	}
+	for watcher := range s.watchers {
+		if watcher.outputLimit {
+			watcher.frames.WriteJSON(protocol.FrameTruncated, truncated)
+		}
+	}
+	if killed {
+		go s.terminate(fmt.Sprintf("output reached the limit of %s, terminated", protocol.FormatBytes(s.maxOutput)), syscall.SIGTERM, syscall.SIGKILL)
+	}
+}
+
+// attach makes the connection the session client, replaying the output
+// after offset, or after what the previous client received when offset
+// is negative. A client already attached is disconnected. The info, when
+// given, is sent first along with where the replayed output starts.
+func (s *Session) attach(client *sessionClient, offset int64, info *protocol.SessionInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		s.log.Info("Session taken over by a new client")
+		// Tell the previous client, so it doesn't take the session back
+		// as it would after losing its connection
+		go func(previous *sessionClient) {
+			previous.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			previous.frames.WriteError(protocol.ErrorConflict, "session taken over by another client")
+			previous.close()
+		}(s.client)
+		s.client = nil
+	}
+
+	// The output before the buffer was dropped
+	if offset < 0 {
+		offset = s.sent
+	}
+	if len(s.output) > 0 && offset < s.output[0].offset {
+		offset = s.output[0].offset
+	}
+	offset = min(offset, s.produced)
+	if info != nil {
+		info.Offset = offset
+		if err := client.frames.WriteJSON(protocol.FrameSession, info); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range s.output {
+		end := chunk.offset + int64(len(chunk.data))
+		if end <= offset {
+			continue
+		}
+		data := chunk.data
+		if chunk.offset < offset {
+			data = data[offset-chunk.offset:]
+		}
+		if err := client.frames.WriteFrame(chunk.frameType, data); err != nil {
+			return err
+		}
+	}
+
+	s.client = client
+	s.attaches++
+	s.sent = s.produced
+	if s.state == protocol.SessionClosed {
+		if err := client.frames.WriteExit(s.exitCode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch adds a read-only client to the session, replaying the buffered
+// output so it starts from the same screen.
+func (s *Session) watch(client *sessionClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, chunk := range s.output {
+		if err := client.frames.WriteFrame(chunk.frameType, chunk.data); err != nil {
+			return err
+		}
+	}
+
+	client.readOnly = true
+	if s.state == protocol.SessionClosed {
+		if err := client.frames.WriteExit(s.exitCode); err != nil {
+			return err
+		}
+	}
+	if s.watchers == nil {
+		s.watchers = make(map[*sessionClient]struct{})
+	}
+	s.watchers[client] = struct{}{}
+	return nil
+}
+
+// detach removes the client from the session, reporting whether it was
+// still the attached one.
+func (s *Session) detach(client *sessionClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if client.readOnly {
+		_, ok := s.watchers[client]
+		delete(s.watchers, client)
+		return ok
+	}
+	if s.client != client {
+		return false
+	}
+	s.client = nil
+	return true
+}
+
+// handleInput dispatches the frames sent by the client until it
+// disconnects, reporting whether it detached on purpose.
+func (s *Session) handleInput(client *sessionClient) bool {
+	for {
+		frameType, payload, err := protocol.ReadFrame(client.conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.log.Error("Error reading from the client", "err", err)
+				client.lost.Store(true)
+			}
+			return false
+		}
+		client.keepalive.Seen()
+
+		// Watchers can only answer pings and leave
+		switch {
+		case frameType == protocol.FramePing:
+			client.frames.WritePong(payload)
+			continue
+		case frameType == protocol.FramePong:
+			continue
+		case client.readOnly && frameType != protocol.FrameDetach:
+			continue
+		}
+
+		switch frameType {
+		case protocol.FrameData:
+			s.stats.bytesIn.Add(int64(len(payload)))
+			s.inputBytes.Add(int64(len(payload)))
+			s.lastActive.Store(time.Now().UnixNano())
+			s.stdio.queueInput(inputChunk{data: payload}, client.keepalive)
+		case protocol.FrameEOF:
+			s.stdio.queueInput(inputChunk{eof: true}, client.keepalive)
+		case protocol.FrameResize:
+			width, height, err := protocol.DecodeResize(payload)
+			if err != nil {
+				s.log.Error("Error decoding resize request", "err", err)
+				continue
+			}
+			if s.stdio.resize == nil {
+				continue
+			}
+			if err := s.stdio.resize(width, height); err != nil {
+				s.log.Error("Error resizing PTY", "err", err)
+			} else {
+				s.mu.Lock()
+				s.width, s.height = width, height
+				if s.recorder != nil && width > 0 && height > 0 {
+					s.recorder.Resize(width, height)
+				}
+				s.mu.Unlock()
+				s.log.Debug("Terminal resized", "width", width, "height", height)
+			}
+		case protocol.FrameSignal:
+			sig, ok := protocol.ForwardedSignals[string(payload)]
+			if !ok {
+				s.log.Warn("Ignoring unknown signal", "signal", string(payload))
+				continue
+			}
+			s.log.Info("Forwarding signal to the command", "signal", string(payload))
+			if err := s.signal(sig); err != nil {
+				s.log.Error("Error delivering signal", "signal", string(payload), "err", err)
+			}
+		case protocol.FrameDetach:
+			// Stop sending output before acknowledging, so nothing is
+			// lost between the acknowledgement and the disconnection
+			s.detach(client)
+			client.frames.WriteFrame(protocol.FrameDetach, nil)
+			s.log.Info("Client detached, leaving the command running")
+			return true
+		default:
+			s.log.Warn("Ignoring unexpected frame", "frame_type", frameType)
+		}
+	}
+}
+
+// PID returns the process ID of the command, 0 until it started.
+func (s *Session) PID() int {
+	if s.State() == protocol.SessionNegotiating {
+		return 0
+	}
+	return s.cmd.Process.Pid
+}
+
+// ref returns how clients can refer to the session, preferring its name.
+func (s *Session) ref() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.ID
+}
+
+// signal delivers a signal to the process group of the command, as long
+// as it is running: once reaped, its process group ID may be reused.
+func (s *Session) signal(sig syscall.Signal) error {
+	if s.State() != protocol.SessionRunning {
+		return nil
+	}
+	return signalProcessGroup(s.cmd.Process.Pid, sig)
+}
+
+// processTree returns the descendants of the command, including those
+// that left its process group, as long as it is running.
+func (s *Session) processTree() []int {
+	if s.State() != protocol.SessionRunning {
+		return nil
+	}
+	return descendants(s.cmd.Process.Pid)
+}
+
+// disconnected applies the on-disconnect policy once the client went away.
+// Unless the session is kept, the whole process tree is hung up and, with
+// OnDisconnectKill, whatever survives SIGHUP gets SIGTERM and then SIGKILL
+// after the grace period.
+func (s *Session) disconnected(grace time.Duration) {
+	switch s.OnDisconnect {
+	case protocol.OnDisconnectKeep:
+		s.log.Info("Client went away, keeping the command running")
+	case protocol.OnDisconnectHup:
+		s.stdio.closeInput()
+		go s.stop(grace, syscall.SIGHUP)
+	default:
+		s.stdio.closeInput()
+		go s.stop(grace, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL)
+	}
+}
+
+// awaitResume gives the client that lost its connection up to timeout to
+// resume the session, applying the on-disconnect policy if it doesn't.
+func (s *Session) awaitResume(timeout, grace time.Duration) {
+	s.mu.Lock()
+	attaches := s.attaches
+	s.mu.Unlock()
+	s.log.Info("Client connection lost, waiting for it to resume", "timeout", timeout)
+	go func() {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(timeout):
+		}
+		s.mu.Lock()
+		resumed := s.attaches != attaches
+		s.mu.Unlock()
+		if !resumed {
+			s.log.Info("Client didn't resume the session")
+			s.disconnected(grace)
+		}
+	}()
+}
+
+// watchIdle hangs up the command once the session had no input nor output
+// for the timeout, then escalates like a disconnection would, freeing what
+// forgotten shells hold.
+func (s *Session) watchIdle(timeout time.Duration) {
+	for {
+		idle := time.Since(time.Unix(0, s.lastActive.Load()))
+		if idle >= timeout {
+			break
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(timeout - idle):
+		}
+	}
+	s.terminate(fmt.Sprintf("session idle for %s, terminated", timeout), syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL)
+}
+
+// limitDuration terminates the command once the session ran for
+// maxDuration, set by the named setting, with SIGTERM and then SIGKILL.
+// Clients are told it timed out.
+func (s *Session) limitDuration(maxDuration time.Duration, setting string) {
+	select {
+	case <-s.done:
+	case <-time.After(time.Until(s.StartedAt.Add(maxDuration))):
+		s.log.Info("Session ran out of time", setting, maxDuration)
+		s.terminate(protocol.CloseTimeout, syscall.SIGTERM, syscall.SIGKILL)
+	}
+}
+
+// terminate stops the command on behalf of the server, telling the
+// clients the reason once it exited.
+func (s *Session) terminate(reason string, signals ...syscall.Signal) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+	s.log.Info("Terminating session", "reason", reason)
+	s.stdio.closeInput()
+	s.stop(killGracePeriod, signals...)
+}
+
+// kill terminates the command and its descendants with SIGTERM, escalating
+// to SIGKILL after the grace period, and waits for the session to be done.
+func (s *Session) kill(grace time.Duration) {
+	s.stop(grace, syscall.SIGTERM, syscall.SIGKILL)
+}
+
+// stop sends each signal in turn to the whole process tree of the command,
+// moving to the next one if some process is still alive after the grace
+// period, and waits for the session to be done.
+func (s *Session) stop(grace time.Duration, signals ...syscall.Signal) {
+	var tree []int
+	for i, sig := range signals {
+		if i > 0 {
+			s.log.Info("Session still running, escalating", "sent", signalString(signals[i-1]), "sending", signalString(sig))
+		}
+		tree = appendMissing(tree, s.processTree())
+		s.signal(sig)
+		for _, pid := range tree {
+			signalProcess(pid, sig)
+		}
+		if s.waitTree(tree, grace) {
+			break
+		}
+	}
+	<-s.done
+}
+
+// waitTree waits up to timeout for the command and the given processes to
+// exit, reporting whether they all did.
+func (s *Session) waitTree(tree []int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if s.hasExited() && !anyAlive(tree) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func anyAlive(pids []int) bool {
+	for _, pid := range pids {
+		if processAlive(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendMissing appends the PIDs of more not already in pids.
+func appendMissing(pids, more []int) []int {
+	for _, pid := range more {
+		found := false
+		for _, known := range pids {
+			if known == pid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// State returns the current lifecycle stage of the session.
+func (s *Session) State() protocol.SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Session) setState(state protocol.SessionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// wait waits for the command to exit, drains its output and closes the
+// session. The goroutine running it owns the session resources, nothing
+// else releases them.
+func (s *Session) wait() {
+	code := exitCode(s.cmd.Wait())
+	usage := commandUsage(s.cmd)
+	s.log.Info("Session exited", "code", code, "user_seconds", usage.UserSeconds, "system_seconds", usage.SystemSeconds, "max_rss_kib", usage.MaxRSS)
+	s.mu.Lock()
+	s.usage = usage
+	s.mu.Unlock()
+	s.execSpan.set("exit_code", code)
+	s.execSpan.finish()
+	s.setState(protocol.SessionDraining)
+
+	// Drain the remaining output before reporting the exit code
+	teardown := s.trace.child("teardown")
+	defer teardown.finish()
+	s.stdio.drain(outputDrainTimeout)
+	s.close(code)
+}
+
+// commandUsage returns the resources used by an exited command.
+func commandUsage(cmd *exec.Cmd) *protocol.Usage {
+	usage := &protocol.Usage{}
+	if cmd.ProcessState == nil {
+		return usage
+	}
+	usage.UserSeconds = cmd.ProcessState.UserTime().Seconds()
+	usage.SystemSeconds = cmd.ProcessState.SystemTime().Seconds()
+	usage.MaxRSS = maxRSS(cmd.ProcessState)
+	return usage
+}
+
+// close reports the exit code to the clients, releases the session
+// resources and marks the session as closed.
+func (s *Session) close(code int) {
+	s.stdio.release()
+
+	s.mu.Lock()
+	s.state = protocol.SessionClosed
+	s.exitCode = code
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			s.log.Error("Error closing the recording", "err", err)
+		}
+		s.recorder = nil
+	}
+	if s.client != nil {
+		if s.reportUsage && s.usage != nil {
+			s.client.frames.WriteJSON(protocol.FrameUsage, s.usage)
+		}
+		if s.reason != "" && s.client.closeReason {
+			s.client.frames.WriteFrame(protocol.FrameClose, []byte(s.reason))
+		}
+		if err := s.client.frames.WriteExit(code); err != nil {
+			s.log.Error("Error sending exit code", "err", err)
+		}
+	}
+	for watcher := range s.watchers {
+		if s.reason != "" && watcher.closeReason {
+			watcher.frames.WriteFrame(protocol.FrameClose, []byte(s.reason))
+		}
+		watcher.frames.WriteExit(code)
+	}
+	s.mu.Unlock()
+
+	close(s.done)
+}
+
+// status returns a snapshot of the session for listing.
+func (s *Session) status() protocol.SessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Listed sessions may still be negotiating, without a process yet
+	pid := 0
+	if s.state != protocol.SessionNegotiating {
+		pid = s.cmd.Process.Pid
+	}
+	return protocol.SessionStatus{
+		ID:           s.ID,
+		Name:         s.Name,
+		Command:      s.Command,
+		PID:          pid,
+		UID:          s.UID,
+		StartedAt:    s.StartedAt,
+		Width:        s.width,
+		Height:       s.height,
+		NoPTY:        s.NoPTY,
+		Persistent:   s.OnDisconnect == protocol.OnDisconnectKeep,
+		OnDisconnect: s.OnDisconnect,
+		State:        s.state.String(),
+		Attached:     s.client != nil,
+		Watchers:     len(s.watchers),
+		Exited:       s.state == protocol.SessionClosed,
+		ExitCode:     s.exitCode,
+	}
+}
+
+// hasExited reports whether the command exited.
+func (s *Session) hasExited() bool {
+	return s.State() >= protocol.SessionDraining
+}
+
+// isCollected reports whether the exit code reached a client, so the
+// session can be forgotten.
+func (s *Session) isCollected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == protocol.SessionClosed && s.client != nil
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// sshHandshakeTimeout bounds the SSH handshake, so clients that never
+// complete it don't hold a connection.
+const sshHandshakeTimeout = 30 * time.Second
+
+// sshFeatures are the features the SSH frontend asks the server for.
+var sshFeatures = []string{
+	protocol.FeatureResize,
+	protocol.FeatureExitCode,
+	protocol.FeatureSplitStderr,
+	protocol.FeatureNoPTY,
+	protocol.FeatureEnv,
+	protocol.FeatureSignals,
+	protocol.FeatureCloseReason,
+	protocol.FeatureOutputLimit,
+}
+
+// sshConn is the server end of an SSH session channel, bridged to the hrun
+// protocol. The client is already authenticated by its key.
+type sshConn struct {
+	net.Conn
+	remote net.Addr
+	// name identifies the client, the comment of its key or its user
+	name string
+}
+
+func (c *sshConn) RemoteAddr() net.Addr { return c.remote }
+
+// Read reports the pipe closed here as net.ErrClosed, as other
+// connections do.
+func (c *sshConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+// sshListener is a small SSH server: clients authenticate with a key of
+// the authorized keys file, and each of their exec or shell sessions is
+// accepted as an hrun connection, served as any other.
+type sshListener struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	conns    chan net.Conn
+	done     chan struct{}
+	close    func() error
+}
+
+// listenSSH listens for SSH connections on a TCP address, with the host
+// key and the authorized keys of cfg.
+func listenSSH(address string, cfg *Config) (net.Listener, error) {
+	hostKey, err := loadSSHHostKey(cfg.SSHHostKey)
+	if err != nil {
+		return nil, err
+	}
+	authorizedKeys := cfg.SSHAuthorizedKeys
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return authorizeSSHKey(authorizedKeys, meta, key)
+		},
+		ServerVersion: "SSH-2.0-hrun",
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &sshListener{
+		listener: listener,
+		config:   config,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	l.close = sync.OnceValue(func() error {
+		close(l.done)
+		return l.listener.Close()
+	})
+	go l.acceptConnections()
+	return l, nil
+}
+
+// loadSSHHostKey reads the private host key in path, as written by
+// ssh-keygen.
+func loadSSHHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// authorizeSSHKey accepts the keys listed in the authorized keys file at
+// path, read on every attempt so keys are added and revoked without a
+// reload. The comment of the key names the client.
+func authorizeSSHKey(path string, meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Error reading the SSH authorized keys", "err", err)
+		return nil, err
+	}
+	for len(data) > 0 {
+		authorized, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			if comment == "" {
+				comment = meta.User()
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"name": comment}}, nil
+		}
+	}
+	return nil, errors.New("SSH key not authorized")
+}
+
+func (l *sshListener) acceptConnections() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Error accepting SSH connection", "err", err)
+				l.close()
+			}
+			return
+		}
+		go l.serveConnection(conn)
+	}
+}
+
+// serveConnection completes the SSH handshake and serves the session
+// channels of the client, each of them running a command.
+func (l *sshListener) serveConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, l.config)
+	if err != nil {
+		slog.Warn("Rejecting SSH client, handshake failed", "remote_addr", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	name := serverConn.Permissions.Extensions["name"]
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			slog.Warn("Error accepting SSH channel", "err", err)
+			continue
+		}
+		session := &sshSession{
+			listener: l,
+			channel:  channel,
+			requests: requests,
+			remote:   serverConn.RemoteAddr(),
+			name:     name,
+		}
+		go session.serve()
+	}
+}
+
+func (l *sshListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sshListener) Close() error   { return l.close() }
+func (l *sshListener) Addr() net.Addr { return l.listener.Addr() }
+
+// sshSession bridges an SSH session channel to an hrun connection, acting
+// as the client of the server.
+type sshSession struct {
+	listener *sshListener
+	channel  ssh.Channel
+	requests <-chan *ssh.Request
+	remote   net.Addr
+	name     string
+}
+
+// Payloads of the SSH channel requests, as defined by RFC 4254.
+type (
+	sshPtyRequest struct {
+		Term          string
+		Columns, Rows uint32
+		Width, Height uint32
+		Modes         string
+	}
+	sshWindowChange struct {
+		Columns, Rows uint32
+		Width, Height uint32
+	}
+	sshEnvRequest struct {
+		Name, Value string
+	}
+	sshExecRequest struct {
+		Command string
+	}
+	sshSignalRequest struct {
+		Signal string
+	}
+	sshExitStatus struct {
+		Status uint32
+	}
+)
+
+func (s *sshSession) serve() {
+	defer s.channel.Close()
+
+	// Gather the terminal and the environment until the client asks for
+	// a command or a shell
+	cmd := protocol.Command{NoPTY: true}
+	for started := false; !started; {
+		req, ok := <-s.requests
+		if !ok {
+			return
+		}
+		accepted := true
+		switch req.Type {
+		case "pty-req":
+			var pty sshPtyRequest
+			if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+				accepted = false
+				break
+			}
+			cmd.NoPTY = false
+			cmd.Width, cmd.Height = uint16(pty.Columns), uint16(pty.Rows)
+			cmd.Term = pty.Term
+		case "env":
+			var env sshEnvRequest
+			if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+				accepted = false
+				break
+			}
+			cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+		case "exec":
+			var exec sshExecRequest
+			var err error
+			if err = ssh.Unmarshal(req.Payload, &exec); err == nil {
+				cmd.Command, err = SplitCommandLine(exec.Command)
+			}
+			if err != nil || len(cmd.Command) == 0 {
+				accepted = false
+				break
+			}
+			started = true
+		case "shell":
+			shell := os.Getenv("SHELL")
+			if shell == "" {
+				shell = "/bin/sh"
+			}
+			cmd.Command = []string{"sh", "-c", shell}
+			started = true
+		default:
+			accepted = false
+		}
+		if req.WantReply {
+			req.Reply(accepted, nil)
+		}
+	}
+
+	// Hand the server end of a pipe to the server, and speak the hrun
+	// protocol on the other one
+	serverEnd, conn := net.Pipe()
+	defer conn.Close()
+	select {
+	case s.listener.conns <- &sshConn{Conn: serverEnd, remote: s.remote, name: s.name}:
+	case <-s.listener.done:
+		serverEnd.Close()
+		return
+	}
+	frames := protocol.NewFrameWriter(conn)
+	if err := protocol.WritePreamble(conn); err != nil {
+		return
+	}
+	if err := frames.WriteHello(&protocol.Hello{Version: protocol.ProtocolVersion, Features: sshFeatures}); err != nil {
+		return
+	}
+	if _, err := protocol.ReadHello(conn); err != nil {
+		return
+	}
+	if err := frames.WriteRequest(&cmd); err != nil {
+		return
+	}
+
+	go s.forwardRequests(frames)
+	go func() {
+		if err := protocol.CopyToFrames(frames, protocol.FrameData, s.channel); err == nil {
+			frames.WriteFrame(protocol.FrameEOF, nil)
+		}
+	}()
+	s.channel.SendRequest("exit-status", false, ssh.Marshal(&sshExitStatus{Status: uint32(s.forwardOutput(conn))}))
+}
+
+// forwardRequests forwards the resizes and the signals of the client.
+func (s *sshSession) forwardRequests(frames *protocol.FrameWriter) {
+	for req := range s.requests {
+		accepted := true
+		switch req.Type {
+		case "window-change":
+			var size sshWindowChange
+			if err := ssh.Unmarshal(req.Payload, &size); err != nil {
+				accepted = false
+				break
+			}
+			frames.WriteResize(uint16(size.Columns), uint16(size.Rows))
+		case "signal":
+			var signal sshSignalRequest
+			if err := ssh.Unmarshal(req.Payload, &signal); err != nil {
+				accepted = false
+				break
+			}
+			frames.WriteFrame(protocol.FrameSignal, []byte(signal.Signal))
+		default:
+			accepted = false
+		}
+		if req.WantReply {
+			req.Reply(accepted, nil)
+		}
+	}
+}
+
+// forwardOutput copies the output of the command to the channel, and
+// returns its exit code.
+func (s *sshSession) forwardOutput(conn net.Conn) int {
+	stderr := s.channel.Stderr()
+	for {
+		frameType, payload, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return protocol.ExitConnectionError
+		}
+		switch frameType {
+		case protocol.FrameData:
+			s.channel.Write(payload)
+		case protocol.FrameStderr:
+			stderr.Write(payload)
+		case protocol.FrameError:
+			var errMsg protocol.ErrorMessage
+			json.Unmarshal(payload, &errMsg)
+			fmt.Fprintf(stderr, "hrun: %s\r\n", errMsg.Message)
+			return protocol.ExitConnectionError
+		case protocol.FrameClose:
+			fmt.Fprintf(stderr, "hrun: %s\r\n", payload)
+		case protocol.FrameTruncated:
+			var truncated protocol.Truncated
+			json.Unmarshal(payload, &truncated)
+			fmt.Fprintf(stderr, "hrun: output truncated after %s\r\n", protocol.FormatBytes(truncated.Limit))
+		case protocol.FrameExit:
+			code, err := protocol.DecodeExit(payload)
+			if err != nil {
+				return protocol.ExitConnectionError
+			}
+			s.channel.CloseWrite()
+			return code
+		}
+	}
+}
+
+// SplitCommandLine splits the command line of an exec request into its
+// arguments, honoring quotes and backslashes. No shell is involved, so the
+// allowlist applies to the actual command.
+func SplitCommandLine(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
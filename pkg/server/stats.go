@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// serverStats counts what the server did since it started, updated from
+// the sessions and their connections.
+type serverStats struct {
+	started  time.Time
+	sessions atomic.Int64
+	finished atomic.Int64
+	denied   atomic.Int64
+	// bytesIn is the input sent to the commands, bytesOut their output
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// runTime is the total run time of the finished sessions
+	runTime atomic.Int64
+
+	// startLatency is the time taken to start the commands, from their
+	// request to the running process, durations their run time
+	startLatency *histogram
+	durations    *histogram
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		started:      time.Now(),
+		startLatency: newHistogram(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1),
+		durations:    newHistogram(0.1, 1, 10, 60, 300, 1800, 3600, 14400, 86400),
+	}
+}
+
+// sessionStarted records how long a command took to start.
+func (st *serverStats) sessionStarted(latency time.Duration) {
+	st.sessions.Add(1)
+	st.startLatency.observe(latency.Seconds())
+}
+
+// sessionFinished records the run time of a session whose command exited.
+func (st *serverStats) sessionFinished(runTime time.Duration) {
+	st.finished.Add(1)
+	st.runTime.Add(int64(runTime))
+	st.durations.observe(runTime.Seconds())
+}
+
+// snapshot returns the current values of the counters.
+func (st *serverStats) snapshot(active int) *protocol.Stats {
+	stats := &protocol.Stats{
+		StartedAt:      st.started,
+		Sessions:       st.sessions.Load(),
+		ActiveSessions: active,
+		DeniedCommands: st.denied.Load(),
+		BytesIn:        st.bytesIn.Load(),
+		BytesOut:       st.bytesOut.Load(),
+	}
+	if finished := st.finished.Load(); finished > 0 {
+		stats.AverageSessionSeconds = time.Duration(st.runTime.Load() / finished).Seconds()
+	}
+	return stats
+}
+
+// histogram counts observations in cumulative buckets, like Prometheus
+// histograms.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+)
+
+// inputQueueSize is the number of input frames buffered while the
+// command isn't reading its stdin.
+const inputQueueSize = 64
+
+// commandIO tracks the server side of a command's standard streams.
+type commandIO struct {
+	log *slog.Logger
+
+	// childFiles are the ends handed to the command, closed in the server
+	// once the command has started
+	childFiles []*os.File
+	// files are the server ends, closed by release once the session is
+	// over. Nothing else closes them.
+	files []io.Closer
+	// outputs are closed once the matching output stream is fully sent
+	outputs []chan struct{}
+
+	// stdin receives the client input, written from the input queue
+	stdin     io.Writer
+	input     chan inputChunk
+	closed    chan struct{}
+	closeOnce sync.Once
+	// closeStdin ends the command input, it is only set for pipes as a
+	// pty must survive the end of the client input
+	closeStdin func() error
+	// resize applies a new terminal size, nil without a pty
+	resize func(width, height uint16) error
+}
+
+// inputChunk is a piece of client input queued for the command stdin.
+type inputChunk struct {
+	data []byte
+	eof  bool
+}
+
+// forward sends everything read from r as frames of the given type.
+func (c *commandIO) forward(frames protocol.FrameSender, frameType byte, r io.ReadCloser) {
+	done := make(chan struct{})
+	c.outputs = append(c.outputs, done)
+	c.files = append(c.files, r)
+	go func() {
+		protocol.CopyToFrames(frames, frameType, r)
+		close(done)
+	}()
+}
+
+// closeChildFiles releases the server copies of the command ends, so the
+// outputs reach EOF as soon as the command and its children exit.
+func (c *commandIO) closeChildFiles() {
+	for _, f := range c.childFiles {
+		f.Close()
+	}
+}
+
+// drain waits for the remaining output to be sent, giving up after the
+// timeout if a background process keeps a stream open.
+func (c *commandIO) drain(timeout time.Duration) {
+	deadline := time.After(timeout)
+	for _, done := range c.outputs {
+		select {
+		case <-done:
+		case <-deadline:
+			c.log.Warn("Timed out draining output")
+			return
+		}
+	}
+}
+
+// startInput starts writing the queued input to stdin. The input is
+// queued so a command that isn't reading its stdin doesn't hold back the
+// control frames sent by the client.
+func (c *commandIO) startInput() {
+	c.input = make(chan inputChunk, inputQueueSize)
+	c.closed = make(chan struct{})
+	go c.writeInput()
+}
+
+// queueInput queues client input for the command stdin, dropping it if
+// the input was closed in the meantime. Once the queue is full, it waits
+// for the command to read, holding back the frames of the client and so
+// the timeout of its keepalive.
+func (c *commandIO) queueInput(chunk inputChunk, keepalive *protocol.Keepalive) {
+	select {
+	case c.input <- chunk:
+		return
+	case <-c.closed:
+		return
+	default:
+	}
+	defer keepalive.Hold()()
+	select {
+	case c.input <- chunk:
+	case <-c.closed:
+	}
+}
+
+// closeInput stops writing to stdin, discarding the input still queued.
+func (c *commandIO) closeInput() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// release closes the server ends of the streams. It must only be called
+// once the session is over, by its owner.
+func (c *commandIO) release() {
+	c.closeInput()
+	for _, f := range c.files {
+		f.Close()
+	}
+}
+
+// writeInput writes the queued input to the command stdin until the input
+// is closed. For pipes, it is also the only one closing stdin.
+func (c *commandIO) writeInput() {
+	if c.closeStdin != nil {
+		defer c.closeStdin()
+	}
+
+	failed := false
+	for {
+		var chunk inputChunk
+		select {
+		case chunk = <-c.input:
+		case <-c.closed:
+			return
+		}
+		if failed {
+			continue
+		}
+		if chunk.eof {
+			if c.closeStdin != nil {
+				c.closeStdin()
+			}
+			continue
+		}
+		if _, err := c.stdin.Write(chunk.data); err != nil {
+			c.log.Error("Error writing input to the command", "err", err)
+			failed = true
+		}
+	}
+}
+
+// pipeIO connects the command to plain pipes, so binary data isn't
+// mangled by terminal translation. Stdout and stderr are sent as separate
+// frames and stdin is closed once the client input is over.
+func pipeIO(cmd *exec.Cmd, frames protocol.FrameSender, logger *slog.Logger) (*commandIO, error) {
+	stdio := &commandIO{log: logger}
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, err
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		return nil, err
+	}
+
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	stdio.childFiles = []*os.File{stdinReader, stdoutWriter, stderrWriter}
+	stdio.stdin = stdinWriter
+	stdio.closeStdin = sync.OnceValue(stdinWriter.Close)
+	stdio.startInput()
+
+	stdio.forward(frames, protocol.FrameData, stdoutReader)
+	stdio.forward(frames, protocol.FrameStderr, stderrReader)
+
+	return stdio, nil
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package server
+
+import (
+	"log/slog"
+	"log/syslog"
+	"strconv"
+	"strings"
+)
+
+// newSyslogHandler logs to the local syslog daemon, with the attributes
+// appended to the message as key=value pairs.
+func newSyslogHandler(level slog.Leveler) (slog.Handler, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "hrun")
+	if err != nil {
+		return nil, err
+	}
+	return &fieldsHandler{
+		level: level,
+		emit: func(level slog.Level, msg string, fields []slog.Attr) error {
+			line := msg
+			for _, field := range fields {
+				value := field.Value.String()
+				if value == "" || strings.ContainsAny(value, " \"=\n") {
+					value = strconv.Quote(value)
+				}
+				line += " " + field.Key + "=" + value
+			}
+			switch {
+			case level >= slog.LevelError:
+				return writer.Err(line)
+			case level >= slog.LevelWarn:
+				return writer.Warning(line)
+			case level >= slog.LevelInfo:
+				return writer.Info(line)
+			default:
+				return writer.Debug(line)
+			}
+		},
+	}, nil
+}
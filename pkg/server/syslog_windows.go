@@ -0,0 +1,11 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// newSyslogHandler fails, Windows has no syslog daemon.
+func newSyslogHandler(level slog.Leveler) (slog.Handler, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
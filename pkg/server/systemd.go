@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// systemdAdminName is the FileDescriptorName of the admin socket in the
+// socket unit.
+const systemdAdminName = "admin"
+
+// systemdListeners takes over the sockets passed by systemd socket
+// activation, none when the server wasn't activated. The one named admin
+// is the admin socket, the other ones the sockets of the clients. They
+// must be unix sockets, so the clients are identified as on any other.
+func systemdListeners() (listeners []net.Listener, adminListener net.Listener, err error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// The commands must not think they were activated as well
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || count < 1 {
+		return nil, nil, nil
+	}
+
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		if adminListener != nil {
+			adminListener.Close()
+		}
+	}
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("systemd socket %d: %w", listenFdsStart+i, err)
+		}
+		switch {
+		case l.Addr().Network() != "unix":
+			l.Close()
+			closeAll()
+			return nil, nil, fmt.Errorf("systemd socket %s is not a unix socket", l.Addr())
+		case name != systemdAdminName:
+			listeners = append(listeners, l)
+		case adminListener == nil:
+			adminListener = l
+		default:
+			l.Close()
+			closeAll()
+			return nil, nil, errors.New("systemd passed more than one admin socket")
+		}
+	}
+	if len(listeners) == 0 {
+		closeAll()
+		return nil, nil, errors.New("systemd only passed the admin socket")
+	}
+	return listeners, adminListener, nil
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+var errCertificateNotAllowed = errors.New("client certificate not allowed")
+
+// serverTLSConfig returns the TLS settings of the listener, requiring the
+// clients to present a certificate signed by TLSCA when set.
+func (c *Config) serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.TLSCA != "" {
+		if config.ClientCAs, err = transport.LoadCertPool(c.TLSCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certificateNames returns the subject alternative names of a
+// certificate: its DNS names, URIs and email addresses.
+func certificateNames(cert *x509.Certificate) []string {
+	names := slices.Clone(cert.DNSNames)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return append(names, cert.EmailAddresses...)
+}
+
+// AuthorizeCertificate returns the name of the client presenting cert,
+// its first subject alternative name in TLSAllowedNames. Any certificate
+// signed by TLSCA is allowed when TLSAllowedNames is empty.
+func (c *Config) AuthorizeCertificate(cert *x509.Certificate) (string, error) {
+	names := certificateNames(cert)
+	if len(c.TLSAllowedNames) == 0 {
+		if len(names) == 0 {
+			return cert.Subject.CommonName, nil
+		}
+		return names[0], nil
+	}
+	for _, name := range names {
+		if slices.Contains(c.TLSAllowedNames, name) {
+			return name, nil
+		}
+	}
+	return "", errCertificateNotAllowed
+}
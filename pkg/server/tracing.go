@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// traceBatchSize and traceBatchDelay bound how many spans are sent at
+	// once and how long they wait to be sent
+	traceBatchSize  = 256
+	traceBatchDelay = 5 * time.Second
+	// traceQueueSize is how many finished spans can wait for the exporter,
+	// more are dropped rather than slowing the sessions down
+	traceQueueSize = 2048
+)
+
+// tracer exports spans to an OpenTelemetry collector with OTLP over HTTP,
+// in its JSON encoding. A nil tracer records nothing, so the spans can be
+// used whether tracing is configured or not.
+type tracer struct {
+	url    string
+	client *http.Client
+	done   chan struct{}
+
+	// mu guards queue against the spans finished after Close
+	mu     sync.Mutex
+	queue  chan *span
+	closed bool
+}
+
+// newTracer starts exporting spans to the OTLP endpoint, as in
+// http://localhost:4318.
+func newTracer(endpoint string) *tracer {
+	t := &tracer{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *span, traceQueueSize),
+		done:   make(chan struct{}),
+	}
+	go t.export()
+	slog.Info("Exporting traces", "url", t.url)
+	return t
+}
+
+// span is a timed operation of a trace.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	root     bool
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]any
+	err        string
+}
+
+// start begins the root span of a new trace.
+func (t *tracer) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	sp := &span{tracer: t, name: name, root: true, start: time.Now()}
+	rand.Read(sp.traceID[:])
+	rand.Read(sp.spanID[:])
+	return sp
+}
+
+// child begins a span below sp.
+func (sp *span) child(name string) *span {
+	if sp == nil {
+		return nil
+	}
+	child := &span{tracer: sp.tracer, traceID: sp.traceID, parentID: sp.spanID, name: name, start: time.Now()}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+// set adds an attribute to the span, a string, an integer or a boolean.
+func (sp *span) set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.attributes == nil {
+		sp.attributes = make(map[string]any)
+	}
+	sp.attributes[key] = value
+}
+
+// fail marks the span as failed.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.err = err.Error()
+}
+
+// finish ends the span and queues it for export, only the first call
+// counts.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if !sp.end.IsZero() {
+		sp.mu.Unlock()
+		return
+	}
+	sp.end = time.Now()
+	sp.mu.Unlock()
+
+	t := sp.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- sp:
+	default:
+	}
+}
+
+// Close sends the queued spans and stops the exporter.
+func (t *tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-time.After(traceBatchDelay):
+		slog.Warn("Timed out sending the last traces")
+	}
+}
+
+// export sends the finished spans in batches.
+func (t *tracer) export() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceBatchDelay)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case sp, ok := <-t.queue:
+			if !ok {
+				t.send(batch)
+				return
+			}
+			batch = append(batch, sp)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+func (t *tracer) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]map[string]any, 0, len(batch))
+	for _, sp := range batch {
+		spans = append(spans, sp.otlp())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": "hrun"}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "hrun"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		slog.Error("Error encoding traces", "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Error sending traces", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		slog.Error("Error sending traces", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Error("Error sending traces", "status", resp.Status)
+	}
+}
+
+// otlp returns the span in the OTLP JSON encoding.
+func (sp *span) otlp() map[string]any {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	// Root spans serve a client, the others are internal steps
+	kind := 1
+	if sp.root {
+		kind = 2
+	}
+	encoded := map[string]any{
+		"traceId":           hex.EncodeToString(sp.traceID[:]),
+		"spanId":            hex.EncodeToString(sp.spanID[:]),
+		"name":              sp.name,
+		"kind":              kind,
+		"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(sp.attributes),
+	}
+	if !sp.root {
+		encoded["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+	}
+	if sp.err != "" {
+		encoded["status"] = map[string]any{"code": 2, "message": sp.err}
+	}
+	return encoded
+}
+
+func otlpAttributes(attributes map[string]any) []any {
+	encoded := make([]any, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case string:
+			v = map[string]any{"stringValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": v})
+	}
+	return encoded
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/mirkobrombin/hrun/pkg/protocol"
+	"github.com/mirkobrombin/hrun/pkg/transport"
+)
+
+// varlinkServiceInterface describes org.varlink.service, implemented by
+// every varlink service.
+const varlinkServiceInterface = `# The Varlink Service Interface is provided by every varlink service. It
+# describes the service and the interfaces it implements.
+interface org.varlink.service
+
+# Get a list of all the interfaces a service provides and information
+# about the implementation.
+method GetInfo() -> (
+  vendor: string,
+  product: string,
+  version: string,
+  url: string,
+  interfaces: []string
+)
+
+# Get the description of an interface that is implemented by this service.
+method GetInterfaceDescription(interface: string) -> (description: string)
+
+# The requested interface was not found.
+error InterfaceNotFound (interface: string)
+
+# The requested method was not found
+error MethodNotFound (method: string)
+
+# The interface defines the requested method, but the supplied arguments are
+# not supported
+error MethodNotImplemented (method: string)
+
+# One of the passed parameters is invalid.
+error InvalidParameter (parameter: string)
+`
+
+// varlinkExecInterface describes org.hrun.Exec, the interface of hrun.
+const varlinkExecInterface = `# Run commands on the host through hrun.
+interface org.hrun.Exec
+
+# Run runs a command on the host, without a terminal, with stdin as its
+# whole input. Env adds variables to its environment as KEY=VALUE, and
+# timeout terminates it after that many seconds. Token answers the
+# challenge of servers with a token file. Called with more, the output is
+# streamed as it comes and the last reply holds the exit code.
+method Run(
+  command: []string,
+  env: ?[]string,
+  cwd: ?string,
+  stdin: ?string,
+  timeout: ?float,
+  token: ?string
+) -> (stdout: ?string, stderr: ?string, exit_code: ?int)
+
+# The server refused to run the command, code is one of the errors of the
+# hrun protocol as in denied or rate-limited.
+error Refused (code: string, message: string)
+`
+
+// varlinkCall and varlinkReply are the messages of the varlink protocol,
+// each of them followed by a NUL byte.
+type varlinkCall struct {
+	Method     string          `json:"method"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	More       bool            `json:"more,omitempty"`
+	Oneway     bool            `json:"oneway,omitempty"`
+}
+
+type varlinkReply struct {
+	Parameters any    `json:"parameters,omitempty"`
+	Continues  bool   `json:"continues,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// varlinkRun are the parameters of org.hrun.Exec.Run.
+type varlinkRun struct {
+	Command []string `json:"command"`
+	Env     []string `json:"env"`
+	Cwd     string   `json:"cwd"`
+	Stdin   string   `json:"stdin"`
+	Timeout float64  `json:"timeout"`
+	Token   string   `json:"token"`
+}
+
+// varlinkOutput are the replies of org.hrun.Exec.Run.
+type varlinkOutput struct {
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// varlinkListener is a small varlink service on a unix socket, and
+// accepts each call of org.hrun.Exec.Run as an hrun connection, served as
+// any other.
+type varlinkListener struct {
+	listener net.Listener
+	conns    chan net.Conn
+	done     chan struct{}
+	close    func() error
+}
+
+// listenVarlink listens for varlink calls on the unix socket at path.
+func listenVarlink(path string) (net.Listener, error) {
+	listener, err := transport.ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &varlinkListener{
+		listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	l.close = sync.OnceValue(func() error {
+		close(l.done)
+		return l.listener.Close()
+	})
+	go l.acceptConnections()
+	return l, nil
+}
+
+func (l *varlinkListener) acceptConnections() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Error accepting varlink connection", "err", err)
+				l.close()
+			}
+			return
+		}
+		go l.serveConnection(conn)
+	}
+}
+
+func (l *varlinkListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *varlinkListener) Close() error   { return l.close() }
+func (l *varlinkListener) Addr() net.Addr { return l.listener.Addr() }
+
+// serveConnection answers the calls of a client, one after the other.
+func (l *varlinkListener) serveConnection(conn net.Conn) {
+	defer conn.Close()
+	peer, err := connectionPeer(conn)
+	if err != nil {
+		slog.Warn("Error reading varlink client credentials", "err", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := reader.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		var call varlinkCall
+		if err := json.Unmarshal(data[:len(data)-1], &call); err != nil {
+			slog.Warn("Rejecting varlink client, invalid call", "err", err)
+			return
+		}
+		reply := func(r *varlinkReply) error {
+			if call.Oneway {
+				return nil
+			}
+			return writeVarlink(conn, r)
+		}
+		if err := l.handleCall(conn, peer, &call, reply); err != nil {
+			return
+		}
+	}
+}
+
+// writeVarlink writes a message of the varlink protocol.
+func writeVarlink(conn net.Conn, message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(data, 0))
+	return err
+}
+
+// handleCall answers a call with reply, failing when the client is gone.
+func (l *varlinkListener) handleCall(conn net.Conn, peer Peer, call *varlinkCall, reply func(*varlinkReply) error) error {
+	switch call.Method {
+	case "org.varlink.service.GetInfo":
+		return reply(&varlinkReply{Parameters: map[string]any{
+			"vendor":     "hrun",
+			"product":    "hrun",
+			"version":    protocol.BuildVersion(),
+			"url":        "https://github.com/mirkobrombin/hrun",
+			"interfaces": []string{"org.varlink.service", "org.hrun.Exec"},
+		}})
+	case "org.varlink.service.GetInterfaceDescription":
+		var params struct {
+			Interface string `json:"interface"`
+		}
+		json.Unmarshal(call.Parameters, &params)
+		switch params.Interface {
+		case "org.varlink.service":
+			return reply(&varlinkReply{Parameters: map[string]string{"description": varlinkServiceInterface}})
+		case "org.hrun.Exec":
+			return reply(&varlinkReply{Parameters: map[string]string{"description": varlinkExecInterface}})
+		}
+		return reply(&varlinkReply{
+			Error:      "org.varlink.service.InterfaceNotFound",
+			Parameters: map[string]string{"interface": params.Interface},
+		})
+	case "org.hrun.Exec.Run":
+		var params varlinkRun
+		if err := json.Unmarshal(call.Parameters, &params); err != nil || len(params.Command) == 0 {
+			return reply(&varlinkReply{
+				Error:      "org.varlink.service.InvalidParameter",
+				Parameters: map[string]string{"parameter": "command"},
+			})
+		}
+		return l.run(conn, peer, &params, call.More, reply)
+	}
+
+	iface := call.Method[:max(strings.LastIndex(call.Method, "."), 0)]
+	if iface != "org.varlink.service" && iface != "org.hrun.Exec" {
+		return reply(&varlinkReply{
+			Error:      "org.varlink.service.InterfaceNotFound",
+			Parameters: map[string]string{"interface": iface},
+		})
+	}
+	return reply(&varlinkReply{
+		Error:      "org.varlink.service.MethodNotFound",
+		Parameters: map[string]string{"method": call.Method},
+	})
+}
+
+// run bridges a call of org.hrun.Exec.Run to an hrun connection, acting as
+// the client of the server. Without more, the output is gathered in the
+// single reply.
+func (l *varlinkListener) run(client net.Conn, peer Peer, params *varlinkRun, more bool, reply func(*varlinkReply) error) error {
+	refused := func(code, message string) error {
+		return reply(&varlinkReply{
+			Error:      "org.hrun.Exec.Refused",
+			Parameters: map[string]string{"code": code, "message": message},
+		})
+	}
+
+	conn, err := openBridge(l.conns, l.done, client.RemoteAddr(), peer)
+	if err != nil {
+		return refused(protocol.ErrorUnavailable, err.Error())
+	}
+	defer conn.Close()
+	cmd := protocol.Command{
+		Command: params.Command,
+		Env:     params.Env,
+		Cwd:     params.Cwd,
+		Timeout: params.Timeout,
+	}
+	var stdout, stderr strings.Builder
+	code, err := runBatch(conn, params.Token, &cmd, []byte(params.Stdin), func(out, errOut []byte) error {
+		if !more {
+			stdout.Write(out)
+			stderr.Write(errOut)
+			return nil
+		}
+		return reply(&varlinkReply{Parameters: &varlinkOutput{Stdout: string(out), Stderr: string(errOut)}, Continues: true})
+	})
+	var errMsg *protocol.ErrorMessage
+	switch {
+	case errors.As(err, &errMsg):
+		return refused(errMsg.Code, errMsg.Message)
+	case err != nil:
+		return refused(protocol.ErrorUnavailable, err.Error())
+	case more:
+		return reply(&varlinkReply{Parameters: &varlinkOutput{ExitCode: &code}})
+	}
+	return reply(&varlinkReply{Parameters: &varlinkOutput{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: &code}})
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the client key to accept a WebSocket
+// handshake, as defined by RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// terminalPage is the browser terminal served next to the WebSocket
+// endpoint.
+//
+//go:embed web/terminal.html
+var terminalPage []byte
+
+// websocketListener serves the browser terminal over HTTP and accepts the
+// hrun protocol over WebSocket connections to /ws, each binary message
+// carrying a part of the byte stream.
+type websocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	conns    chan net.Conn
+	done     chan struct{}
+	close    func() error
+}
+
+// listenWebSocket listens for WebSocket connections on a TCP address.
+func listenWebSocket(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &websocketListener{
+		listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(terminalPage)
+	})
+	mux.HandleFunc("/ws", l.upgrade)
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	l.close = sync.OnceValue(func() error {
+		close(l.done)
+		return l.server.Close()
+	})
+	go func() {
+		if err := l.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving WebSocket connections", "err", err)
+			l.close()
+		}
+	}()
+	return l, nil
+}
+
+// upgrade turns an HTTP request into a WebSocket connection and hands it
+// over to Accept.
+func (l *websocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	// Other sites must not drive the terminal from the browser of the user
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			slog.Warn("Rejecting WebSocket connection from another origin", "origin", origin)
+			http.Error(w, "cross-origin WebSocket connections are not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("Error taking over the WebSocket connection", "err", err)
+		return
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- &websocketConn{Conn: conn, reader: rw.Reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *websocketListener) Close() error   { return l.close() }
+func (l *websocketListener) Addr() net.Addr { return l.listener.Addr() }
+
+// headerContains reports whether a comma-separated header has the token,
+// ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketConn is the server end of a WebSocket connection, reading the
+// payload of the data messages as a stream and writing binary messages.
+type websocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// remaining is what is left to read of the current data frame, masked
+	// with mask from maskPos on
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+	closed    bool
+
+	writeMu sync.Mutex
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	for i := range p[:n] {
+		p[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next frame, handling the control
+// frames whole.
+func (c *websocketConn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return errors.New("unmasked WebSocket frame from the client")
+	}
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(extended) & (1<<63 - 1))
+	}
+	if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = length
+		return nil
+	}
+
+	// Control frames are small and read whole
+	if length > 125 {
+		return errors.New("WebSocket control frame too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= c.mask[i%4]
+	}
+	switch opcode {
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsClose:
+		c.closed = true
+		c.writeFrame(wsClose, payload)
+	}
+	return nil
+}
+
+// Close sends a normal closure before closing the connection.
+func (c *websocketConn) Close() error {
+	c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return c.Conn.Close()
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single unmasked frame, as servers do.
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(append(header, payload...))
+	return err
+}
@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// MemListener is a listener in memory, whose connections are the ends of
+// the net.Pipe opened by Dial. It serves a server in the same process,
+// like in tests, without creating any socket.
+type MemListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemListener returns a listener in memory, open until closed.
+func NewMemListener() *MemListener {
+	return &MemListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept waits for the next connection opened by Dial.
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener, failing the pending and future calls of
+// Accept and Dial. The connections already accepted stay open.
+func (l *MemListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener, which can't be dialed.
+func (l *MemListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+// Dial opens a connection to the listener, once it accepts it or until ctx
+// is done. It has the signature of the Dial field of a client.
+func (l *MemListener) Dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Err: net.ErrClosed}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// memAddr is the address of a MemListener.
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
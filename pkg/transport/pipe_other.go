@@ -0,0 +1,51 @@
+//go:build !windows
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DefaultSocket returns where the server listens unless told otherwise,
+// one socket per user: in the runtime directory of the user, or named after
+// their UID in /tmp without one.
+func DefaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "hrun", "hrun.sock")
+	}
+	return fmt.Sprintf("/tmp/hrun-%d.sock", os.Getuid())
+}
+
+// CheckSocketOwner fails when the socket at path belongs to another user
+// than the client or root, as another user may create the default socket
+// in /tmp first to get the commands of the client.
+func CheckSocketOwner(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		// Dialing reports it
+		return nil
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if uid := int(stat.Uid); uid != os.Getuid() && uid != 0 {
+		return fmt.Errorf("%s belongs to UID %d, not to this user", path, uid)
+	}
+	return nil
+}
+
+var errPipeUnsupported = errors.New("named pipes are only available on Windows")
+
+func ListenPipe(path string) (net.Listener, error) {
+	return nil, errPipeUnsupported
+}
+
+func dialPipe(path string) (net.Conn, error) {
+	return nil, errPipeUnsupported
+}
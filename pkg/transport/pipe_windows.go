@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultSocket returns where the server listens unless told otherwise,
+// the pipe being only open to the user running the server.
+func DefaultSocket() string {
+	return `\\.\pipe\hrun`
+}
+
+// CheckSocketOwner has nothing to check, the pipe of another user can't be
+// opened.
+func CheckSocketOwner(path string) error {
+	return nil
+}
+
+// pipeBufferSize is the size of the pipe buffers in each direction.
+const pipeBufferSize = 64 * 1024
+
+// pipeDialTimeout bounds the wait for a free pipe instance.
+const pipeDialTimeout = 5 * time.Second
+
+var procGetNamedPipeClientProcessId = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetNamedPipeClientProcessId")
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// PipeConn is a connected instance of a named pipe. The handle is
+// overlapped, which os.NewFile only polls since Go 1.25.
+type PipeConn struct {
+	*os.File
+	addr pipeAddr
+}
+
+func (c *PipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *PipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// ClientPID returns the PID of the client on the other end of the pipe.
+func (c *PipeConn) ClientPID() (int, error) {
+	rawConn, err := c.File.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var pid uint32
+	var pidErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if r, _, err := procGetNamedPipeClientProcessId.Call(fd, uintptr(unsafe.Pointer(&pid))); r == 0 {
+			pidErr = err
+		}
+	})
+	if err != nil {
+		return -1, err
+	}
+	if pidErr != nil {
+		return -1, pidErr
+	}
+	return int(pid), nil
+}
+
+// pipeListener accepts the clients of a named pipe. An instance of the
+// pipe always waits for the next client, so the name never disappears
+// between two connections.
+type pipeListener struct {
+	addr pipeAddr
+	sa   *windows.SecurityAttributes
+	// closed is signaled by Close to interrupt a pending Accept
+	closed windows.Handle
+
+	mu     sync.Mutex
+	handle windows.Handle
+	done   bool
+}
+
+// ListenPipe creates a named pipe only the server user and the system can
+// open, refusing remote clients.
+func ListenPipe(path string) (net.Listener, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	sd, err := windows.SecurityDescriptorFromString("D:P(A;;GA;;;" + user.User.Sid.String() + ")(A;;GA;;;SY)")
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{
+		addr: pipeAddr(path),
+		sa:   &windows.SecurityAttributes{SecurityDescriptor: sd},
+	}
+	l.sa.Length = uint32(unsafe.Sizeof(*l.sa))
+	if l.handle, err = l.newInstance(true); err != nil {
+		return nil, &os.PathError{Op: "listen", Path: path, Err: err}
+	}
+	if l.closed, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		windows.CloseHandle(l.handle)
+		return nil, err
+	}
+	return l, nil
+}
+
+// newInstance creates an instance of the pipe, the first one fails when
+// another process already owns the name.
+func (l *pipeListener) newInstance(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(string(l.addr))
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	return windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES,
+		pipeBufferSize, pipeBufferSize, 0, l.sa)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return nil, net.ErrClosed
+	}
+
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(event)
+	overlapped := windows.Overlapped{HEvent: event}
+	err = windows.ConnectNamedPipe(l.handle, &overlapped)
+	if err == windows.ERROR_IO_PENDING {
+		signaled, waitErr := windows.WaitForMultipleObjects([]windows.Handle{event, l.closed}, false, windows.INFINITE)
+		if waitErr != nil {
+			return nil, waitErr
+		}
+		if signaled != windows.WAIT_OBJECT_0 {
+			var n uint32
+			windows.CancelIoEx(l.handle, &overlapped)
+			windows.GetOverlappedResult(l.handle, &overlapped, &n, true)
+			return nil, net.ErrClosed
+		}
+		var n uint32
+		err = windows.GetOverlappedResult(l.handle, &overlapped, &n, false)
+	}
+	if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: err}
+	}
+
+	// Wait for the next client on a new instance, and hand the connected
+	// one over. The client stays connected if that fails, and is accepted
+	// on the next call.
+	next, err := l.newInstance(false)
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: err}
+	}
+	conn := &PipeConn{File: os.NewFile(uintptr(l.handle), string(l.addr)), addr: l.addr}
+	l.handle = next
+	return conn, nil
+}
+
+func (l *pipeListener) Close() error {
+	windows.SetEvent(l.closed)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return nil
+	}
+	l.done = true
+	return windows.CloseHandle(l.handle)
+}
+
+func (l *pipeListener) Addr() net.Addr { return l.addr }
+
+// dialPipe connects to a named pipe, waiting for a free instance while the
+// server is busy accepting other clients. The server may only identify the
+// client, not act as it.
+func dialPipe(path string) (net.Conn, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(pipeDialTimeout)
+	for {
+		handle, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return &PipeConn{File: os.NewFile(uintptr(handle), path), addr: pipeAddr(path)}, nil
+		}
+		if !errors.Is(err, windows.ERROR_PIPE_BUSY) || time.Now().After(deadline) {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(path), Err: err}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol negotiated over QUIC.
+const quicALPN = "hrun"
+
+var errQUICWithoutTLS = errors.New("QUIC requires a TLS certificate")
+
+// quicConfig keeps the connections of idle sessions alive.
+var quicConfig = &quic.Config{KeepAlivePeriod: 15 * time.Second}
+
+// QUICStreamConn is a bidirectional QUIC stream, carrying the byte
+// stream of a single hrun connection.
+type QUICStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+	// closeConn also closes the QUIC connection, for clients owning it
+	closeConn bool
+}
+
+func (c *QUICStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *QUICStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// ConnectionState returns the TLS state of the QUIC connection.
+func (c *QUICStreamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Read reports the stream closed here as net.ErrClosed, and the
+// connection closed by the peer as io.EOF, as other connections do.
+func (c *QUICStreamConn) Read(p []byte) (int, error) {
+	n, err := c.Stream.Read(p)
+	var streamErr *quic.StreamError
+	var appErr *quic.ApplicationError
+	switch {
+	case errors.As(err, &streamErr) && !streamErr.Remote:
+		err = net.ErrClosed
+	case errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0:
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close closes both directions of the stream, Close on a quic.Stream
+// only closes the sending one.
+func (c *QUICStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	err := c.Stream.Close()
+	if c.closeConn {
+		c.conn.CloseWithError(0, "")
+	}
+	return err
+}
+
+// quicListener accepts the streams of every QUIC connection, each of them
+// served as a connection of its own.
+type quicListener struct {
+	listener *quic.Listener
+	conns    chan net.Conn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	close    func() error
+}
+
+// listenQUIC listens for QUIC connections on a UDP address.
+func listenQUIC(address string, config *tls.Config) (net.Listener, error) {
+	config = config.Clone()
+	config.NextProtos = []string{quicALPN}
+	listener, err := quic.ListenAddr(address, config, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	l := &quicListener{listener: listener, conns: make(chan net.Conn)}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.close = sync.OnceValue(func() error {
+		l.cancel()
+		return l.listener.Close()
+	})
+	go l.acceptConnections()
+	return l, nil
+}
+
+func (l *quicListener) acceptConnections() {
+	for {
+		conn, err := l.listener.Accept(l.ctx)
+		if err != nil {
+			if l.ctx.Err() == nil {
+				slog.Error("Error accepting QUIC connection", "err", err)
+				l.close()
+			}
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+// acceptStreams hands the streams opened by a client over to Accept,
+// until the connection is closed.
+func (l *quicListener) acceptStreams(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.conns <- &QUICStreamConn{Stream: stream, conn: conn}:
+		case <-l.ctx.Done():
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error   { return l.close() }
+func (l *quicListener) Addr() net.Addr { return l.listener.Addr() }
+
+// dialQUIC opens a QUIC connection with a single stream, the system
+// authorities verify the server when config is nil.
+func dialQUIC(ctx context.Context, address string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS13}
+	}
+	config = config.Clone()
+	config.NextProtos = []string{quicALPN}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, address, config, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &QUICStreamConn{Stream: stream, conn: conn, closeConn: true}, nil
+}
@@ -0,0 +1,193 @@
+// Package transport dials and listens on the addresses hrun connects over:
+// unix sockets, Windows named pipes, TCP with optional TLS, QUIC and vsock.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ParseAddress splits an address into the network and the address to
+// listen on or dial: tcp://host:port for TCP, quic://host:port for QUIC,
+// vsock://cid:port for virtual machine sockets, ws://host:port for
+// WebSocket, ssh://host:port for SSH, grpc://host:port for gRPC,
+// varlink:///path for varlink, dbus://session or dbus://system for D-Bus,
+// \\.\pipe\name for Windows named pipes, launchd://name for a socket of
+// launchd and unix:///path or a plain path for unix sockets, abstract ones
+// when starting with @.
+func ParseAddress(addr string) (network, address string, err error) {
+	if IsNamedPipe(addr) {
+		return "pipe", addr, nil
+	}
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		return "unix", addr, nil
+	}
+	switch scheme {
+	case "unix":
+		return "unix", rest, nil
+	case "varlink":
+		if rest == "" {
+			return "", "", fmt.Errorf("invalid varlink address %q, expected varlink:///path", addr)
+		}
+		return "varlink", rest, nil
+	case "dbus":
+		if rest != "session" && rest != "system" {
+			return "", "", fmt.Errorf("invalid D-Bus address %q, expected dbus://session or dbus://system", addr)
+		}
+		return "dbus", rest, nil
+	case "launchd":
+		if rest == "" {
+			return "", "", fmt.Errorf("invalid launchd address %q, expected launchd://name", addr)
+		}
+		return "launchd", rest, nil
+	case "tcp", "quic", "ws", "ssh", "grpc":
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return "", "", fmt.Errorf("invalid %s address %q: %w", strings.ToUpper(scheme), addr, err)
+		}
+		return scheme, rest, nil
+	case "vsock":
+		if _, err := parseVsockAddr(rest); err != nil {
+			return "", "", err
+		}
+		return "vsock", rest, nil
+	}
+	return "", "", fmt.Errorf("unknown transport %q, expected unix, tcp, quic, vsock, ws, ssh, grpc, varlink, dbus or launchd", scheme)
+}
+
+// IsAbstractSocket reports whether path names a socket of the Linux
+// abstract namespace, which starts with @ and has no file to clean up.
+func IsAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// IsNamedPipe reports whether path names a Windows named pipe.
+func IsNamedPipe(path string) bool {
+	return strings.HasPrefix(path, `\\.\pipe\`)
+}
+
+// Listen listens on an address accepted by ParseAddress, with TLS over TCP
+// when config is not nil. QUIC requires config. The launchd, WebSocket,
+// SSH, gRPC, varlink and D-Bus addresses are served by the server.
+func Listen(addr string, config *tls.Config) (net.Listener, error) {
+	network, address, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "vsock":
+		vsock, _ := parseVsockAddr(address)
+		return listenVsock(vsock)
+	case "pipe":
+		return ListenPipe(address)
+	case "launchd", "ws", "ssh", "grpc", "varlink", "dbus":
+		return nil, fmt.Errorf("%s addresses are only served by the server", network)
+	case "quic":
+		if config == nil {
+			return nil, errQUICWithoutTLS
+		}
+		return listenQUIC(address, config)
+	}
+	if network == "unix" {
+		return ListenUnix(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil || network != "tcp" || config == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// ErrServerRunning is returned when listening on a socket another server
+// listens on.
+var ErrServerRunning = errors.New("a server is already listening")
+
+// ListenUnix listens on a unix socket, creating its directory when
+// missing and replacing the socket file left behind by a server that
+// didn't shut down gracefully. The file is removed once the listener is
+// closed.
+func ListenUnix(path string) (net.Listener, error) {
+	if !IsAbstractSocket(path) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket removes the socket at path when no server listens on
+// it, and fails when one does. Anything else than a socket is left for
+// listening to fail on.
+func removeStaleSocket(path string) error {
+	if IsAbstractSocket(path) {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode().Type() != os.ModeSocket {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w on %s", ErrServerRunning, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing the stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// Dial connects to an address accepted by ParseAddress, with TLS over
+// TCP when config is not nil. QUIC verifies the server against the system
+// authorities when config is nil.
+func Dial(addr string, config *tls.Config) (net.Conn, error) {
+	return DialContext(context.Background(), addr, config)
+}
+
+// DialContext is like Dial, giving up on connecting once ctx is done.
+func DialContext(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	network, address, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case network == "vsock":
+		vsock, _ := parseVsockAddr(address)
+		return dialVsock(vsock)
+	case network == "pipe":
+		return dialPipe(address)
+	case network == "quic":
+		return dialQUIC(ctx, address, config)
+	case network == "ws":
+		return nil, errors.New("WebSocket addresses are for browsers, connect over TCP instead")
+	case network == "ssh":
+		return nil, errors.New("SSH addresses are for SSH clients, connect over TCP instead")
+	case network == "grpc":
+		return nil, errors.New("gRPC addresses are for gRPC clients, connect over TCP instead")
+	case network == "varlink":
+		return nil, errors.New("varlink addresses are for varlink clients, connect to a unix socket instead")
+	case network == "dbus":
+		return nil, errors.New("D-Bus addresses are for D-Bus clients, connect to a unix socket instead")
+	case network == "launchd":
+		return nil, errors.New("launchd addresses are for the server, connect to the socket path instead")
+	case network == "tcp" && config != nil:
+		dialer := &tls.Dialer{Config: config}
+		return dialer.DialContext(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
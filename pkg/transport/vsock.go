@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// vsockCIDAny is the context ID listening on every one, VMADDR_CID_ANY.
+const vsockCIDAny = 0xffffffff
+
+// vsockAddr is the address of a virtual machine socket: the context ID of
+// the machine, 2 for the host, and a port.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+
+func (a vsockAddr) String() string {
+	if a.cid == vsockCIDAny {
+		return "any:" + strconv.FormatUint(uint64(a.port), 10)
+	}
+	return fmt.Sprintf("%d:%d", a.cid, a.port)
+}
+
+// parseVsockAddr parses a cid:port address, the CID being any to listen
+// on every one.
+func parseVsockAddr(addr string) (vsockAddr, error) {
+	cid, port, ok := strings.Cut(addr, ":")
+	if !ok {
+		return vsockAddr{}, fmt.Errorf("invalid vsock address %q, expected cid:port", addr)
+	}
+	var a vsockAddr
+	if cid == "any" {
+		a.cid = vsockCIDAny
+	} else {
+		n, err := strconv.ParseUint(cid, 10, 32)
+		if err != nil {
+			return vsockAddr{}, fmt.Errorf("invalid vsock context ID %q", cid)
+		}
+		a.cid = uint32(n)
+	}
+	n, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return vsockAddr{}, fmt.Errorf("invalid vsock port %q", port)
+	}
+	a.port = uint32(n)
+	return a, nil
+}
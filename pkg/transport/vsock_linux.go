@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockConn is a connected virtual machine socket. The file is
+// non-blocking, so reads and writes go through the runtime poller and
+// support deadlines.
+type vsockConn struct {
+	*os.File
+	local, remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// vsockListener accepts virtual machine socket connections.
+type vsockListener struct {
+	file *os.File
+	addr vsockAddr
+}
+
+// listenVsock listens on a virtual machine socket.
+func listenVsock(addr vsockAddr) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return &vsockListener{file: os.NewFile(uintptr(fd), "vsock:"+addr.String()), addr: addr}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rawConn, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err = rawConn.Read(func(listenFD uintptr) bool {
+		fd, sa, acceptErr = unix.Accept4(int(listenFD), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return !errors.Is(acceptErr, unix.EAGAIN)
+	})
+	if errors.Is(err, os.ErrClosed) {
+		return nil, net.ErrClosed
+	}
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("accept", err)
+	}
+	conn := &vsockConn{File: os.NewFile(uintptr(fd), "vsock"), local: l.addr}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		conn.remote = vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+	return conn, nil
+}
+
+func (l *vsockListener) Close() error   { return l.file.Close() }
+func (l *vsockListener) Addr() net.Addr { return l.addr }
+
+// dialVsock connects to a virtual machine socket.
+func dialVsock(addr vsockAddr) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// Connect while blocking, the poller only takes over the connection
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	conn := &vsockConn{File: os.NewFile(uintptr(fd), "vsock"), remote: addr}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			conn.local = vsockAddr{cid: vm.CID, port: vm.Port}
+		}
+	}
+	return conn, nil
+}
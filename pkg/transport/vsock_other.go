@@ -0,0 +1,18 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+var errVsockUnsupported = errors.New("vsock is only available on Linux")
+
+func listenVsock(addr vsockAddr) (net.Listener, error) {
+	return nil, errVsockUnsupported
+}
+
+func dialVsock(addr vsockAddr) (net.Conn, error) {
+	return nil, errVsockUnsupported
+}